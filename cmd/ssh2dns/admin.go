@@ -0,0 +1,57 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/fudanchii/ssh2dns/internal/admin"
+	"github.com/fudanchii/ssh2dns/internal/reload"
+	"github.com/miekg/dns"
+)
+
+// adminCommands are the commands served on -admin, each running what a signal or restart would otherwise.
+func adminCommands(dep Dependencies, reloaders []reload.Reloader) map[string]admin.Command {
+	return map[string]admin.Command{
+		"stats": func(w io.Writer, _ []string) error {
+			if stat, ok := dep.ClientPool.(fmt.Stringer); ok {
+				fmt.Fprintln(w, stat.String())
+			}
+			_, err := fmt.Fprintf(w, "cache entries: %d\n", dep.Lookup.CacheLen())
+			return err
+		},
+		"cache flush": func(w io.Writer, _ []string) error {
+			dep.Lookup.FlushCache()
+			return nil
+		},
+		"cache delete": func(w io.Writer, args []string) error {
+			if len(args) < 1 || len(args) > 2 {
+				return fmt.Errorf("usage: cache delete <name> [type]")
+			}
+			qtype := uint16(0)
+			if len(args) == 2 {
+				var ok bool
+				if qtype, ok = dns.StringToType[strings.ToUpper(args[1])]; !ok {
+					return fmt.Errorf("unknown record type %s", args[1])
+				}
+			}
+			_, err := fmt.Fprintf(w, "deleted %d entries\n", dep.Lookup.DeleteCache(args[0], qtype))
+			return err
+		},
+		"cache dump": func(w io.Writer, _ []string) error {
+			return dep.Lookup.DumpCache(w)
+		},
+		"pool reset": func(w io.Writer, _ []string) error {
+			pool, ok := dep.ClientPool.(interface{ Reset() })
+			if !ok {
+				return fmt.Errorf("-upstream %s has no connection pool to reset", dep.Config.Upstream())
+			}
+			pool.Reset()
+			return nil
+		},
+		"reload": func(w io.Writer, _ []string) error {
+			reload.All(reloaders...)
+			return nil
+		},
+	}
+}
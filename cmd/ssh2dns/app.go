@@ -1,13 +1,19 @@
 package main
 
 import (
+	"context"
+	"fmt"
 	"os"
 
+	"github.com/fudanchii/ssh2dns/internal/admin"
 	"github.com/fudanchii/ssh2dns/internal/config"
 	"github.com/fudanchii/ssh2dns/internal/log"
+	"github.com/fudanchii/ssh2dns/internal/metrics"
 	"github.com/fudanchii/ssh2dns/internal/proxy"
 	"github.com/fudanchii/ssh2dns/internal/recdns"
-	"github.com/fudanchii/ssh2dns/internal/ssh"
+	"github.com/fudanchii/ssh2dns/internal/reload"
+	"github.com/fudanchii/ssh2dns/internal/tracing"
+	"github.com/fudanchii/ssh2dns/internal/upstream"
 	"go.uber.org/dig"
 )
 
@@ -16,6 +22,7 @@ type Dependencies struct {
 
 	Config     *config.AppConfig
 	ClientPool recdns.DNSClientPool
+	Lookup     *recdns.LookupCoordinator
 	DNSProxy   *proxy.Proxy
 }
 
@@ -37,13 +44,64 @@ func (c *container) provide(cons ...interface{}) *dig.Container {
 func setupAppContainer() *dig.Container {
 	return (&container{dig.New()}).provide(
 		config.New,
-		ssh.NewClientPool,
+		upstream.New,
+		recdns.New,
 		proxy.New,
 	)
 }
 
-func appStart(signal chan os.Signal) func(Dependencies) {
+type signals struct {
+	shutdown chan os.Signal
+	reload   chan os.Signal
+	dump     chan os.Signal
+	debug    chan os.Signal
+}
+
+func appStart(sig signals) func(Dependencies) {
 	return func(dep Dependencies) {
+		if endpoint := dep.Config.OTLPEndpoint(); endpoint != "" {
+			shutdown, err := tracing.Setup(context.TODO(), endpoint, dep.Config.InstanceName())
+			if err != nil {
+				log.Err(err.Error())
+			} else {
+				log.Info("exporting traces to " + endpoint)
+				defer shutdown(context.TODO())
+			}
+		}
+
+		reloaders := []reload.Reloader{dep.DNSProxy, dep.Lookup}
+		if r, ok := dep.ClientPool.(reload.Reloader); ok {
+			reloaders = append(reloaders, r)
+		}
+
+		// bound before dropping privileges, the socket usually goes somewhere like /run
+		if path := dep.Config.AdminSocket(); path != "" {
+			srv, err := admin.NewServer(path, adminCommands(dep, reloaders))
+			if err != nil {
+				log.Fatal(err.Error())
+			}
+			go func() {
+				log.Info("serving admin commands on " + path)
+				if err := srv.Serve(); err != nil {
+					log.Err(err.Error())
+				}
+			}()
+			defer srv.Close()
+		}
+
+		// written before dropping privileges too, for the same reason
+		if path := dep.Config.PIDFile(); path != "" {
+			if err := writePIDFile(path); err != nil {
+				log.Fatal(err.Error())
+			}
+			defer removePIDFile(path)
+		}
+
+		// the proxy, DNS-over-HTTPS included, is bound by now, serving needs no privileges
+		if err := dropPrivileges(dep.Config.User(), dep.Config.Group()); err != nil {
+			log.Fatal(err.Error())
+		}
+
 		go func(dep *Dependencies) {
 			log.Info("Listening...")
 			if err := dep.DNSProxy.ListenAndServe(); err != nil {
@@ -53,6 +111,75 @@ func appStart(signal chan os.Signal) func(Dependencies) {
 
 		defer dep.DNSProxy.Shutdown()
 
-		<-signal
+		if addr := dep.Config.MetricsAddr(); addr != "" {
+			srv := metrics.NewServer(addr)
+			go func() {
+				log.Info("serving metrics on " + addr)
+				if err := srv.ListenAndServe(); err != nil {
+					log.Err(err.Error())
+				}
+			}()
+			defer srv.Shutdown(context.TODO())
+		}
+
+		if addr := dep.Config.PprofAddr(); addr != "" {
+			srv := metrics.NewProfileServer(addr)
+			go func() {
+				log.Info("serving profiles on " + addr)
+				if err := srv.ListenAndServe(); err != nil {
+					log.Err(err.Error())
+				}
+			}()
+			defer srv.Shutdown(context.TODO())
+		}
+
+		if file := dep.Config.PreloadFile(); file != "" && dep.Config.CacheOnly() {
+			log.Err("not preloading " + file + ", -cache-only makes no lookups")
+		} else if file != "" {
+			go func() {
+				if err := dep.Lookup.Preload(file, dep.Config.WorkerNum()); err != nil {
+					log.Err(err.Error())
+				}
+			}()
+		}
+
+		for {
+			select {
+			case <-sig.shutdown:
+				return
+			case <-sig.reload:
+				reload.All(reloaders...)
+			case <-sig.dump:
+				if stat, ok := dep.ClientPool.(fmt.Stringer); ok {
+					log.Info(stat.String())
+				}
+			case <-sig.debug:
+				if log.ToggleDebug() {
+					log.Info("debug logging enabled")
+				} else {
+					log.Info("debug logging disabled")
+				}
+			}
+		}
 	}
 }
+
+// command picks what to run from the positional arguments,
+// without any the DNS proxy is started.
+func command(cfg *config.AppConfig, sig signals) (interface{}, error) {
+	if cfg.Probe() {
+		return probe, nil
+	}
+
+	args := cfg.Args()
+	if len(args) == 0 {
+		return appStart(sig), nil
+	}
+
+	switch args[0] {
+	case "resolve":
+		return resolve, nil
+	}
+
+	return nil, fmt.Errorf("unknown command: %s", args[0])
+}
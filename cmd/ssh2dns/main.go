@@ -11,6 +11,17 @@
 //
 //	$ ssh2dns -s example.com:22 -b localhost:53
 //
+// To resolve a single name and print the lookup trace without listening:
+//
+//	$ ssh2dns -s example.com:22 -r resolve example.com A
+//
+// To check the upstream is reachable, e.g. from a health check, exiting with 1 if it isn't:
+//
+//	$ ssh2dns -s example.com:22 -probe
+//
+// Send SIGHUP to reload reloadable subsystems, e.g. the DNS-over-HTTPS certificate or the ssh keys, and flush the cache,
+// SIGUSR1 to log the ssh connection pool statistics, and SIGUSR2 to toggle debug logging.
+//
 // See ssh2dns -help for available options.
 
 package main
@@ -21,16 +32,44 @@ import (
 	"os/signal"
 	"syscall"
 
+	"github.com/fudanchii/ssh2dns/internal/config"
 	"github.com/fudanchii/ssh2dns/internal/log"
+	"github.com/fudanchii/ssh2dns/internal/metrics"
 )
 
 func main() {
-	shutdownSignal := make(chan os.Signal, 1)
-	signal.Notify(shutdownSignal, syscall.SIGINT, syscall.SIGQUIT, syscall.SIGTERM)
+	sig := signals{
+		shutdown: make(chan os.Signal, 1),
+		reload:   make(chan os.Signal, 1),
+		dump:     make(chan os.Signal, 1),
+		debug:    make(chan os.Signal, 1),
+	}
+	signal.Notify(sig.shutdown, syscall.SIGINT, syscall.SIGQUIT, syscall.SIGTERM)
+	signal.Notify(sig.reload, syscall.SIGHUP)
+	signal.Notify(sig.dump, syscall.SIGUSR1)
+	signal.Notify(sig.debug, syscall.SIGUSR2)
+
+	container := setupAppContainer()
+
+	var cfg *config.AppConfig
+	if err := container.Invoke(func(c *config.AppConfig) { cfg = c }); err != nil {
+		log.Err(err.Error())
+		os.Exit(1)
+	}
+
+	log.SetInstance(cfg.InstanceName())
+	log.SetDebug(cfg.Debug())
+	metrics.Instance.Set(cfg.InstanceName())
 
 	log.Info("Starting...")
 
-	if err := setupAppContainer().Invoke(appStart(shutdownSignal)); err != nil {
+	cmd, err := command(cfg, sig)
+	if err != nil {
+		log.Err(err.Error())
+		os.Exit(1)
+	}
+
+	if err := container.Invoke(cmd); err != nil {
 		log.Err(err.Error())
 		os.Exit(1)
 	}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/fudanchii/ssh2dns/internal/errors"
+	"github.com/fudanchii/ssh2dns/internal/log"
+)
+
+// writePIDFile writes our process ID to path. A file left over by a previous run is overwritten,
+// one naming a process still running belongs to a live instance.
+func writePIDFile(path string) error {
+	if data, err := os.ReadFile(path); err == nil {
+		pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+		if err == nil && pid != os.Getpid() && processRunning(pid) {
+			return fmt.Errorf("pidfile %s is in use by running process %d", path, pid)
+		}
+		log.Err("overwriting stale pidfile " + path)
+	}
+
+	return os.WriteFile(path, []byte(strconv.Itoa(os.Getpid())+"\n"), 0o644)
+}
+
+// removePIDFile removes path on shutdown, unless it was taken over since by another instance.
+func removePIDFile(path string) {
+	data, err := os.ReadFile(path)
+	if err != nil || strings.TrimSpace(string(data)) != strconv.Itoa(os.Getpid()) {
+		return
+	}
+	// with -user, the directory it's in may no longer be writable for us
+	if err := os.Remove(path); err != nil {
+		log.Err(err.Error())
+	}
+}
+
+func processRunning(pid int) bool {
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	// signal 0 only checks the process exists, one we may not signal exists too
+	err = p.Signal(syscall.Signal(0))
+	return err == nil || errors.Is(err, os.ErrPermission)
+}
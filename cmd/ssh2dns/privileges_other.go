@@ -0,0 +1,15 @@
+//go:build !unix
+
+package main
+
+import (
+	"fmt"
+	"runtime"
+)
+
+func dropPrivileges(username, groupname string) error {
+	if username == "" && groupname == "" {
+		return nil
+	}
+	return fmt.Errorf("-user and -group are not supported on %s", runtime.GOOS)
+}
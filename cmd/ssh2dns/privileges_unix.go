@@ -0,0 +1,69 @@
+//go:build unix
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/user"
+	"strconv"
+	"syscall"
+)
+
+// dropPrivileges switches to username and groupname, once the listeners are bound
+// and before any query is served, so binding :53 doesn't mean running as root.
+// groupname defaults to the user's primary group.
+func dropPrivileges(username, groupname string) error {
+	if username == "" && groupname == "" {
+		return nil
+	}
+
+	uid, gid := -1, -1
+
+	if username != "" {
+		u, err := user.Lookup(username)
+		if err != nil {
+			return err
+		}
+		if uid, err = strconv.Atoi(u.Uid); err != nil {
+			return err
+		}
+		if groupname == "" {
+			if gid, err = strconv.Atoi(u.Gid); err != nil {
+				return err
+			}
+		}
+	}
+
+	if groupname != "" {
+		g, err := user.LookupGroup(groupname)
+		if err != nil {
+			return err
+		}
+		if gid, err = strconv.Atoi(g.Gid); err != nil {
+			return err
+		}
+	}
+
+	// group first, we can't change it anymore once we are no longer root
+	if gid >= 0 {
+		if err := syscall.Setgroups([]int{gid}); err != nil {
+			return fmt.Errorf("cannot drop supplementary groups: %w", err)
+		}
+		if err := syscall.Setgid(gid); err != nil {
+			return fmt.Errorf("cannot switch to group %d: %w", gid, err)
+		}
+	}
+
+	if uid >= 0 {
+		if err := syscall.Setuid(uid); err != nil {
+			return fmt.Errorf("cannot switch to user %d: %w", uid, err)
+		}
+	}
+
+	if uid >= 0 && os.Getuid() != uid {
+		return fmt.Errorf("still running as user %d after switching to %d", os.Getuid(), uid)
+	}
+
+	return nil
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/fudanchii/ssh2dns/internal/config"
+	"github.com/fudanchii/ssh2dns/internal/recdns"
+	"github.com/miekg/dns"
+	"go.uber.org/dig"
+)
+
+type probeDependencies struct {
+	dig.In
+
+	Config     *config.AppConfig
+	ClientPool recdns.DNSClientPool
+	Lookup     *recdns.LookupCoordinator
+}
+
+// probe checks the upstream is usable, connecting the pool first, then resolving the probe name
+// through the lookup coordinator the listener would use. A failure makes ssh2dns exit with 1.
+func probe(dep probeDependencies) error {
+	defer dep.Lookup.Close()
+
+	ctx, cancel := context.WithTimeout(context.TODO(), dep.Lookup.Timeout())
+	defer cancel()
+
+	start := time.Now()
+	cli, err := dep.ClientPool.Acquire(ctx)
+	if err != nil {
+		fmt.Printf("FAIL connect after %s: %s\n", time.Since(start), err.Error())
+		return fmt.Errorf("probe failed")
+	}
+	cli.Release()
+	connected := time.Since(start)
+
+	msg := new(dns.Msg)
+	msg.SetQuestion(dns.Fqdn(dep.Config.ProbeName()), dns.TypeA)
+
+	start = time.Now()
+	rsp, err := dep.Lookup.Handle(ctx, msg)
+	elapsed := time.Since(start)
+
+	switch {
+	case err != nil:
+		fmt.Printf("FAIL lookup %s after %s (connect %s): %s\n", msg.Question[0].Name, elapsed, connected, err.Error())
+		return fmt.Errorf("probe failed")
+	case rsp.Rcode != dns.RcodeSuccess:
+		fmt.Printf("FAIL lookup %s after %s (connect %s): %s\n", msg.Question[0].Name, elapsed, connected, dns.RcodeToString[rsp.Rcode])
+		return fmt.Errorf("probe failed")
+	}
+
+	fmt.Printf("OK connect %s, lookup %s %s, %d answers\n", connected, msg.Question[0].Name, elapsed, len(rsp.Answer))
+	return nil
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fudanchii/ssh2dns/internal/config"
+	"github.com/fudanchii/ssh2dns/internal/recdns"
+	"github.com/miekg/dns"
+	"go.uber.org/dig"
+)
+
+type resolveDependencies struct {
+	dig.In
+
+	Config *config.AppConfig
+	Lookup *recdns.LookupCoordinator
+}
+
+// resolve looks up a single name, printing every upstream exchange
+// and the final answer in dig-like format.
+func resolve(dep resolveDependencies) error {
+	defer dep.Lookup.Close()
+
+	args := dep.Config.Args()[1:]
+	if len(args) < 1 {
+		return fmt.Errorf("usage: ssh2dns [options] resolve <name> [type]")
+	}
+
+	name, qtype := dns.Fqdn(args[0]), dns.TypeA
+
+	if len(args) > 1 {
+		t, ok := dns.StringToType[strings.ToUpper(args[1])]
+		if !ok {
+			return fmt.Errorf("unknown record type: %s", args[1])
+		}
+		qtype = t
+	}
+
+	var (
+		mu   sync.Mutex
+		step int
+	)
+
+	dep.Lookup.SetTrace(func(t recdns.TraceStep) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		step++
+		fmt.Print(formatTraceStep(step, t))
+	})
+
+	msg := new(dns.Msg)
+	msg.SetQuestion(name, qtype)
+
+	start := time.Now()
+	rsp, err := dep.Lookup.Handle(context.TODO(), msg)
+	elapsed := time.Since(start)
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	if err != nil {
+		return err
+	}
+
+	fmt.Println()
+	fmt.Println(rsp.String())
+	fmt.Printf(";; Query time: %s\n", elapsed)
+
+	return nil
+}
+
+func formatTraceStep(step int, t recdns.TraceStep) string {
+	var sb strings.Builder
+
+	fmt.Fprintf(&sb, ";; [%d] @%s %s %s %s: ",
+		step, t.Server, t.Question.Name, dns.TypeToString[t.Question.Qtype], t.Duration)
+
+	if t.Err != nil {
+		fmt.Fprintf(&sb, "error: %s\n", t.Err.Error())
+		return sb.String()
+	}
+
+	fmt.Fprintf(&sb, "%s, answer: %d, authority: %d, additional: %d\n",
+		dns.RcodeToString[t.Response.Rcode], len(t.Response.Answer), len(t.Response.Ns), len(t.Response.Extra))
+
+	if len(t.Response.Answer) == 0 {
+		for _, rr := range t.Response.Ns {
+			if ns, ok := rr.(*dns.NS); ok {
+				fmt.Fprintf(&sb, ";;     delegated %s to %s\n", ns.Hdr.Name, ns.Ns)
+			}
+		}
+	}
+
+	return sb.String()
+}
@@ -0,0 +1,160 @@
+// Package admin serves runtime commands to local operators over a Unix socket,
+// one command per line, e.g. with socat - UNIX-CONNECT:/run/ssh2dns.sock.
+// The output of every command is followed by a line with OK, or ERR and the reason it failed.
+package admin
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/fudanchii/ssh2dns/internal/errors"
+	"github.com/fudanchii/ssh2dns/internal/log"
+)
+
+// Command runs one admin command, writing what it has to tell to w,
+// args are the words following the command name on its line.
+type Command func(w io.Writer, args []string) error
+
+type Server struct {
+	path     string
+	listener net.Listener
+	commands map[string]Command
+
+	mu    sync.Mutex
+	conns map[net.Conn]struct{}
+	wg    sync.WaitGroup
+}
+
+// NewServer listens on a Unix socket at path for the given commands, keyed by their name,
+// which may have several words, e.g. "cache flush". The socket is only accessible by its owner.
+func NewServer(path string, commands map[string]Command) (*Server, error) {
+	// a socket left over by a previous run would fail the bind, one still answering belongs to a live instance
+	if fi, err := os.Lstat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		if conn, err := net.Dial("unix", path); err == nil {
+			conn.Close()
+			return nil, fmt.Errorf("admin socket %s is in use by another process", path)
+		}
+		os.Remove(path)
+	}
+
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, 0o600); err != nil {
+		listener.Close()
+		return nil, err
+	}
+
+	return &Server{
+		path:     path,
+		listener: listener,
+		commands: commands,
+		conns:    map[net.Conn]struct{}{},
+	}, nil
+}
+
+func (s *Server) Serve() error {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+
+		s.mu.Lock()
+		s.conns[conn] = struct{}{}
+		s.mu.Unlock()
+
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			s.serveConn(conn)
+
+			s.mu.Lock()
+			delete(s.conns, conn)
+			s.mu.Unlock()
+		}()
+	}
+}
+
+func (s *Server) serveConn(conn net.Conn) {
+	defer conn.Close()
+
+	scanner := bufio.NewScanner(conn)
+	out := bufio.NewWriter(conn)
+	for scanner.Scan() {
+		line := strings.Join(strings.Fields(scanner.Text()), " ")
+		switch line {
+		case "":
+			continue
+		case "quit":
+			return
+		case "help":
+			fmt.Fprintln(out, strings.Join(s.names(), "\n"))
+			fmt.Fprintln(out, "OK")
+		default:
+			s.run(out, line)
+		}
+		if err := out.Flush(); err != nil {
+			return
+		}
+	}
+}
+
+func (s *Server) run(out io.Writer, line string) {
+	cmd, args, ok := s.lookup(line)
+	if !ok {
+		fmt.Fprintf(out, "ERR unknown command %q, see help\n", line)
+		return
+	}
+
+	log.Info("admin: " + line)
+	if err := cmd(out, args); err != nil {
+		fmt.Fprintln(out, "ERR "+err.Error())
+		return
+	}
+	fmt.Fprintln(out, "OK")
+}
+
+// lookup finds the command with the longest name line starts with, the rest of the line are its arguments.
+func (s *Server) lookup(line string) (Command, []string, bool) {
+	words := strings.Fields(line)
+	for n := len(words); n > 0; n-- {
+		if cmd, ok := s.commands[strings.Join(words[:n], " ")]; ok {
+			return cmd, words[n:], true
+		}
+	}
+	return nil, nil, false
+}
+
+func (s *Server) names() []string {
+	names := []string{"help", "quit"}
+	for name := range s.commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Close stops listening, hangs up on connected operators, and waits for running commands to finish.
+func (s *Server) Close() error {
+	err := s.listener.Close()
+
+	s.mu.Lock()
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.mu.Unlock()
+
+	s.wg.Wait()
+	return err
+}
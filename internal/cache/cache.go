@@ -2,10 +2,17 @@ package cache
 
 import (
 	"fmt"
+	"io"
+	"math"
+	"math/rand"
+	"slices"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/fudanchii/ssh2dns/internal/config"
 	"github.com/fudanchii/ssh2dns/internal/log"
+	"github.com/fudanchii/ssh2dns/internal/names"
 
 	"github.com/dgraph-io/ristretto"
 	"github.com/miekg/dns"
@@ -14,21 +21,51 @@ import (
 type Cache struct {
 	rc     *ristretto.Cache
 	config *config.AppConfig
+	keys   *keyIndex
+
+	// hints are the root server addresses, kept apart from ristretto so they are never evicted nor flushed
+	hints map[string]dnsCacheContent
+
+	// mu is held exclusively by Flush and SetHint only, ristretto's Clear must not run alongside anything else
+	mu sync.RWMutex
 }
 
 type dnsCacheContent struct {
 	Ts     time.Time
 	Ttl    time.Duration
+	Rcode  int
 	Answer []dns.RR
 	Ns     []dns.RR
 	Extra  []dns.RR
+
+	// key and seq tell the key index which entry is leaving the cache
+	key string
+	seq uint64
+}
+
+// entryOverhead approximates the memory an entry takes besides its packed records,
+// the key, the struct, and ristretto's own bookkeeping.
+const entryOverhead = 128
+
+// staleTTL is the TTL given to records served past their expiry, per RFC 8767 section 4.
+const staleTTL = 30
+
+// hintTTL is the TTL root hints are served with, whatever the hints file says,
+// the 6 days the root zone itself gives the root server addresses.
+const hintTTL = 518400
+
+// expiry is when the entry stops being served as fresh, we cache 3 times longer than TTL.
+func (c dnsCacheContent) expiry() time.Time {
+	return c.Ts.Add(c.Ttl * 3 * time.Second)
 }
 
 func New(cfg *config.AppConfig) *Cache {
+	keys := newKeyIndex()
 	cache, err := ristretto.NewCache(&ristretto.Config{
 		NumCounters: 1e7,
-		MaxCost:     1 << 30,
+		MaxCost:     int64(cfg.CacheSize()) << 20,
 		BufferItems: 64,
+		OnExit:      keys.onExit,
 	})
 
 	if err != nil {
@@ -39,57 +76,102 @@ func New(cfg *config.AppConfig) *Cache {
 		return nil
 	}
 
-	return &Cache{cache, cfg}
+	return &Cache{rc: cache, config: cfg, keys: keys, hints: map[string]dnsCacheContent{}}
 }
 
 func (cache *Cache) Get(msg *dns.Msg) (*dns.Msg, bool) {
-	cacheval, found := cache.rc.Get(keying(msg))
+	actualval, found := cache.get(msg)
+	if !found || time.Now().After(actualval.expiry()) {
+		return nil, false
+	}
+
+	// callers reorder and append to the sections, they must not do that to the cached ones
+	msg.Rcode = actualval.Rcode
+	msg.Answer = slices.Clone(actualval.Answer)
+	msg.Ns = slices.Clone(actualval.Ns)
+	msg.Extra = slices.Clone(actualval.Extra)
+
+	return msg, true
+}
+
+// GetStale returns the cached reply for msg even past its expiry,
+// as long as it is within the configured serve-stale window.
+// The records are copies carrying staleTTL, so clients come back soon for a fresh answer.
+// The returned flag tells whether the entry was actually expired.
+func (cache *Cache) GetStale(msg *dns.Msg) (rsp *dns.Msg, stale bool, found bool) {
+	actualval, found := cache.get(msg)
 	if !found {
-		return nil, found
+		return nil, false, false
 	}
 
-	actualval := cacheval.(dnsCacheContent)
+	stale = time.Now().After(actualval.expiry())
+
+	rsp = msg.Copy()
+	rsp.Rcode = actualval.Rcode
+	rsp.Answer = staleCopy(actualval.Answer)
+	rsp.Ns = staleCopy(actualval.Ns)
+	rsp.Extra = staleCopy(actualval.Extra)
+
+	return rsp, stale, true
+}
 
-	// evict cache when expired, cache 3 times longer than TTL
-	if time.Now().After(actualval.Ts.Add(actualval.Ttl * 3 * time.Second)) {
-		cache.rc.Del(keying(msg))
+func (cache *Cache) get(msg *dns.Msg) (dnsCacheContent, bool) {
+	cache.mu.RLock()
+	defer cache.mu.RUnlock()
+
+	// root hints answer whatever DNSSEC bits the query has, they are never validated anyway
+	key := keying(msg)
+	cacheval, found := cache.rc.Get(key)
+	if !found {
+		return cache.hint(questionKey(msg))
 	}
 
-	msg.Answer = actualval.Answer
-	msg.Ns = actualval.Ns
-	msg.Extra = actualval.Extra
+	actualval := cacheval.(dnsCacheContent)
 
-	return msg, true
+	// evict cache when expired, and past the serve-stale window if any
+	if time.Now().After(actualval.expiry().Add(cache.config.ServeStale())) {
+		cache.rc.Del(key)
+		return cache.hint(questionKey(msg))
+	}
+
+	return actualval, true
 }
 
 func (cache *Cache) Set(req *dns.Msg, msg *dns.Msg) {
-	if len(msg.Answer) == 0 && len(msg.Ns) == 0 && len(msg.Extra) == 0 {
-		// no cache for empty answers, authority, and additional sections
+	if len(msg.Answer) == 0 && len(msg.Ns) == 0 && len(msg.Extra) == 0 && !msg.Authoritative {
+		// no cache for empty answers, authority, and additional sections, unless we were told so with authority
 		return
 	}
 
-	firstSection := getFirstAvailableSection(msg)
+	kind := classify(msg)
+	policy := cache.policyFor(kind)
+	if !policy.Enabled {
+		return
+	}
 
-	ttl := firstSection.Header().Ttl
-	if ttl < 180 {
-		ttl = 180
+	ttl := clampTTL(ttlOf(kind, msg), policy)
+	if override, ok := cache.config.TTLOverride(req.Question[0].Qtype); ok {
+		ttl = uint32(override.Seconds())
 	}
+	ttl = jitter(ttl, cache.config.CacheJitter())
 
-	cache.rc.Set(keying(req), dnsCacheContent{
+	cache.store(keying(req), dnsCacheContent{
 		Ts:     time.Now(),
 		Ttl:    time.Duration(ttl),
-		Answer: msg.Answer,
-		Ns:     msg.Ns,
-		Extra:  msg.Extra,
-	}, 0)
+		Rcode:  msg.Rcode,
+		Answer: slices.Clone(msg.Answer),
+		Ns:     slices.Clone(msg.Ns),
+		Extra:  slices.Clone(msg.Extra),
+	}, cost(msg))
 }
 
 func (cache *Cache) SetFromRR(rr dns.RR) {
 	req := dns.Msg{
 		Question: []dns.Question{
 			{
-				Name:  rr.Header().Name,
-				Qtype: rr.Header().Rrtype,
+				Name:   rr.Header().Name,
+				Qtype:  rr.Header().Rrtype,
+				Qclass: rr.Header().Class,
 			},
 		},
 	}
@@ -100,14 +182,249 @@ func (cache *Cache) SetFromRR(rr dns.RR) {
 	cache.Set(&req, &msg)
 }
 
+// SetHint keeps rr, a root server address from the root hints, for as long as the cache lives.
+// It is answered with hintTTL, and survives eviction and Flush alike, so recursion never loses its starting point.
+func (cache *Cache) SetHint(rr dns.RR) {
+	rr = dns.Copy(rr)
+	rr.Header().Ttl = hintTTL
+	key := questionKey(&dns.Msg{Question: []dns.Question{{Name: rr.Header().Name, Qtype: rr.Header().Rrtype, Qclass: rr.Header().Class}}})
+
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+
+	content := cache.hints[key]
+	content.key = key
+	content.Answer = append(content.Answer, rr)
+	cache.hints[key] = content
+}
+
+// hint returns the root hint under key, always fresh, the mutex must be held.
+func (cache *Cache) hint(key string) (dnsCacheContent, bool) {
+	content, found := cache.hints[key]
+	if !found {
+		return dnsCacheContent{}, false
+	}
+	content.Ts = time.Now()
+	content.Ttl = hintTTL
+	return content, true
+}
+
+// SetDelegation caches the name servers of zone and their glue, as received in a referral,
+// for the time the NS records allow within the delegation cache policy.
+// They are kept apart from answers, a client asking for the NS of zone must still get an answer.
+func (cache *Cache) SetDelegation(zone string, ns []dns.RR, glue []dns.RR) {
+	if len(ns) == 0 {
+		return
+	}
+
+	policy := cache.policyFor(delegationReply)
+	if !policy.Enabled {
+		return
+	}
+
+	msg := &dns.Msg{Ns: ns, Extra: glue}
+	ttl := jitter(clampTTL(minTTL(ns), policy), cache.config.CacheJitter())
+
+	cache.store(delegationKey(zone), dnsCacheContent{
+		Ts:    time.Now(),
+		Ttl:   time.Duration(ttl),
+		Ns:    slices.Clone(ns),
+		Extra: slices.Clone(glue),
+	}, cost(msg))
+}
+
+// Delegation returns the cached name servers of zone and their glue as a referral, a copy the caller may modify.
+func (cache *Cache) Delegation(zone string) (*dns.Msg, bool) {
+	cache.mu.RLock()
+	defer cache.mu.RUnlock()
+
+	cacheval, found := cache.rc.Get(delegationKey(zone))
+	if !found {
+		return nil, false
+	}
+
+	actualval := cacheval.(dnsCacheContent)
+	if time.Now().After(actualval.expiry()) {
+		cache.rc.Del(delegationKey(zone))
+		return nil, false
+	}
+
+	// in random order, so the servers asked first don't always line up with the referral
+	ns := slices.Clone(actualval.Ns)
+	rand.Shuffle(len(ns), func(i, j int) { ns[i], ns[j] = ns[j], ns[i] })
+
+	return &dns.Msg{Ns: ns, Extra: slices.Clone(actualval.Extra)}, true
+}
+
+// store adds content under key, and to the key index as long as ristretto takes it.
+func (cache *Cache) store(key string, content dnsCacheContent, cost int64) {
+	cache.mu.RLock()
+	defer cache.mu.RUnlock()
+
+	content.key = key
+	content.seq = cache.keys.add(key)
+	if !cache.rc.Set(key, content, cost) {
+		cache.keys.drop(key, content.seq)
+	}
+}
+
+// Flush empties the cache but for the root hints, lookups going on meanwhile wait for it.
+func (cache *Cache) Flush() {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+
+	cache.rc.Clear()
+}
+
+// Delete removes the cached answers for name and qtype, in every class, and returns how many there were.
+// qtype 0 removes those of every type. Deleting NS, or every type, removes the cached delegation of name too.
+func (cache *Cache) Delete(name string, qtype uint16) int {
+	cache.mu.RLock()
+	defer cache.mu.RUnlock()
+
+	prefix := names.Canonical(name) + ":"
+	if qtype != 0 {
+		prefix += fmt.Sprintf("%d:", qtype)
+	}
+
+	deleted := 0
+	for _, key := range cache.keys.list() {
+		if strings.HasPrefix(key, prefix) || ((qtype == 0 || qtype == dns.TypeNS) && key == delegationKey(name)) {
+			cache.rc.Del(key)
+			deleted++
+		}
+	}
+	return deleted
+}
+
+// Len is the number of entries cached, answers, delegations, and root hints alike.
+func (cache *Cache) Len() int {
+	cache.mu.RLock()
+	defer cache.mu.RUnlock()
+
+	return cache.keys.len() + len(cache.hints)
+}
+
+// Dump writes every cached entry to w in zone file format, each preceded by a comment line
+// with its key, rcode, and how long until it expires. Root hints are only written when nothing
+// looked up replaces them.
+// The cache is only locked while each entry is read, a slow reader doesn't hold up Flush, nor lookups.
+func (cache *Cache) Dump(w io.Writer) error {
+	now := time.Now()
+	for _, key := range cache.dumpKeys() {
+		cache.mu.RLock()
+		content, found := cache.lookup(key)
+		cache.mu.RUnlock()
+		if !found {
+			continue
+		}
+
+		if _, err := fmt.Fprintf(w, ";; %s %s, expires in %s\n",
+			strings.TrimSuffix(key, ","), dns.RcodeToString[content.Rcode], content.expiry().Sub(now).Round(time.Second)); err != nil {
+			return err
+		}
+		for _, section := range [][]dns.RR{content.Answer, content.Ns, content.Extra} {
+			for _, rr := range section {
+				if rr.Header().Rrtype == dns.TypeOPT {
+					continue
+				}
+				if _, err := fmt.Fprintln(w, rr.String()); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+// dumpKeys lists the keys of ristretto entries and root hints, in order.
+func (cache *Cache) dumpKeys() []string {
+	keys := cache.keys.list()
+
+	cache.mu.RLock()
+	for key := range cache.hints {
+		keys = append(keys, key)
+	}
+	cache.mu.RUnlock()
+
+	slices.Sort(keys)
+	return slices.Compact(keys)
+}
+
+// lookup returns the entry under key, from ristretto or the root hints, the mutex must be held.
+func (cache *Cache) lookup(key string) (dnsCacheContent, bool) {
+	if cacheval, found := cache.rc.Get(key); found {
+		return cacheval.(dnsCacheContent), true
+	}
+	return cache.hint(key)
+}
+
+func minTTL(rrs []dns.RR) uint32 {
+	ttl := rrs[0].Header().Ttl
+	for _, rr := range rrs[1:] {
+		ttl = min(ttl, rr.Header().Ttl)
+	}
+	return ttl
+}
+
+func staleCopy(rrs []dns.RR) []dns.RR {
+	if len(rrs) == 0 {
+		return nil
+	}
+
+	copied := make([]dns.RR, 0, len(rrs))
+	for _, rr := range rrs {
+		rr = dns.Copy(rr)
+		if rr.Header().Rrtype != dns.TypeOPT {
+			rr.Header().Ttl = staleTTL
+		}
+		copied = append(copied, rr)
+	}
+	return copied
+}
+
+// jitter moves ttl by a random amount up to percent of it either way,
+// so records cached together with the same TTL don't all expire at once.
+func jitter(ttl uint32, percent float64) uint32 {
+	if percent <= 0 || ttl == 0 {
+		return ttl
+	}
+	offset := float64(ttl) * percent / 100 * (2*rand.Float64() - 1)
+	return uint32(math.Max(0, math.Round(float64(ttl)+offset)))
+}
+
+// cost is what an entry for msg weighs against -cache-size, roughly its size in memory.
+// Parsed records take more than packed ones, but in proportion, which is what eviction needs.
+func cost(msg *dns.Msg) int64 {
+	return int64(msg.Len()) + entryOverhead
+}
+
+// keying keys the entry for req by its question and the DNSSEC bits the reply depends on,
+// DO telling whether it carries signatures, CD whether the upstream validated it.
 func keying(req *dns.Msg) string {
+	key := questionKey(req)
+	if opt := req.IsEdns0(); opt != nil && opt.Do() {
+		key = strings.TrimSuffix(key, ",") + "+do,"
+	}
+	if req.CheckingDisabled {
+		key = strings.TrimSuffix(key, ",") + "+cd,"
+	}
+	return key
+}
+
+func questionKey(req *dns.Msg) string {
 	key := ""
 	for _, q := range req.Question {
-		key += fmt.Sprintf("%s:%d,", q.Name, q.Qtype)
+		key += fmt.Sprintf("%s:%d:%d,", names.Canonical(q.Name), q.Qtype, q.Qclass)
 	}
 	return key
 }
 
+func delegationKey(zone string) string {
+	return "delegation:" + names.Canonical(zone)
+}
+
 func getFirstAvailableSection(msg *dns.Msg) dns.RR {
 	if len(msg.Answer) > 0 {
 		return msg.Answer[0]
@@ -0,0 +1,164 @@
+package cache
+
+import (
+	"testing"
+
+	"github.com/fudanchii/ssh2dns/internal/config"
+	"github.com/miekg/dns"
+)
+
+func newTestCache(t *testing.T) *Cache {
+	t.Helper()
+	cfg, err := config.NewFromOptions(config.Options{"c": "true"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := New(cfg)
+	if c == nil {
+		t.Fatal("cache not created")
+	}
+	t.Cleanup(c.rc.Close)
+	return c
+}
+
+func query(name string, do, cd bool) *dns.Msg {
+	m := new(dns.Msg)
+	m.SetQuestion(name, dns.TypeA)
+	m.CheckingDisabled = cd
+	if do {
+		m.SetEdns0(1232, true)
+	}
+	return m
+}
+
+func reply(req *dns.Msg, ip string) *dns.Msg {
+	rsp := new(dns.Msg)
+	rsp.SetReply(req)
+	rr, _ := dns.NewRR(req.Question[0].Name + " 300 IN A " + ip)
+	rsp.Answer = []dns.RR{rr}
+	return rsp
+}
+
+func TestDNSSECBitsKeyEntries(t *testing.T) {
+	tests := []struct {
+		name         string
+		setDO, setCD bool
+		getDO, getCD bool
+		wantHit      bool
+	}{
+		{"same bits", false, false, false, false, true},
+		{"both bits", true, true, true, true, true},
+		{"cd answer to plain client", false, true, false, false, false},
+		{"plain answer to cd client", false, false, false, true, false},
+		{"unsigned answer to do client", false, false, true, false, false},
+		{"signed answer to plain client", true, false, false, false, false},
+		{"do answer to cd client", true, false, false, true, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newTestCache(t)
+			req := query("example.com.", tt.setDO, tt.setCD)
+			c.Set(req, reply(req, "192.0.2.1"))
+			c.rc.Wait()
+
+			_, hit := c.Get(query("example.com.", tt.getDO, tt.getCD))
+			if hit != tt.wantHit {
+				t.Errorf("hit = %v, want %v", hit, tt.wantHit)
+			}
+		})
+	}
+}
+
+func TestHintsIgnoreDNSSECBits(t *testing.T) {
+	c := newTestCache(t)
+	rr, _ := dns.NewRR("a.root-servers.net. 3600000 IN A 198.41.0.4")
+	c.SetHint(rr)
+
+	if _, hit := c.Get(query("a.root-servers.net.", true, true)); !hit {
+		t.Error("root hint not found for a query with DO and CD set")
+	}
+}
+
+func TestDeleteFlaggedEntries(t *testing.T) {
+	c := newTestCache(t)
+	for _, bits := range [][2]bool{{false, false}, {true, false}, {false, true}, {true, true}} {
+		req := query("example.com.", bits[0], bits[1])
+		c.Set(req, reply(req, "192.0.2.1"))
+	}
+	c.rc.Wait()
+
+	if n := c.Delete("example.com.", dns.TypeA); n != 4 {
+		t.Errorf("deleted %d entries, want 4", n)
+	}
+}
+
+func TestCachedSectionsAreCopies(t *testing.T) {
+	c := newTestCache(t)
+
+	req := query("example.com.", false, false)
+	rsp := reply(req, "192.0.2.1")
+	second, _ := dns.NewRR("example.com. 300 IN A 192.0.2.2")
+	rsp.Answer = append(rsp.Answer, second)
+	c.Set(req, rsp)
+	c.rc.Wait()
+
+	// what the caller still holds after Set
+	other, _ := dns.NewRR("example.com. 300 IN A 198.51.100.1")
+	rsp.Answer[0] = other
+	rsp.Answer = append(rsp.Answer, other)
+
+	first, hit := c.Get(query("example.com.", false, false))
+	if !hit {
+		t.Fatal("cache miss")
+	}
+	// what the caller does to a hit, rotating and adding records
+	first.Answer[0], first.Answer[1] = first.Answer[1], first.Answer[0]
+	first.Answer = append(first.Answer, other)
+	first.Extra = append(first.Extra, other)
+
+	again, hit := c.Get(query("example.com.", false, false))
+	if !hit {
+		t.Fatal("cache miss")
+	}
+	if len(again.Answer) != 2 || len(again.Extra) != 0 {
+		t.Fatalf("cached reply changed to %v", again)
+	}
+	if a := again.Answer[0].(*dns.A).A.String(); a != "192.0.2.1" {
+		t.Errorf("first cached answer = %s, want 192.0.2.1", a)
+	}
+	if a := again.Answer[1].(*dns.A).A.String(); a != "192.0.2.2" {
+		t.Errorf("second cached answer = %s, want 192.0.2.2", a)
+	}
+}
+
+func TestCachedDelegationIsCopy(t *testing.T) {
+	c := newTestCache(t)
+
+	ns, _ := dns.NewRR("example.com. 300 IN NS ns.example.com.")
+	glue, _ := dns.NewRR("ns.example.com. 300 IN A 192.0.2.53")
+	nsSet, glueSet := []dns.RR{ns}, []dns.RR{glue}
+	c.SetDelegation("example.com.", nsSet, glueSet)
+	c.rc.Wait()
+
+	other, _ := dns.NewRR("example.com. 300 IN NS ns.evil.")
+	nsSet[0], glueSet[0] = other, other
+
+	referral, found := c.Delegation("example.com.")
+	if !found {
+		t.Fatal("delegation not cached")
+	}
+	referral.Ns[0] = other
+	referral.Extra = append(referral.Extra, other)
+
+	referral, found = c.Delegation("example.com.")
+	if !found {
+		t.Fatal("delegation not cached")
+	}
+	if len(referral.Ns) != 1 || referral.Ns[0].(*dns.NS).Ns != "ns.example.com." {
+		t.Errorf("cached name servers changed to %v", referral.Ns)
+	}
+	if len(referral.Extra) != 1 || referral.Extra[0].Header().Name != "ns.example.com." {
+		t.Errorf("cached glue changed to %v", referral.Extra)
+	}
+}
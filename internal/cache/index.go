@@ -0,0 +1,66 @@
+package cache
+
+import (
+	"sort"
+	"sync"
+)
+
+// keyIndex keeps the keys of the entries in the ristretto cache, which can't be iterated itself.
+// Every entry stored carries a sequence number, so ristretto letting go of a replaced value
+// doesn't drop the key of the value replacing it.
+type keyIndex struct {
+	mu   sync.Mutex
+	seq  uint64
+	keys map[string]uint64
+}
+
+func newKeyIndex() *keyIndex {
+	return &keyIndex{keys: map[string]uint64{}}
+}
+
+// add records key as about to be stored, and returns the sequence number its entry must carry.
+func (ki *keyIndex) add(key string) uint64 {
+	ki.mu.Lock()
+	defer ki.mu.Unlock()
+
+	ki.seq++
+	ki.keys[key] = ki.seq
+	return ki.seq
+}
+
+// drop forgets key, unless it was stored again since the entry numbered seq.
+func (ki *keyIndex) drop(key string, seq uint64) {
+	ki.mu.Lock()
+	defer ki.mu.Unlock()
+
+	if ki.keys[key] == seq {
+		delete(ki.keys, key)
+	}
+}
+
+// onExit is given to ristretto, it is called for every value leaving the cache,
+// evicted, rejected, deleted, or replaced.
+func (ki *keyIndex) onExit(val interface{}) {
+	if content, ok := val.(dnsCacheContent); ok {
+		ki.drop(content.key, content.seq)
+	}
+}
+
+// list returns the keys in order.
+func (ki *keyIndex) list() []string {
+	ki.mu.Lock()
+	defer ki.mu.Unlock()
+
+	keys := make([]string, 0, len(ki.keys))
+	for key := range ki.keys {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (ki *keyIndex) len() int {
+	ki.mu.Lock()
+	defer ki.mu.Unlock()
+	return len(ki.keys)
+}
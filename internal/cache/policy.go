@@ -0,0 +1,85 @@
+package cache
+
+import (
+	"time"
+
+	"github.com/fudanchii/ssh2dns/internal/config"
+
+	"github.com/miekg/dns"
+)
+
+type replyKind int
+
+const (
+	positiveReply replyKind = iota
+	negativeReply
+	delegationReply
+)
+
+// classify tells whether msg answers the question, denies it (NXDOMAIN or NODATA),
+// or only refers to the name servers of a child zone.
+func classify(msg *dns.Msg) replyKind {
+	if len(msg.Answer) > 0 {
+		return positiveReply
+	}
+
+	if msg.Rcode == dns.RcodeNameError || hasType(msg.Ns, dns.TypeSOA) {
+		return negativeReply
+	}
+
+	// NODATA from an authoritative server leaving out the SOA
+	if msg.Authoritative && msg.Rcode == dns.RcodeSuccess && !hasType(msg.Ns, dns.TypeNS) {
+		return negativeReply
+	}
+
+	if hasType(msg.Ns, dns.TypeNS) {
+		return delegationReply
+	}
+
+	return positiveReply
+}
+
+func (cache *Cache) policyFor(kind replyKind) config.CachePolicy {
+	switch kind {
+	case negativeReply:
+		return cache.config.NegativeCachePolicy()
+	case delegationReply:
+		return cache.config.DelegationCachePolicy()
+	}
+	return cache.config.PositiveCachePolicy()
+}
+
+// ttlOf returns the TTL msg may be cached for, in seconds,
+// negative replies use the SOA minimum per RFC 2308 section 5.
+func ttlOf(kind replyKind, msg *dns.Msg) uint32 {
+	if kind == negativeReply {
+		for _, rr := range msg.Ns {
+			if soa, ok := rr.(*dns.SOA); ok {
+				return min(soa.Hdr.Ttl, soa.Minttl)
+			}
+		}
+		// without a SOA there is no TTL to go by, the negative minimum applies
+		return 0
+	}
+
+	return getFirstAvailableSection(msg).Header().Ttl
+}
+
+func clampTTL(ttl uint32, policy config.CachePolicy) uint32 {
+	if minTTL := uint32(policy.MinTTL / time.Second); ttl < minTTL {
+		ttl = minTTL
+	}
+	if maxTTL := uint32(policy.MaxTTL / time.Second); maxTTL > 0 && ttl > maxTTL {
+		ttl = maxTTL
+	}
+	return ttl
+}
+
+func hasType(rrs []dns.RR, rrtype uint16) bool {
+	for _, rr := range rrs {
+		if rr.Header().Rrtype == rrtype {
+			return true
+		}
+	}
+	return false
+}
@@ -2,99 +2,848 @@ package config
 
 import (
 	"flag"
+	"fmt"
 	"net"
+	"net/netip"
+	"net/url"
 	"os"
 	"path"
 	"runtime"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/fudanchii/ssh2dns/internal/version"
+	"github.com/miekg/dns"
 )
 
 type AppConfig struct {
-	bindAddr        string
-	remoteAddr      string
-	hostKey         string
-	remoteUser      string
-	privkeyFile     string
-	targetServer    string
-	connTimeout     int
-	workerNum       int
-	useCache        bool
-	doNotVerifyHost bool
-	recursiveLookup bool
-}
-
-func New() *AppConfig {
-	var config AppConfig
+	bindAddr         string
+	remoteAddr       string
+	hostKey          string
+	remoteUser       string
+	privkeyFile      string
+	targetServer     string
+	targetServers    []net.IP
+	dnsPort          int
+	connTimeout      int
+	workerNum        int
+	useCache         bool
+	doNotVerifyHost  bool
+	recursiveLookup  bool
+	dohAddr          string
+	dohCertFile      string
+	dohKeyFile       string
+	rateLimit        float64
+	rateBurst        int
+	rateExemptList   string
+	rateExempt       []netip.Prefix
+	rateLimitDrop    bool
+	allowList        string
+	allowedClients   []netip.Prefix
+	jumpHosts        string
+	sshProxy         string
+	controlPath      string
+	sshProxyURL      *url.URL
+	maxSessions      int
+	returnReferral   bool
+	insecureFallback bool
+	fallbackDNS      string
+	maxConnLifetime  time.Duration
+	maxConnIdleTime  time.Duration
+	trimExtra        bool
+	minimalRsp       bool
+	serveStale       time.Duration
+	cacheOnly        bool
+	retries          int
+	preloadFile      string
+	probe            bool
+	debug            bool
+	probeName        string
+	breakerThreshold int
+	breakerCooldown  time.Duration
+	chaosVersion     string
+	rotateAnswers    bool
+	upstream         string
+	acquireTimeout   time.Duration
+	metricsAddr      string
+	reusePort        bool
+	queryBudget      int
+	nsParallel       int
+	rootParallel     int
+	preferFamily     string
+	minIdle          int
+	waitForUpstream  time.Duration
+	noFallback       bool
+	passRefused      bool
+	noCookies        bool
+	maxMsgSize       int
+	pprofAddr        string
+	adminSocket      string
+	pidFile          string
+	lookupTimeout    time.Duration
+	udpDeadline      time.Duration
+	routeList        string
+	routes           []Route
+	upstreamPin      string
+	upstreamPadding  int
+	ttlOverrideList  string
+	otlpEndpoint     string
+	cacheSize        int
+	runAsUser        string
+	runAsGroup       string
+	rebindProtect    bool
+	udpSize          int
+	readTimeout      time.Duration
+	udpReadBuffer    int
+	udpWriteBuffer   int
+	rebindAllow      string
+	ttlOverrides     map[uint16]time.Duration
+	instanceName     string
+	cacheJitter      float64
+	keepAlive        time.Duration
+	quiet            bool
+	logSample        int
+	upstreamAddr     string
+	disableChaos     bool
+	positiveCache    CachePolicy
+	negativeCache    CachePolicy
+	delegationCache  CachePolicy
+	args             []string
+}
+
+// CachePolicy tells whether a kind of reply gets cached, and the bounds of its TTL.
+type CachePolicy struct {
+	Enabled bool
+	MinTTL  time.Duration
+	MaxTTL  time.Duration
+}
+
+// Transports lookups can go through, selected with -upstream.
+const (
+	UpstreamSSH = "ssh"
+	UpstreamDoH = "doh"
+	UpstreamDoT = "dot"
+)
+
+// Address families recursion prefers, selected with -prefer.
+const (
+	PreferIPv4 = "v4"
+	PreferIPv6 = "v6"
+	PreferAuto = "auto"
+)
+
+const (
+	defaultAllowedClients = "127.0.0.0/8,::1/128,10.0.0.0/8,172.16.0.0/12,192.168.0.0/16"
+	allowAllClients       = "all"
+)
+
+func New() (*AppConfig, error) {
+	config, showVersion := defineFlags(flag.CommandLine)
+
+	flag.Parse()
+
+	if *showVersion {
+		fmt.Println(version.String())
+		os.Exit(0)
+	}
+
+	config.args = flag.Args()
+
+	explicit := map[string]bool{}
+	flag.Visit(func(f *flag.Flag) { explicit[f.Name] = true })
+
+	return config.finish(explicit)
+}
+
+// Options holds settings keyed by their command line flag name, without the leading dash,
+// e.g. Options{"s": "example.com:22", "r": "true"}. Unset options take the flag defaults.
+type Options map[string]string
+
+// NewFromOptions builds the configuration from opts instead of the command line,
+// leaving the global flag set alone, for programs embedding ssh2dns.
+func NewFromOptions(opts Options) (*AppConfig, error) {
+	fs := flag.NewFlagSet("ssh2dns", flag.ContinueOnError)
+	config, _ := defineFlags(fs)
+
+	explicit := map[string]bool{}
+	for name, val := range opts {
+		if err := fs.Set(name, val); err != nil {
+			return nil, fmt.Errorf("invalid option %s: %w", name, err)
+		}
+		explicit[name] = true
+	}
+
+	return config.finish(explicit)
+}
+
+// defineFlags registers every option into fs, bound to the returned configuration.
+func defineFlags(fs *flag.FlagSet) (*AppConfig, *bool) {
+	var (
+		config      AppConfig
+		showVersion bool
+	)
 
 	defrsa := path.Join(os.Getenv("HOME"), ".ssh/id_rsa")
 	knownHosts := path.Join(os.Getenv("HOME"), ".ssh/known_hosts")
 
-	flag.StringVar(
+	fs.StringVar(
 		&config.bindAddr,
 		"b", "127.0.0.1:53",
-		"Bind to this host and port, default to 127.0.0.1:53",
+		"Bind to this host and port, on both UDP and TCP, accepts a comma separated list, default to 127.0.0.1:53",
 	)
-	flag.StringVar(
+	fs.StringVar(
 		&config.privkeyFile,
 		"i", defrsa,
-		"Specify identity file to use when connecting to ssh server",
+		"Specify identity file to use when connecting to ssh server, accepts a comma separated list tried in order",
 	)
-	flag.StringVar(
+	fs.StringVar(
 		&config.remoteAddr,
 		"s", "127.0.0.1:22",
-		"Connect to this ssh server, default to 127.0.0.1:22",
+		"Connect to this ssh server, also accepts a Host alias from ssh_config, default to 127.0.0.1:22",
 	)
-	flag.StringVar(
+	fs.StringVar(
 		&config.remoteUser,
 		"u", os.Getenv("USER"),
 		"Specify user to connect with ssh server",
 	)
-	flag.StringVar(
+	fs.StringVar(
 		&config.hostKey,
 		"h", knownHosts,
 		"Specify hostkey to use with ssh server",
 	)
-	flag.StringVar(
+	fs.StringVar(
 		&config.targetServer,
 		"dns", "8.8.8.8:53",
-		"Remote DNS server to connect to, should accept TCP connection, default to 8.8.8.8:53",
+		"Comma separated list of remote DNS servers to connect to, taken in turn and failed over, should accept TCP connection, default to 8.8.8.8:53",
 	)
-	flag.IntVar(
+	fs.IntVar(
+		&config.dnsPort,
+		"dns-port", 53,
+		"Port upstream DNS servers are asked on through the tunnel, the -dns and -route resolvers as well as the name servers recursion goes through, default to 53",
+	)
+	fs.IntVar(
 		&config.connTimeout,
-		"t", 10,
-		"Set timeout for net dial, default to 10 seconds",
+		"t", 2,
+		"Set timeout for connecting to the ssh server, opening tunneled connections, and each upstream exchange, 0 disables, must be below -lookup-timeout, and below half of -udp-deadline when -r falls back to -dns, default to 2 seconds",
 	)
-	flag.IntVar(
+	fs.IntVar(
 		&config.workerNum,
 		"w", runtime.NumCPU(),
 		"Set the number of worker to run as ssh client, default to number of cpu",
 	)
-	flag.BoolVar(
+	fs.BoolVar(
 		&config.useCache,
 		"c", false,
 		"Use cache, default to false",
 	)
-	flag.BoolVar(
+	fs.BoolVar(
 		&config.doNotVerifyHost,
 		"x", false,
 		"Skip host key verification, makes you vulnerable to man-in-the-middle attack!",
 	)
-	flag.BoolVar(
+	fs.BoolVar(
 		&config.recursiveLookup,
 		"r", false,
 		"Do recursive lookup instead of connecting to caching remote DNS, if this is set, -dns config will be ignored",
 	)
 
-	flag.Parse()
+	fs.StringVar(
+		&config.dohAddr,
+		"doh", "",
+		"Also serve DNS-over-HTTPS on this address (e.g. :443), disabled if empty",
+	)
+	fs.StringVar(
+		&config.dohCertFile,
+		"doh-cert", "",
+		"TLS certificate file for the DNS-over-HTTPS listener",
+	)
+	fs.StringVar(
+		&config.dohKeyFile,
+		"doh-key", "",
+		"TLS private key file for the DNS-over-HTTPS listener",
+	)
+
+	fs.Float64Var(
+		&config.rateLimit,
+		"rate", 0,
+		"Maximum queries per second allowed from a single client address, 0 disables rate limiting",
+	)
+	fs.IntVar(
+		&config.rateBurst,
+		"burst", 20,
+		"Number of queries a client may burst above -rate, default to 20",
+	)
+	fs.StringVar(
+		&config.rateExemptList,
+		"rate-exempt", "127.0.0.0/8,::1/128",
+		"Comma separated list of client networks exempted from rate limiting",
+	)
+	fs.BoolVar(
+		&config.rateLimitDrop,
+		"rate-drop", false,
+		"Silently drop rate limited queries instead of answering REFUSED",
+	)
+	fs.StringVar(
+		&config.allowList,
+		"allow", "",
+		"Comma separated list of client networks allowed to query, use \"all\" to answer anyone, default to loopback and RFC1918 networks",
+	)
+	fs.StringVar(
+		&config.jumpHosts,
+		"J", "",
+		"Comma separated list of jump hosts ([user@]host[:port]) to reach the ssh server through, in order",
+	)
+	fs.StringVar(
+		&config.sshProxy,
+		"ssh-proxy", "",
+		"Reach the ssh server, or the first -J jump host, through this HTTP CONNECT (http://[user:pass@]host[:port]) or SOCKS5 (socks5://[user:pass@]host[:port]) proxy",
+	)
+	fs.StringVar(
+		&config.controlPath,
+		"control-path", "",
+		"Tunnel through the ssh connection of the OpenSSH ControlMaster listening on this socket instead of connecting to the ssh server, -s, -u, -i, -J, and -ssh-proxy are then unused",
+	)
+	fs.BoolVar(
+		&config.cacheOnly,
+		"cache-only", false,
+		"Answer from the cache only, SERVFAIL on a miss, never connecting upstream, -serve-stale still applies, default to false",
+	)
+	fs.IntVar(
+		&config.maxSessions,
+		"max-sessions", 10,
+		"Maximum concurrent channels opened over each ssh connection, should not exceed the server's MaxSessions, 0 means unbounded, default to 10",
+	)
+	fs.BoolVar(
+		&config.returnReferral,
+		"referral", false,
+		"Include the last referral received in the authority section when recursion fails to find an answer",
+	)
+	fs.BoolVar(
+		&config.insecureFallback,
+		"insecure-fallback", false,
+		"Resolve directly, bypassing the ssh tunnel, while the connection pool is reconnecting",
+	)
+	fs.StringVar(
+		&config.fallbackDNS,
+		"fallback-dns", "",
+		"Plain DNS server used by -insecure-fallback, default to the system resolver",
+	)
+	fs.DurationVar(
+		&config.maxConnLifetime,
+		"max-lifetime", 0,
+		"Reconnect ssh connections older than this duration (e.g. 1h), 0 keeps them forever",
+	)
+	fs.DurationVar(
+		&config.maxConnIdleTime,
+		"max-idle", 0,
+		"Reconnect ssh connections left idle longer than this duration (e.g. 10m), 0 keeps them forever",
+	)
+	fs.BoolVar(
+		&config.trimExtra,
+		"trim-extra", false,
+		"Drop the additional section, except EDNS0 OPT, from UDP replies that would otherwise be truncated",
+	)
+	fs.BoolVar(
+		&config.minimalRsp,
+		"minimal-responses", false,
+		"Drop the authority and additional sections, except DNSSEC proofs and EDNS0 OPT, from replies with answers, like BIND's minimal-responses, default to false",
+	)
+	fs.DurationVar(
+		&config.serveStale,
+		"serve-stale", 0,
+		"Answer from expired cache entries up to this long past expiry (e.g. 1h) when upstream resolution fails, 0 disables",
+	)
+	fs.IntVar(
+		&config.retries,
+		"retries", 2,
+		"Retry an upstream server this many times on transient read or write errors before moving on, default to 2",
+	)
+	fs.IntVar(
+		&config.breakerThreshold,
+		"breaker-threshold", 3,
+		"Skip an upstream server after this many consecutive timeouts, unreachable connections, or SERVFAIL answers, 0 disables, default to 3",
+	)
+	fs.DurationVar(
+		&config.breakerCooldown,
+		"breaker-cooldown", 30*time.Second,
+		"How long an upstream server is skipped once -breaker-threshold is reached, default to 30s",
+	)
+	fs.StringVar(
+		&config.preloadFile,
+		"preload", "",
+		"File of name and query type pairs, one per line, resolved into cache at startup",
+	)
+	fs.DurationVar(
+		&config.acquireTimeout,
+		"acquire-timeout", 2*time.Second,
+		"Give up on a lookup after waiting this long for a busy ssh connection to be free, 0 waits for the whole lookup deadline, making a new one is bounded by -t, default to 2s",
+	)
+	fs.StringVar(
+		&config.otlpEndpoint,
+		"otlp-endpoint", "",
+		"Export traces of every lookup to this OTLP/HTTP collector, host:port over TLS or an http:// URL, default to none",
+	)
+	fs.StringVar(
+		&config.metricsAddr,
+		"metrics", "",
+		"Serve runtime metrics as JSON on this address, at /debug/vars",
+	)
+	fs.BoolVar(
+		&config.quiet,
+		"q", false,
+		"Do not log every request, default to false",
+	)
+	fs.IntVar(
+		&config.logSample,
+		"log-sample", 1,
+		"Log only one request out of this many, at least 1, default to 1, logging all of them",
+	)
+	fs.DurationVar(
+		&config.keepAlive,
+		"keepalive", 0,
+		"Keep tunneled connections to upstream servers open this long after an exchange, for the next query to the same server, 0 closes them right away, default to 0",
+	)
+	fs.BoolVar(
+		&config.rebindProtect,
+		"rebind-protect", false,
+		"Drop private, loopback, and link-local addresses from answers for names outside -rebind-allow, against DNS rebinding, default to false",
+	)
+	fs.StringVar(
+		&config.rebindAllow,
+		"rebind-allow", "",
+		"Comma separated list of internal zones whose names may resolve to private addresses under -rebind-protect",
+	)
+	fs.StringVar(
+		&config.runAsUser,
+		"user", "",
+		"Switch to this user once the listening addresses are bound, e.g. to bind :53 as root without serving as root, default to none",
+	)
+	fs.StringVar(
+		&config.runAsGroup,
+		"group", "",
+		"Switch to this group once the listening addresses are bound, default to the primary group of -user",
+	)
+	fs.IntVar(
+		&config.cacheSize,
+		"cache-size", 1024,
+		"Bound the cache to about this many megabytes of records, evicting the least used entries past it, default to 1024",
+	)
+	fs.StringVar(
+		&config.ttlOverrideList,
+		"ttl-override", "",
+		"Comma separated list of type=duration pairs, e.g. NS=1h,A=30s, caching replies to questions of that type this long whatever their TTL",
+	)
+	fs.Float64Var(
+		&config.cacheJitter,
+		"cache-jitter", 10,
+		"Randomly lengthen or shorten how long each cache entry lives by up to this percentage, 0 disables, default to 10",
+	)
+	fs.StringVar(
+		&config.instanceName,
+		"name", "",
+		"Name of this instance, tagging every log line and the metrics, default to none",
+	)
+	fs.IntVar(
+		&config.nsParallel,
+		"ns-parallel", 1,
+		"Ask up to this many name servers of a delegation at once and take the first answer, 1 asks them one at a time, default to 1",
+	)
+	fs.IntVar(
+		&config.rootParallel,
+		"root-parallel", 2,
+		"Ask up to this many root servers at once, in random order, and take the first answer, 1 asks them one at a time, default to 2",
+	)
+	fs.IntVar(
+		&config.queryBudget,
+		"query-budget", 50,
+		"Maximum upstream queries a single recursive lookup may send, referrals and CNAME chases included, 0 disables, default to 50",
+	)
+	fs.BoolVar(
+		&config.reusePort,
+		"reuseport", false,
+		"Bind listening sockets with SO_REUSEPORT, so several ssh2dns processes can share the same addresses, default to false",
+	)
+	fs.IntVar(
+		&config.udpSize,
+		"udp-size", dns.MinMsgSize,
+		"Size in bytes of the buffer incoming UDP queries are read into, larger queries are cut short, default to 512",
+	)
+	fs.IntVar(
+		&config.udpReadBuffer,
+		"udp-rcvbuf", 0,
+		"Size in bytes of the receive buffer (SO_RCVBUF) of listening UDP sockets, raise it when queries are dropped under load, 0 keeps the system default",
+	)
+	fs.IntVar(
+		&config.udpWriteBuffer,
+		"udp-sndbuf", 0,
+		"Size in bytes of the send buffer (SO_SNDBUF) of listening UDP sockets, 0 keeps the system default",
+	)
+	fs.BoolVar(
+		&config.debug,
+		"debug", false,
+		"Log every upstream exchange and cache hit, toggled at runtime with SIGUSR2, default to false",
+	)
+	fs.BoolVar(
+		&config.noCookies,
+		"no-cookies", false,
+		"Do not send DNS cookies (RFC 7873) with upstream queries, nor check those in replies",
+	)
+	fs.BoolVar(
+		&config.noFallback,
+		"no-fallback", false,
+		"With -r, answer SERVFAIL when recursion fails instead of asking the -dns servers, default to false",
+	)
+	fs.BoolVar(
+		&config.passRefused,
+		"pass-refused", false,
+		"Answer REFUSED as soon as a -dns server refuses a query, instead of asking the next one, default to false",
+	)
+	fs.StringVar(
+		&config.routeList,
+		"route", "",
+		"Comma separated list of zone=strategy pairs resolving names in zone recursively (recursive), with NXDOMAIN (local), or through the tunnel to the given resolvers separated by |, e.g. corp.internal=10.0.0.53|10.0.0.54",
+	)
+	fs.DurationVar(
+		&config.lookupTimeout,
+		"lookup-timeout", 5*time.Second,
+		"Give up on resolving a query after this long, recursion failing past it falls back to -dns for as long again, default to 5s",
+	)
+	fs.DurationVar(
+		&config.udpDeadline,
+		"udp-deadline", 5*time.Second,
+		"Give up on a query from a UDP client after this long, by then it has sent the query again, with -r the recursion and its fallback share it, TCP and DoH clients get twice -lookup-timeout, default to 5s",
+	)
+	fs.StringVar(
+		&config.pprofAddr,
+		"pprof", "",
+		"Serve net/http/pprof profiles on this address, at /debug/pprof/, e.g. 127.0.0.1:6060, disabled by default",
+	)
+	fs.StringVar(
+		&config.adminSocket,
+		"admin", "",
+		"Serve admin commands (stats, cache flush, cache delete, cache dump, pool reset, reload) on a Unix socket at this path, e.g. /run/ssh2dns.sock, disabled by default",
+	)
+	fs.StringVar(
+		&config.pidFile,
+		"pidfile", "",
+		"Write the process ID to this file once listening, e.g. /run/ssh2dns.pid, removed again on shutdown, disabled by default",
+	)
+	fs.IntVar(
+		&config.maxMsgSize,
+		"max-msg-size", dns.MaxMsgSize,
+		"Largest reply in bytes read from upstream servers through the tunnel, longer ones fail the exchange unread, default to 65535",
+	)
+	fs.IntVar(
+		&config.minIdle,
+		"min-idle", 0,
+		"Keep at least this many ssh connections established and idle in the background, up to -w, so bursts don't wait for handshakes, default to 0",
+	)
+	fs.DurationVar(
+		&config.waitForUpstream,
+		"wait-for-upstream", 0,
+		"Keep trying to connect to the ssh server at startup for up to this long, e.g. while it is still booting, 0 gives up on the first failure, default to 0",
+	)
+	fs.StringVar(
+		&config.preferFamily,
+		"prefer", PreferAuto,
+		"Address family of name servers tried first during recursion, v4, v6, or auto to favor the one answering lately, default to auto",
+	)
+	fs.BoolVar(
+		&config.probe,
+		"probe", false,
+		"Connect to the upstream, resolve -probe-name once, print OK or FAIL with timings, then exit with 0 or 1, without listening",
+	)
+	fs.StringVar(
+		&config.probeName,
+		"probe-name", "example.com",
+		"Name resolved by -probe, default to example.com",
+	)
+	fs.DurationVar(
+		&config.readTimeout,
+		"read-timeout", 2*time.Second,
+		"How long the listener waits to read a query, before giving up on a TCP client, default to 2s",
+	)
+	fs.StringVar(
+		&config.upstream,
+		"upstream", UpstreamSSH,
+		"Send queries through the ssh tunnel (ssh), or straight to a DNS-over-HTTPS (doh) or DNS-over-TLS (dot) resolver at -upstream-addr",
+	)
+	fs.StringVar(
+		&config.upstreamAddr,
+		"upstream-addr", "",
+		"Resolver used by -upstream doh or dot, an https URL for doh, host[:port] for dot",
+	)
+	fs.StringVar(
+		&config.upstreamPin,
+		"upstream-pin", "",
+		"Comma separated list of base64 SHA-256 hashes of the keys the doh or dot upstream may present, trusted instead of the system certificates",
+	)
+	fs.IntVar(
+		&config.upstreamPadding,
+		"upstream-padding", 0,
+		"Pad queries to the dot upstream with EDNS0 padding (RFC 7830) to a multiple of this many bytes, e.g. 128, 0 disables, default to 0",
+	)
+	fs.BoolVar(
+		&config.rotateAnswers,
+		"rotate", false,
+		"Rotate the order of records of the same name and type in every reply, for round-robin load balancing",
+	)
+	fs.StringVar(
+		&config.chaosVersion,
+		"chaos-version", "ssh2dns",
+		"Version string answered to version.bind CHAOS TXT queries, default to ssh2dns",
+	)
+	fs.BoolVar(
+		&config.disableChaos,
+		"no-chaos", false,
+		"Refuse version.bind and hostname.bind CHAOS TXT queries",
+	)
+	cachePolicyFlags(fs, &config.positiveCache, "positive", "answers")
+	cachePolicyFlags(fs, &config.negativeCache, "negative", "NXDOMAIN and NODATA replies")
+	cachePolicyFlags(fs, &config.delegationCache, "delegation", "referrals to child zone name servers")
+	fs.BoolVar(
+		&showVersion,
+		"version", false,
+		"Print version and build information, then exit",
+	)
+
+	return &config, &showVersion
+}
+
+// finish resolves what depends on the parsed options,
+// explicit tells which options were given rather than left to their defaults.
+func (c *AppConfig) finish(explicit map[string]bool) (*AppConfig, error) {
+	var err error
+
+	c.applySSHConfig(explicit)
+
+	switch c.upstream {
+	case UpstreamSSH:
+	case UpstreamDoH, UpstreamDoT:
+		if c.upstreamAddr == "" {
+			return nil, fmt.Errorf("-upstream %s requires -upstream-addr", c.upstream)
+		}
+		if c.recursiveLookup {
+			return nil, fmt.Errorf("-r requires -upstream %s, a %s resolver can only be forwarded to", UpstreamSSH, c.upstream)
+		}
+	default:
+		return nil, fmt.Errorf("unknown upstream %s, expected %s, %s, or %s", c.upstream, UpstreamSSH, UpstreamDoH, UpstreamDoT)
+	}
+
+	if c.upstreamPadding < 0 || c.upstreamPadding > dns.MaxMsgSize {
+		return nil, fmt.Errorf("-upstream-padding must be between 0 and %d, got %d", dns.MaxMsgSize, c.upstreamPadding)
+	}
+	if c.upstreamPadding > 0 && c.upstream != UpstreamDoT {
+		return nil, fmt.Errorf("-upstream-padding requires -upstream %s", UpstreamDoT)
+	}
+
+	if c.sshProxyURL, err = parseProxyURL(c.sshProxy); err != nil {
+		return nil, err
+	}
+
+	if c.controlPath != "" && c.upstream != UpstreamSSH {
+		return nil, fmt.Errorf("-control-path requires -upstream %s", UpstreamSSH)
+	}
+	c.controlPath = expandHome(c.controlPath)
+
+	if c.dnsPort < 1 || c.dnsPort > 65535 {
+		return nil, fmt.Errorf("-dns-port must be between 1 and 65535, got %d", c.dnsPort)
+	}
+
+	if c.routes, err = parseRoutes(c.routeList, strconv.Itoa(c.dnsPort)); err != nil {
+		return nil, err
+	}
+	// DoH and DoT clients always ask their resolver, whatever server a route names,
+	// only local routes avoid sending internal names to it
+	for _, route := range c.routes {
+		if route.Strategy == RouteLocal || c.upstream == UpstreamSSH {
+			continue
+		}
+		if route.Strategy == RouteForward {
+			return nil, fmt.Errorf("-route %s forwarding to its own resolvers requires -upstream %s", route.Zone, UpstreamSSH)
+		}
+		return nil, fmt.Errorf("-route %s=%s requires -upstream %s", route.Zone, route.Strategy, UpstreamSSH)
+	}
+
+	if c.lookupTimeout <= 0 {
+		return nil, fmt.Errorf("-lookup-timeout must be positive, got %s", c.lookupTimeout)
+	}
+	if c.udpDeadline <= 0 {
+		return nil, fmt.Errorf("-udp-deadline must be positive, got %s", c.udpDeadline)
+	}
+	// past the lookup deadline, a server that doesn't answer holds the whole lookup instead of being skipped
+	if hop := time.Duration(c.connTimeout) * time.Second; hop >= c.lookupTimeout {
+		return nil, fmt.Errorf("-t must be below -lookup-timeout (%s), got %d seconds", c.lookupTimeout, c.connTimeout)
+	}
+	// and a UDP client's recursion only gets the half of -udp-deadline its fallback doesn't
+	if hop, stage := time.Duration(c.connTimeout)*time.Second, c.udpDeadline/2; c.recursesWithFallback() && hop >= stage {
+		return nil, fmt.Errorf("-t must be below half of -udp-deadline (%s) when recursion falls back to -dns, got %d seconds", stage, c.connTimeout)
+	}
+
+	if c.logSample < 1 {
+		return nil, fmt.Errorf("-log-sample must be at least 1, got %d", c.logSample)
+	}
+
+	if c.maxMsgSize < dns.MinMsgSize || c.maxMsgSize > dns.MaxMsgSize {
+		return nil, fmt.Errorf("-max-msg-size must be between %d and %d, got %d", dns.MinMsgSize, dns.MaxMsgSize, c.maxMsgSize)
+	}
+
+	if c.waitForUpstream < 0 {
+		return nil, fmt.Errorf("-wait-for-upstream can't be negative, got %s", c.waitForUpstream)
+	}
+
+	if c.minIdle < 0 || c.minIdle > c.workerNum {
+		return nil, fmt.Errorf("-min-idle must be between 0 and -w (%d), got %d", c.workerNum, c.minIdle)
+	}
+
+	switch c.preferFamily {
+	case PreferIPv4, PreferIPv6, PreferAuto:
+	default:
+		return nil, fmt.Errorf("unknown -prefer %s, expected %s, %s, or %s", c.preferFamily, PreferIPv4, PreferIPv6, PreferAuto)
+	}
+
+	// the default names port 53, only ports given explicitly have to agree with -dns-port
+	dnsPort := ""
+	if explicit["dns"] {
+		dnsPort = strconv.Itoa(c.dnsPort)
+	}
+	if c.targetServers, err = parseServers(c.targetServer, dnsPort); err != nil {
+		return nil, err
+	}
+
+	if c.udpSize < dns.MinMsgSize || c.udpSize > dns.MaxMsgSize {
+		return nil, fmt.Errorf("-udp-size must be between %d and %d, got %d", dns.MinMsgSize, dns.MaxMsgSize, c.udpSize)
+	}
+
+	if c.udpReadBuffer < 0 || c.udpWriteBuffer < 0 {
+		return nil, fmt.Errorf("-udp-rcvbuf and -udp-sndbuf can't be negative")
+	}
+
+	if c.readTimeout <= 0 {
+		return nil, fmt.Errorf("-read-timeout must be positive, got %s", c.readTimeout)
+	}
+
+	if c.cacheSize <= 0 {
+		return nil, fmt.Errorf("-cache-size must be positive, got %d", c.cacheSize)
+	}
+
+	for kind, policy := range map[string]CachePolicy{
+		"positive":   c.positiveCache,
+		"negative":   c.negativeCache,
+		"delegation": c.delegationCache,
+	} {
+		if err := policy.check(kind); err != nil {
+			return nil, err
+		}
+	}
+
+	if c.ttlOverrides, err = parseTTLOverrides(c.ttlOverrideList); err != nil {
+		return nil, err
+	}
+
+	if c.rateExempt, err = parsePrefixes(c.rateExemptList); err != nil {
+		return nil, err
+	}
+
+	if c.allowedClients, err = parseAllowList(c.allowList); err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// parseServers parses a comma separated list of DNS server addresses, with or without port.
+// Every upstream is asked on -dns-port, a port given must be that one, unless port is empty.
+func parseServers(list, port string) ([]net.IP, error) {
+	var servers []net.IP
+
+	for _, srv := range strings.Split(list, ",") {
+		srv = strings.TrimSpace(srv)
+		if srv == "" {
+			continue
+		}
+		host, p, err := net.SplitHostPort(srv)
+		if err != nil {
+			host = strings.Trim(srv, "[]")
+		} else if port != "" && p != port {
+			return nil, fmt.Errorf("DNS server %s is not on -dns-port %s", srv, port)
+		}
+		ip := net.ParseIP(host)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid DNS server address: %s", srv)
+		}
+		servers = append(servers, ip)
+	}
+
+	if len(servers) == 0 {
+		return nil, fmt.Errorf("no DNS server given to -dns")
+	}
+
+	return servers, nil
+}
+
+// cachePolicyFlags defines -no-cache-<kind>, -<kind>-min-ttl, and -<kind>-max-ttl into policy.
+func cachePolicyFlags(fs *flag.FlagSet, policy *CachePolicy, kind, what string) {
+	fs.BoolFunc(
+		"no-cache-"+kind,
+		"Do not cache "+what,
+		func(val string) error {
+			disabled, err := strconv.ParseBool(val)
+			policy.Enabled = !disabled
+			return err
+		},
+	)
+	policy.Enabled = true
+	fs.DurationVar(
+		&policy.MinTTL,
+		kind+"-min-ttl", 3*time.Minute,
+		"Cache "+what+" at least this long regardless of their TTL",
+	)
+	fs.DurationVar(
+		&policy.MaxTTL,
+		kind+"-max-ttl", 0,
+		"Cache "+what+" at most this long regardless of their TTL, 0 means unbounded, can't be below -"+kind+"-min-ttl",
+	)
+}
 
-	return &config
+// check rejects TTL bounds the cache would wrap around or silently ignore, a zero maximum is unbounded.
+func (p CachePolicy) check(kind string) error {
+	if p.MinTTL < 0 {
+		return fmt.Errorf("-%s-min-ttl can't be negative, got %s", kind, p.MinTTL)
+	}
+	if p.MaxTTL < 0 {
+		return fmt.Errorf("-%s-max-ttl can't be negative, got %s", kind, p.MaxTTL)
+	}
+	if p.MaxTTL > 0 && p.MinTTL > p.MaxTTL {
+		return fmt.Errorf("-%s-min-ttl (%s) can't exceed -%s-max-ttl (%s)", kind, p.MinTTL, kind, p.MaxTTL)
+	}
+	return nil
 }
 
-func (c *AppConfig) BindAddr() string {
-	return c.bindAddr
+// Args returns the positional arguments left after flag parsing, e.g. a subcommand.
+func (c *AppConfig) Args() []string {
+	return c.args
 }
 
-func (c *AppConfig) PrivKeyFile() string {
-	return c.privkeyFile
+func (c *AppConfig) BindAddrs() []string {
+	addrs := []string{}
+	for _, addr := range strings.Split(c.bindAddr, ",") {
+		if addr = strings.TrimSpace(addr); addr != "" {
+			addrs = append(addrs, addr)
+		}
+	}
+	return addrs
+}
+
+func (c *AppConfig) PrivKeyFiles() []string {
+	files := []string{}
+	for _, file := range strings.Split(c.privkeyFile, ",") {
+		if file = strings.TrimSpace(file); file != "" {
+			files = append(files, file)
+		}
+	}
+	return files
 }
 
 func (c *AppConfig) RemoteAddr() string {
@@ -109,16 +858,12 @@ func (c *AppConfig) HostKey() string {
 	return c.hostKey
 }
 
-func (c *AppConfig) TargetServer() string {
-	return c.targetServer
+func (c *AppConfig) TargetServers() []net.IP {
+	return c.targetServers
 }
 
-func (c *AppConfig) TargetServerIPv4() net.IP {
-	host, _, err := net.SplitHostPort(c.targetServer)
-	if err != nil {
-		host = "8.8.8.8"
-	}
-	return net.ParseIP(host)
+func (c *AppConfig) DNSPort() int {
+	return c.dnsPort
 }
 
 func (c *AppConfig) ConnTimeout() int {
@@ -129,6 +874,291 @@ func (c *AppConfig) WorkerNum() int {
 	return c.workerNum
 }
 
+func (c *AppConfig) MaxSessions() int {
+	return c.maxSessions
+}
+
+func (c *AppConfig) ReturnReferral() bool {
+	return c.returnReferral
+}
+
+func (c *AppConfig) InsecureFallback() bool {
+	return c.insecureFallback
+}
+
+func (c *AppConfig) FallbackDNS() string {
+	return c.fallbackDNS
+}
+
+func (c *AppConfig) TrimExtra() bool {
+	return c.trimExtra
+}
+
+func (c *AppConfig) MinimalResponses() bool {
+	return c.minimalRsp
+}
+
+func (c *AppConfig) CacheOnly() bool {
+	return c.cacheOnly
+}
+
+func (c *AppConfig) ServeStale() time.Duration {
+	return c.serveStale
+}
+
+func (c *AppConfig) Retries() int {
+	return c.retries
+}
+
+func (c *AppConfig) PositiveCachePolicy() CachePolicy {
+	return c.positiveCache
+}
+
+func (c *AppConfig) NegativeCachePolicy() CachePolicy {
+	return c.negativeCache
+}
+
+func (c *AppConfig) DelegationCachePolicy() CachePolicy {
+	return c.delegationCache
+}
+
+func (c *AppConfig) BreakerThreshold() int {
+	return c.breakerThreshold
+}
+
+func (c *AppConfig) BreakerCooldown() time.Duration {
+	return c.breakerCooldown
+}
+
+func (c *AppConfig) PreloadFile() string {
+	return c.preloadFile
+}
+
+func (c *AppConfig) AcquireTimeout() time.Duration {
+	return c.acquireTimeout
+}
+
+func (c *AppConfig) OTLPEndpoint() string {
+	return c.otlpEndpoint
+}
+
+func (c *AppConfig) MetricsAddr() string {
+	return c.metricsAddr
+}
+
+func (c *AppConfig) Quiet() bool {
+	return c.quiet
+}
+
+func (c *AppConfig) LogSample() int {
+	return c.logSample
+}
+
+func (c *AppConfig) KeepAlive() time.Duration {
+	return c.keepAlive
+}
+
+func (c *AppConfig) RebindProtection() bool {
+	return c.rebindProtect
+}
+
+func (c *AppConfig) RebindAllowed() []string {
+	zones := []string{}
+	for _, zone := range strings.Split(c.rebindAllow, ",") {
+		if zone = strings.TrimSpace(zone); zone != "" {
+			zones = append(zones, dns.Fqdn(zone))
+		}
+	}
+	return zones
+}
+
+func (c *AppConfig) User() string {
+	return c.runAsUser
+}
+
+func (c *AppConfig) Group() string {
+	return c.runAsGroup
+}
+
+func (c *AppConfig) CacheSize() int {
+	return c.cacheSize
+}
+
+// TTLOverride returns how long replies to questions of qtype are cached, if set by -ttl-override.
+func (c *AppConfig) TTLOverride(qtype uint16) (time.Duration, bool) {
+	ttl, ok := c.ttlOverrides[qtype]
+	return ttl, ok
+}
+
+func (c *AppConfig) CacheJitter() float64 {
+	return c.cacheJitter
+}
+
+func (c *AppConfig) InstanceName() string {
+	return c.instanceName
+}
+
+func (c *AppConfig) NSParallel() int {
+	return c.nsParallel
+}
+
+func (c *AppConfig) UpstreamPins() []string {
+	pins := []string{}
+	for _, pin := range strings.Split(c.upstreamPin, ",") {
+		if pin = strings.TrimSpace(pin); pin != "" {
+			pins = append(pins, pin)
+		}
+	}
+	return pins
+}
+
+func (c *AppConfig) NoCookies() bool {
+	return c.noCookies
+}
+
+func (c *AppConfig) NoFallback() bool {
+	return c.noFallback
+}
+
+func (c *AppConfig) PassRefused() bool {
+	return c.passRefused
+}
+
+// recursesWithFallback tells whether some lookups recurse, with -r or a recursive -route,
+// and fall back to the -dns servers when that fails.
+func (c *AppConfig) recursesWithFallback() bool {
+	if c.noFallback {
+		return false
+	}
+	if c.recursiveLookup {
+		return true
+	}
+	for _, route := range c.routes {
+		if route.Strategy == RouteRecursive {
+			return true
+		}
+	}
+	return false
+}
+
+// RouteFor returns the most specific -route covering name, if any.
+func (c *AppConfig) RouteFor(name string) (Route, bool) {
+	for _, route := range c.routes {
+		if dns.IsSubDomain(route.Zone, name) {
+			return route, true
+		}
+	}
+	return Route{}, false
+}
+
+func (c *AppConfig) LookupTimeout() time.Duration {
+	return c.lookupTimeout
+}
+
+func (c *AppConfig) UDPDeadline() time.Duration {
+	return c.udpDeadline
+}
+
+func (c *AppConfig) PprofAddr() string {
+	return c.pprofAddr
+}
+
+func (c *AppConfig) AdminSocket() string {
+	return c.adminSocket
+}
+
+func (c *AppConfig) PIDFile() string {
+	return c.pidFile
+}
+
+func (c *AppConfig) MaxMsgSize() int {
+	return c.maxMsgSize
+}
+
+func (c *AppConfig) MinIdle() int {
+	return c.minIdle
+}
+
+func (c *AppConfig) WaitForUpstream() time.Duration {
+	return c.waitForUpstream
+}
+
+func (c *AppConfig) PreferFamily() string {
+	return c.preferFamily
+}
+
+func (c *AppConfig) RootParallel() int {
+	return c.rootParallel
+}
+
+func (c *AppConfig) QueryBudget() int {
+	return c.queryBudget
+}
+
+func (c *AppConfig) Debug() bool {
+	return c.debug
+}
+
+func (c *AppConfig) Probe() bool {
+	return c.probe
+}
+
+func (c *AppConfig) ProbeName() string {
+	return c.probeName
+}
+
+func (c *AppConfig) UDPSize() int {
+	return c.udpSize
+}
+
+func (c *AppConfig) UDPReadBuffer() int {
+	return c.udpReadBuffer
+}
+
+func (c *AppConfig) UDPWriteBuffer() int {
+	return c.udpWriteBuffer
+}
+
+func (c *AppConfig) ReadTimeout() time.Duration {
+	return c.readTimeout
+}
+
+func (c *AppConfig) ReusePort() bool {
+	return c.reusePort
+}
+
+func (c *AppConfig) Upstream() string {
+	return c.upstream
+}
+
+func (c *AppConfig) UpstreamAddr() string {
+	return c.upstreamAddr
+}
+
+func (c *AppConfig) UpstreamPadding() int {
+	return c.upstreamPadding
+}
+
+func (c *AppConfig) RotateAnswers() bool {
+	return c.rotateAnswers
+}
+
+func (c *AppConfig) ChaosVersion() string {
+	return c.chaosVersion
+}
+
+func (c *AppConfig) DisableChaos() bool {
+	return c.disableChaos
+}
+
+func (c *AppConfig) MaxConnLifetime() time.Duration {
+	return c.maxConnLifetime
+}
+
+func (c *AppConfig) MaxConnIdleTime() time.Duration {
+	return c.maxConnIdleTime
+}
+
 func (c *AppConfig) UseCache() bool {
 	return c.useCache
 }
@@ -140,3 +1170,54 @@ func (c *AppConfig) DoNotVerifyHost() bool {
 func (c *AppConfig) RecursiveLookup() bool {
 	return c.recursiveLookup
 }
+
+func (c *AppConfig) DoHAddr() string {
+	return c.dohAddr
+}
+
+func (c *AppConfig) DoHCertFile() string {
+	return c.dohCertFile
+}
+
+func (c *AppConfig) DoHKeyFile() string {
+	return c.dohKeyFile
+}
+
+func (c *AppConfig) RateLimit() float64 {
+	return c.rateLimit
+}
+
+func (c *AppConfig) RateBurst() int {
+	return c.rateBurst
+}
+
+func (c *AppConfig) RateExempt() []netip.Prefix {
+	return c.rateExempt
+}
+
+func (c *AppConfig) RateLimitDrop() bool {
+	return c.rateLimitDrop
+}
+
+func (c *AppConfig) AllowedClients() []netip.Prefix {
+	return c.allowedClients
+}
+
+// SSHProxy is the -ssh-proxy URL, with its port filled in, nil when the ssh server is dialed directly.
+func (c *AppConfig) SSHProxy() *url.URL {
+	return c.sshProxyURL
+}
+
+func (c *AppConfig) ControlPath() string {
+	return c.controlPath
+}
+
+func (c *AppConfig) JumpHosts() []string {
+	hosts := []string{}
+	for _, host := range strings.Split(c.jumpHosts, ",") {
+		if host = strings.TrimSpace(host); host != "" {
+			hosts = append(hosts, host)
+		}
+	}
+	return hosts
+}
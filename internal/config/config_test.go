@@ -0,0 +1,107 @@
+package config
+
+import "testing"
+
+func TestRoutesUnderDoHAndDoT(t *testing.T) {
+	tests := []struct {
+		upstream string
+		route    string
+		wantErr  bool
+	}{
+		{UpstreamSSH, "corp.internal=10.0.0.53", false},
+		{UpstreamSSH, "corp.internal=recursive", false},
+		{UpstreamDoH, "corp.internal=10.0.0.53", true},
+		{UpstreamDoT, "corp.internal=10.0.0.53|10.0.0.54", true},
+		{UpstreamDoH, "corp.internal=recursive", true},
+		{UpstreamDoT, "lan=local", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.upstream+" "+tt.route, func(t *testing.T) {
+			opts := Options{"upstream": tt.upstream, "route": tt.route}
+			switch tt.upstream {
+			case UpstreamDoH:
+				opts["upstream-addr"] = "https://dns.example/dns-query"
+			case UpstreamDoT:
+				opts["upstream-addr"] = "dns.example:853"
+			}
+			_, err := NewFromOptions(opts)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("err = %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestConnTimeoutBelowLookupTimeout(t *testing.T) {
+	tests := []struct {
+		opts    Options
+		wantErr bool
+	}{
+		{Options{}, false},
+		{Options{"t": "0"}, false},
+		{Options{"t": "4"}, false},
+		{Options{"t": "5"}, true},
+		{Options{"t": "10"}, true},
+		{Options{"t": "10", "lookup-timeout": "15s"}, false},
+		{Options{"lookup-timeout": "2s"}, true},
+		// a UDP client's recursion gets half of -udp-deadline, the fallback the other half
+		{Options{"r": "true"}, false},
+		{Options{"r": "true", "t": "3"}, true},
+		{Options{"r": "true", "t": "3", "no-fallback": "true"}, false},
+		{Options{"r": "true", "t": "3", "udp-deadline": "8s"}, false},
+		{Options{"route": "corp.internal=recursive", "t": "3"}, true},
+	}
+
+	for _, tt := range tests {
+		_, err := NewFromOptions(tt.opts)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%v: err = %v, want error %v", tt.opts, err, tt.wantErr)
+		}
+	}
+}
+
+func TestIPv6Servers(t *testing.T) {
+	for _, dns := range []string{"fd00::1", "[fd00::1]", "[fd00::1]:53"} {
+		cfg, err := NewFromOptions(Options{"dns": dns})
+		if err != nil {
+			t.Errorf("-dns %s: %v", dns, err)
+			continue
+		}
+		if servers := cfg.TargetServers(); len(servers) != 1 || servers[0].String() != "fd00::1" {
+			t.Errorf("-dns %s gave %v, want fd00::1", dns, servers)
+		}
+	}
+}
+
+func TestLogSample(t *testing.T) {
+	for sample, wantErr := range map[string]bool{"1": false, "100": false, "0": true, "-1": true, "-9223372036854775808": true} {
+		if _, err := NewFromOptions(Options{"log-sample": sample}); (err != nil) != wantErr {
+			t.Errorf("-log-sample %s: err = %v, want error %v", sample, err, wantErr)
+		}
+	}
+}
+
+func TestCacheTTLBounds(t *testing.T) {
+	tests := []struct {
+		opts    Options
+		wantErr bool
+	}{
+		{Options{}, false},
+		{Options{"positive-min-ttl": "0", "positive-max-ttl": "1h"}, false},
+		{Options{"negative-min-ttl": "1m", "negative-max-ttl": "1m"}, false},
+		// a zero maximum is unbounded, whatever the minimum
+		{Options{"delegation-min-ttl": "1h", "delegation-max-ttl": "0"}, false},
+		{Options{"positive-min-ttl": "-1s"}, true},
+		{Options{"negative-max-ttl": "-1s"}, true},
+		{Options{"delegation-max-ttl": "1m"}, true},
+		{Options{"positive-min-ttl": "1h", "positive-max-ttl": "1m"}, true},
+	}
+
+	for _, tt := range tests {
+		_, err := NewFromOptions(tt.opts)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%v: err = %v, want error %v", tt.opts, err, tt.wantErr)
+		}
+	}
+}
@@ -0,0 +1,173 @@
+package config
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/fudanchii/ssh2dns/internal/names"
+	"github.com/miekg/dns"
+)
+
+// parsePrefixes parses comma separated CIDRs, bare addresses are taken as single host networks.
+func parsePrefixes(list string) ([]netip.Prefix, error) {
+	prefixes := []netip.Prefix{}
+
+	for _, item := range strings.Split(list, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+
+		prefix, err := netip.ParsePrefix(item)
+		if err != nil {
+			addr, aerr := netip.ParseAddr(item)
+			if aerr != nil {
+				return nil, fmt.Errorf("invalid network %q: %s", item, err.Error())
+			}
+			prefix = netip.PrefixFrom(addr, addr.BitLen())
+		}
+
+		prefixes = append(prefixes, prefix.Masked())
+	}
+
+	return prefixes, nil
+}
+
+func parseAllowList(list string) ([]netip.Prefix, error) {
+	switch strings.TrimSpace(list) {
+	case "":
+		return parsePrefixes(defaultAllowedClients)
+	case allowAllClients:
+		return []netip.Prefix{netip.MustParsePrefix("0.0.0.0/0"), netip.MustParsePrefix("::/0")}, nil
+	}
+	return parsePrefixes(list)
+}
+
+// parseTTLOverrides parses comma separated type=duration pairs, e.g. NS=1h,A=30s.
+func parseTTLOverrides(list string) (map[uint16]time.Duration, error) {
+	overrides := map[uint16]time.Duration{}
+
+	for _, item := range strings.Split(list, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+
+		name, val, ok := strings.Cut(item, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid TTL override %q, expected type=duration", item)
+		}
+
+		qtype, ok := dns.StringToType[strings.ToUpper(strings.TrimSpace(name))]
+		if !ok {
+			return nil, fmt.Errorf("invalid TTL override %q: unknown record type %s", item, name)
+		}
+
+		ttl, err := time.ParseDuration(strings.TrimSpace(val))
+		if err != nil || ttl < 0 {
+			return nil, fmt.Errorf("invalid TTL override %q: bad duration %s", item, val)
+		}
+
+		overrides[qtype] = ttl
+	}
+
+	return overrides, nil
+}
+
+// Strategies a -route may resolve its zone with.
+const (
+	RouteRecursive = "recursive"
+	RouteLocal     = "local"
+	RouteForward   = "forward"
+)
+
+// Route tells how names in Zone, and below it, are resolved, overriding -r and -dns for them.
+type Route struct {
+	Zone     string
+	Strategy string
+
+	// Servers are the resolvers asked through the tunnel, with RouteForward only
+	Servers []net.IP
+}
+
+// parseRoutes parses comma separated zone=strategy pairs, e.g. corp.internal=10.0.0.53|10.0.0.54,lan=local,
+// where the strategy is recursive, local, or the resolvers to forward to, separated by |.
+// Routes are returned most specific zone first. Resolvers given with a port must use port.
+func parseRoutes(list, port string) ([]Route, error) {
+	routes := []Route{}
+
+	for _, item := range strings.Split(list, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+
+		zone, target, ok := strings.Cut(item, "=")
+		zone, target = strings.TrimSpace(zone), strings.TrimSpace(target)
+		if !ok || zone == "" || target == "" {
+			return nil, fmt.Errorf("invalid route %q, expected zone=strategy", item)
+		}
+
+		route := Route{Zone: names.Canonical(zone), Strategy: target}
+		switch target {
+		case RouteRecursive, RouteLocal:
+		default:
+			servers, err := parseServers(strings.ReplaceAll(target, "|", ","), port)
+			if err != nil {
+				return nil, fmt.Errorf("invalid route %q: %s", item, err.Error())
+			}
+			route.Strategy, route.Servers = RouteForward, servers
+		}
+
+		routes = append(routes, route)
+	}
+
+	sort.SliceStable(routes, func(i, j int) bool {
+		return dns.CountLabel(routes[i].Zone) > dns.CountLabel(routes[j].Zone)
+	})
+
+	return routes, nil
+}
+
+// Schemes -ssh-proxy accepts, socks5h is taken as socks5, the proxy always resolves the ssh server name.
+const (
+	ProxyHTTP   = "http"
+	ProxySOCKS5 = "socks5"
+)
+
+// parseProxyURL parses the -ssh-proxy URL, an empty one gives nil.
+// The port defaults to 8080 for http and 1080 for socks5.
+func parseProxyURL(raw string) (*url.URL, error) {
+	if raw == "" {
+		return nil, nil
+	}
+
+	u, err := url.Parse(raw)
+	if err != nil {
+		return nil, fmt.Errorf("invalid -ssh-proxy %s: %w", raw, err)
+	}
+
+	port := ""
+	switch u.Scheme {
+	case ProxyHTTP:
+		port = "8080"
+	case ProxySOCKS5, "socks5h":
+		u.Scheme, port = ProxySOCKS5, "1080"
+	default:
+		return nil, fmt.Errorf("invalid -ssh-proxy %s, expected an http:// or socks5:// URL", raw)
+	}
+
+	if u.Hostname() == "" {
+		return nil, fmt.Errorf("invalid -ssh-proxy %s, no proxy host given", raw)
+	}
+	if u.Port() == "" {
+		u.Host = net.JoinHostPort(u.Hostname(), port)
+	}
+
+	return u, nil
+}
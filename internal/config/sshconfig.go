@@ -0,0 +1,72 @@
+package config
+
+import (
+	"net"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/kevinburke/ssh_config"
+)
+
+// applySSHConfig resolves the -s target as an ssh_config Host alias,
+// filling in hostname, port, user, and identity files unless they were given explicitly.
+func (c *AppConfig) applySSHConfig(explicit map[string]bool) {
+	alias, port, err := net.SplitHostPort(c.remoteAddr)
+	if err != nil {
+		// a bare v6 address may still come bracketed
+		alias, port = strings.Trim(c.remoteAddr, "[]"), ""
+	}
+
+	hostname := alias
+	if hn := sshConfigValue(alias, "HostName"); hn != "" {
+		hostname = strings.ReplaceAll(hn, "%h", alias)
+	}
+
+	if port == "" {
+		port = "22"
+		if p := sshConfigValue(alias, "Port"); p != "" {
+			port = p
+		}
+	}
+
+	c.remoteAddr = net.JoinHostPort(hostname, port)
+
+	if !explicit["u"] {
+		if user := sshConfigValue(alias, "User"); user != "" {
+			c.remoteUser = user
+		}
+	}
+
+	if !explicit["i"] {
+		var identities []string
+		for _, identity := range ssh_config.GetAll(alias, "IdentityFile") {
+			if identity != ssh_config.Default("IdentityFile") {
+				identities = append(identities, expandHome(identity))
+			}
+		}
+		if len(identities) > 0 {
+			c.privkeyFile = strings.Join(identities, ",")
+		}
+	}
+}
+
+// sshConfigValue returns the configured value for key, or empty string
+// when the key is not set for alias and only the ssh_config default applies.
+func sshConfigValue(alias, key string) string {
+	val := ssh_config.Get(alias, key)
+	if val == ssh_config.Default(key) {
+		return ""
+	}
+	return val
+}
+
+func expandHome(p string) string {
+	if p == "~" {
+		return os.Getenv("HOME")
+	}
+	if strings.HasPrefix(p, "~/") {
+		return path.Join(os.Getenv("HOME"), p[2:])
+	}
+	return p
+}
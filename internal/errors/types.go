@@ -3,11 +3,21 @@ package errors
 import (
 	"errors"
 	"fmt"
+	"net"
 	"strings"
+	"time"
 
 	"github.com/miekg/dns"
 )
 
+func Is(err, target error) bool {
+	return errors.Is(err, target)
+}
+
+func As(err error, target any) bool {
+	return errors.As(err, target)
+}
+
 type NetworkIssue struct {
 	Reason error
 }
@@ -16,24 +26,26 @@ func (n NetworkIssue) Error() string {
 	return fmt.Sprintf("network issue: %s", n.Reason.Error())
 }
 
-type DomainNotFound struct {
+// LookupFailed means no answer could be had for N, be it from recursion or the fallback server.
+// A name that doesn't exist is not a failure, it is answered with NXDOMAIN.
+type LookupFailed struct {
 	N   string
 	Err error
 }
 
-func (d DomainNotFound) Wrap(err error) DomainNotFound {
-	if !errors.Is(err, d) {
-		d.Err = err
+func (l LookupFailed) Wrap(err error) LookupFailed {
+	if !errors.Is(err, l) {
+		l.Err = err
 	}
-	return d
+	return l
 }
 
-func (d DomainNotFound) Unwrap() error {
-	return d.Err
+func (l LookupFailed) Unwrap() error {
+	return l.Err
 }
 
-func (d DomainNotFound) Error() string {
-	return fmt.Sprintf("domain not found: %s, cause: %s", d.N, d.Err.Error())
+func (l LookupFailed) Error() string {
+	return fmt.Sprintf("lookup failed: %s, cause: %s", l.N, l.Err.Error())
 }
 
 type ConnectionTimeout struct{}
@@ -81,18 +93,38 @@ func (d DNSDialErr) Is(another error) bool {
 	return another == DNSDialErr{}
 }
 
+func (d DNSDialErr) Unwrap() error {
+	return d.Cause
+}
+
 type DNSWriteErr DNSConnectionError
 
 func (d DNSWriteErr) Error() string {
 	return fmt.Sprintf("error writing DNS request: %s", d.Cause.Error())
 }
 
+func (d DNSWriteErr) Is(another error) bool {
+	return another == DNSWriteErr{}
+}
+
+func (d DNSWriteErr) Unwrap() error {
+	return d.Cause
+}
+
 type DNSReadErr DNSConnectionError
 
 func (d DNSReadErr) Error() string {
 	return fmt.Sprintf("error reading DNS response: %s", d.Cause.Error())
 }
 
+func (d DNSReadErr) Is(another error) bool {
+	return another == DNSReadErr{}
+}
+
+func (d DNSReadErr) Unwrap() error {
+	return d.Cause
+}
+
 type DNSResponseNilWithoutError struct {
 	N string
 }
@@ -100,3 +132,229 @@ type DNSResponseNilWithoutError struct {
 func (d DNSResponseNilWithoutError) Error() string {
 	return fmt.Sprintf("%s: DNS response is nil without any error, this should not happen!", d.N)
 }
+
+type RootHintsUnavailable struct {
+	Found int
+	Min   int
+	Err   error
+}
+
+func (r RootHintsUnavailable) Error() string {
+	if r.Err != nil {
+		return fmt.Sprintf("cannot parse root hints: %s", r.Err.Error())
+	}
+	return fmt.Sprintf("root hints only have %d root server addresses, need at least %d", r.Found, r.Min)
+}
+
+type NoAnswerForQuestion struct {
+	N     string
+	Qtype uint16
+}
+
+func (n NoAnswerForQuestion) Error() string {
+	return fmt.Sprintf("answer for %s has no %s records", n.N, dns.TypeToString[n.Qtype])
+}
+
+// CNAMEChainTooLong means following aliases from N went past Max links, likely a loop.
+type CNAMEChainTooLong struct {
+	N   string
+	Max int
+}
+
+func (c CNAMEChainTooLong) Error() string {
+	return fmt.Sprintf("CNAME chain for %s is longer than %d", c.N, c.Max)
+}
+
+// Referral carries the last delegation received before recursion dead-ended.
+type Referral struct {
+	Ns    []dns.RR
+	Extra []dns.RR
+	Err   error
+}
+
+func (r Referral) Unwrap() error {
+	return r.Err
+}
+
+func (r Referral) Error() string {
+	zone := ""
+	if len(r.Ns) > 0 {
+		zone = r.Ns[0].Header().Name
+	}
+
+	if r.Err == nil {
+		return fmt.Sprintf("no usable name server in referral for %s", zone)
+	}
+	return fmt.Sprintf("resolution stalled at referral for %s: %s", zone, r.Err.Error())
+}
+
+// NotCached means N was asked while -cache-only forbids looking up what isn't cached.
+type NotCached struct {
+	N string
+}
+
+func (n NotCached) Error() string {
+	return fmt.Sprintf("%s is not cached, and no lookup is made with -cache-only", n.N)
+}
+
+// ServerSkipped means the server failed too many times in a row and is cooling down.
+type ServerSkipped struct {
+	Server net.IP
+}
+
+func (s ServerSkipped) Error() string {
+	return fmt.Sprintf("skipping %s, it keeps failing", s.Server)
+}
+
+// SSHAuthFailed means the ssh server at Addr refused us, or we refused it, Reason tells which.
+type SSHAuthFailed struct {
+	User   string
+	Addr   string
+	Reason string
+	Keys   []string
+	Banner string
+	Err    error
+}
+
+func (s SSHAuthFailed) Error() string {
+	var sb strings.Builder
+
+	fmt.Fprintf(&sb, "ssh authentication as %s to %s failed, %s: %s", s.User, s.Addr, s.Reason, s.Err.Error())
+	if len(s.Keys) > 0 {
+		fmt.Fprintf(&sb, "\n\toffered keys: %s", strings.Join(s.Keys, ", "))
+	}
+	if s.Banner != "" {
+		fmt.Fprintf(&sb, "\n\tserver banner: %s", s.Banner)
+	}
+
+	return sb.String()
+}
+
+func (s SSHAuthFailed) Unwrap() error {
+	return s.Err
+}
+
+// PinMismatch means the TLS upstream presented a key not among the -upstream-pin hashes.
+type PinMismatch struct {
+	Host string
+	Got  string
+}
+
+func (p PinMismatch) Error() string {
+	if p.Got == "" {
+		return fmt.Sprintf("%s presented no certificate to check against the pinned keys", p.Host)
+	}
+	return fmt.Sprintf("%s presented key sha256/%s, which is not pinned", p.Host, p.Got)
+}
+
+// QueryBudgetExceeded means a lookup sent Max upstream queries without reaching an answer.
+type QueryBudgetExceeded struct {
+	Max int
+}
+
+func (q QueryBudgetExceeded) Error() string {
+	return fmt.Sprintf("gave up after %d upstream queries", q.Max)
+}
+
+// Refused means the server turned the query down, Rsp is its REFUSED reply.
+type Refused struct {
+	Server net.IP
+	Rsp    *dns.Msg
+}
+
+func (r Refused) Error() string {
+	return fmt.Sprintf("%s refused the query", r.Server)
+}
+
+// ServerFailure means the server answered SERVFAIL, Rsp is its reply, which may tell why in an extended error (RFC 8914).
+type ServerFailure struct {
+	Server net.IP
+	Rsp    *dns.Msg
+}
+
+func (s ServerFailure) Error() string {
+	return fmt.Sprintf("%s failed to answer the query", s.Server)
+}
+
+// ResponseMismatch means a reply from Server was not for the query sent, Reason tells how it differs.
+type ResponseMismatch struct {
+	Server net.IP
+	Reason string
+}
+
+func (r ResponseMismatch) Error() string {
+	return fmt.Sprintf("reply from %s doesn't match the query: %s", r.Server, r.Reason)
+}
+
+// TruncatedResponse means the server kept truncating its reply, even given a large buffer.
+type TruncatedResponse struct {
+	Server net.IP
+}
+
+func (t TruncatedResponse) Error() string {
+	return fmt.Sprintf("%s keeps truncating its response", t.Server)
+}
+
+// MessageTooLarge means a reply announced a length over the -max-msg-size bound.
+type MessageTooLarge struct {
+	Len int
+	Max int
+}
+
+func (m MessageTooLarge) Error() string {
+	return fmt.Sprintf("reply of %d bytes exceeds the %d bytes limit", m.Len, m.Max)
+}
+
+// CookieMismatch means a reply carried a client cookie other than the one sent to Server,
+// it was not an answer to our query.
+type CookieMismatch struct {
+	Server net.IP
+}
+
+func (c CookieMismatch) Error() string {
+	return fmt.Sprintf("reply from %s carries a client cookie we didn't send", c.Server)
+}
+
+// PoolExhausted means no connection became available within the acquire timeout.
+type PoolExhausted struct {
+	Wait time.Duration
+}
+
+func (p PoolExhausted) Error() string {
+	return fmt.Sprintf("no connection available after waiting %s", p.Wait)
+}
+
+// ServerUnreachable means the ssh server could not connect to Addr on our behalf, e.g. nothing listens there
+// or the address family isn't routed from it.
+type ServerUnreachable struct {
+	Addr   string
+	Reason string
+}
+
+func (s ServerUnreachable) Error() string {
+	return fmt.Sprintf("ssh server cannot connect to %s: %s", s.Addr, s.Reason)
+}
+
+// SessionsBusy means every session -max-sessions allows on the ssh connection stayed in use for the dial timeout.
+type SessionsBusy struct{}
+
+func (s SessionsBusy) Error() string {
+	return "no ssh session free within the dial timeout"
+}
+
+type PoolReconnecting struct{}
+
+func (p PoolReconnecting) Error() string {
+	return "connection pool is reconnecting"
+}
+
+// DNAMEOverflow means substituting a DNAME target into the query name
+// produced a name longer than a domain name may be (RFC 6672 section 2.2).
+type DNAMEOverflow struct {
+	N      string
+	Target string
+}
+
+func (d DNAMEOverflow) Error() string {
+	return fmt.Sprintf("DNAME substitution of %s with %s exceeds maximum name length", d.N, d.Target)
+}
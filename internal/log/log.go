@@ -3,10 +3,47 @@ package log
 import (
 	"fmt"
 	"os"
+	"sync/atomic"
 )
 
+// instance tags every line, telling apart the logs of several ssh2dns merged together.
+var instance string
+
+// SetInstance sets the tag put after the level marker of every line, empty disables it.
+func SetInstance(name string) {
+	instance = ""
+	if name != "" {
+		instance = "[" + name + "] "
+	}
+}
+
+// debug tells whether Debug lines are written, it may be flipped while logging goes on.
+var debug atomic.Bool
+
+// SetDebug enables or disables Debug lines.
+func SetDebug(enabled bool) {
+	debug.Store(enabled)
+}
+
+// ToggleDebug flips Debug lines on or off, returning whether they are now enabled.
+func ToggleDebug() bool {
+	for {
+		old := debug.Load()
+		if debug.CompareAndSwap(old, !old) {
+			return !old
+		}
+	}
+}
+
+// Debug writes msg only while debug logging is enabled.
+func Debug(msg string) {
+	if debug.Load() {
+		fmt.Fprintf(os.Stderr, "[~] %s%s\n", instance, msg)
+	}
+}
+
 func Err(msg string) {
-	fmt.Fprintf(os.Stderr, "[!] %s\n", msg)
+	fmt.Fprintf(os.Stderr, "[!] %s%s\n", instance, msg)
 }
 
 func Fatal(msg string) {
@@ -15,9 +52,9 @@ func Fatal(msg string) {
 }
 
 func Info(msg string) {
-	fmt.Printf("[-] %s\n", msg)
+	fmt.Printf("[-] %s%s\n", instance, msg)
 }
 
 func Raw(label string, msg interface{}) {
-	fmt.Fprintf(os.Stderr, "[*] <%s> %q\n", label, msg)
+	fmt.Fprintf(os.Stderr, "[*] %s<%s> %q\n", instance, label, msg)
 }
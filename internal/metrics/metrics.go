@@ -0,0 +1,123 @@
+// Package metrics keeps runtime counters, published through expvar
+// and served as JSON when -metrics is given.
+package metrics
+
+import (
+	"context"
+	"expvar"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	// Instance is the -name of this ssh2dns, labelling the metrics of several instances scraped together.
+	Instance = expvar.NewString("instance")
+
+	// AcquireWait is how long lookups waited for a connection from the pool.
+	AcquireWait = NewDuration("pool_acquire_wait")
+
+	// PoolExhausted counts lookups giving up waiting for a connection.
+	PoolExhausted = expvar.NewInt("pool_exhausted")
+
+	// ReplySize is the packed size of the replies sent to clients, in bytes.
+	ReplySize = NewHistogram("reply_size_bytes", []int64{128, 256, 512, 1232, 4096, 16384, 65535})
+
+	// Truncated counts replies sent with the TC bit set.
+	Truncated = expvar.NewInt("replies_truncated")
+
+	// TransfersRefused counts the zone transfers (AXFR, IXFR) asked of us, all refused.
+	TransfersRefused = expvar.NewInt("transfers_refused")
+)
+
+// Duration aggregates observed durations into count, total, and max.
+type Duration struct {
+	count atomic.Int64
+	total atomic.Int64
+	max   atomic.Int64
+}
+
+// NewDuration creates a Duration published under name.
+func NewDuration(name string) *Duration {
+	d := &Duration{}
+	expvar.Publish(name, expvar.Func(d.snapshot))
+	return d
+}
+
+func (d *Duration) Observe(elapsed time.Duration) {
+	d.count.Add(1)
+	d.total.Add(int64(elapsed))
+	for {
+		current := d.max.Load()
+		if int64(elapsed) <= current || d.max.CompareAndSwap(current, int64(elapsed)) {
+			return
+		}
+	}
+}
+
+func (d *Duration) snapshot() any {
+	count, total := d.count.Load(), d.total.Load()
+
+	var mean time.Duration
+	if count > 0 {
+		mean = time.Duration(total / count)
+	}
+
+	return map[string]any{
+		"count":   count,
+		"mean_ms": mean.Seconds() * 1000,
+		"max_ms":  time.Duration(d.max.Load()).Seconds() * 1000,
+	}
+}
+
+// Histogram counts observed values into buckets, each counting the values up to its upper bound.
+type Histogram struct {
+	bounds []int64
+	counts []atomic.Int64
+}
+
+// NewHistogram creates a Histogram published under name, bounds must be ascending.
+// Values past the last bound go in an overflow bucket.
+func NewHistogram(name string, bounds []int64) *Histogram {
+	h := &Histogram{bounds: bounds, counts: make([]atomic.Int64, len(bounds)+1)}
+	expvar.Publish(name, expvar.Func(h.snapshot))
+	return h
+}
+
+func (h *Histogram) Observe(value int64) {
+	i := sort.Search(len(h.bounds), func(i int) bool { return value <= h.bounds[i] })
+	h.counts[i].Add(1)
+}
+
+func (h *Histogram) snapshot() any {
+	buckets := make(map[string]int64, len(h.counts))
+	for i, bound := range h.bounds {
+		buckets["le_"+strconv.FormatInt(bound, 10)] = h.counts[i].Load()
+	}
+	buckets["inf"] = h.counts[len(h.bounds)].Load()
+	return buckets
+}
+
+// Server serves the published metrics on /debug/vars.
+type Server struct {
+	srv *http.Server
+}
+
+func NewServer(addr string) *Server {
+	mux := http.NewServeMux()
+	mux.Handle("/debug/vars", expvar.Handler())
+	return &Server{srv: &http.Server{Addr: addr, Handler: mux}}
+}
+
+func (s *Server) ListenAndServe() error {
+	if err := s.srv.ListenAndServe(); err != http.ErrServerClosed {
+		return err
+	}
+	return nil
+}
+
+func (s *Server) Shutdown(ctx context.Context) error {
+	return s.srv.Shutdown(ctx)
+}
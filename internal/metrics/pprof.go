@@ -0,0 +1,18 @@
+package metrics
+
+import (
+	"net/http"
+	"net/http/pprof"
+)
+
+// NewProfileServer serves the net/http/pprof profiles on addr, under /debug/pprof/,
+// on its own mux rather than http.DefaultServeMux, so nothing else gets exposed with it.
+func NewProfileServer(addr string) *Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	return &Server{srv: &http.Server{Addr: addr, Handler: mux}}
+}
@@ -0,0 +1,20 @@
+// Package names puts domain names in the one form used for matching them,
+// so user supplied names, question names, and cache keys all agree.
+package names
+
+import (
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// Canonical returns name fully qualified and lowercased,
+// e.g. "Example.COM" and "example.com." both become "example.com.".
+func Canonical(name string) string {
+	return strings.ToLower(dns.Fqdn(name))
+}
+
+// Equal reports whether a and b are the same name, ignoring case and the trailing dot.
+func Equal(a, b string) bool {
+	return Canonical(a) == Canonical(b)
+}
@@ -0,0 +1,46 @@
+package names
+
+import "testing"
+
+func TestCanonical(t *testing.T) {
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"example.com", "example.com."},
+		{"example.com.", "example.com."},
+		{"Example.COM", "example.com."},
+		{"wWw.ExAmPlE.cOm.", "www.example.com."},
+		{".", "."},
+		{"", "."},
+		// an escaped dot belongs to its label, it is neither a separator nor the trailing dot
+		{`A\.B.example.`, `a\.b.example.`},
+		{`host\.`, `host\..`},
+		{`host\\.`, `host\\.`},
+		{`Tab\009.Example`, `tab\009.example.`},
+	}
+
+	for _, tt := range tests {
+		if got := Canonical(tt.name); got != tt.want {
+			t.Errorf("Canonical(%q) = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestEqual(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want bool
+	}{
+		{"example.com", "EXAMPLE.com.", true},
+		{".", "", true},
+		{`a\.b.example.`, "a.b.example.", false},
+		{"example.com.", "example.org.", false},
+	}
+
+	for _, tt := range tests {
+		if got := Equal(tt.a, tt.b); got != tt.want {
+			t.Errorf("Equal(%q, %q) = %v, want %v", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,48 @@
+package proxy
+
+import (
+	"os"
+
+	"github.com/fudanchii/ssh2dns/internal/log"
+	"github.com/fudanchii/ssh2dns/internal/names"
+
+	"github.com/miekg/dns"
+)
+
+// chaosReply answers the version.bind and hostname.bind CHAOS TXT queries probed by monitoring tools,
+// anything else in class CHAOS, or everything when disabled, is refused.
+func (proxy *Proxy) chaosReply(r *dns.Msg) *dns.Msg {
+	q := r.Question[0]
+
+	rsp := new(dns.Msg)
+	if proxy.config.DisableChaos() || q.Qtype != dns.TypeTXT {
+		rsp.SetRcode(r, dns.RcodeRefused)
+		return rsp
+	}
+
+	var txt string
+	switch names.Canonical(q.Name) {
+	case "version.bind.":
+		txt = proxy.config.ChaosVersion()
+	case "hostname.bind.":
+		hostname, err := os.Hostname()
+		if err != nil {
+			log.Err(err.Error())
+			rsp.SetRcode(r, dns.RcodeServerFailure)
+			return rsp
+		}
+		txt = hostname
+	default:
+		rsp.SetRcode(r, dns.RcodeRefused)
+		return rsp
+	}
+
+	rsp.SetReply(r)
+	rsp.Authoritative = true
+	rsp.Answer = []dns.RR{&dns.TXT{
+		Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeTXT, Class: dns.ClassCHAOS},
+		Txt: []string{txt},
+	}}
+
+	return rsp
+}
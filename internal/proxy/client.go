@@ -0,0 +1,37 @@
+package proxy
+
+import (
+	"net"
+	"net/netip"
+
+	"github.com/fudanchii/ssh2dns/internal/log"
+
+	"github.com/miekg/dns"
+)
+
+func clientAddr(w dns.ResponseWriter) netip.Addr {
+	switch addr := w.RemoteAddr().(type) {
+	case *net.UDPAddr:
+		return addr.AddrPort().Addr().Unmap()
+	case *net.TCPAddr:
+		return addr.AddrPort().Addr().Unmap()
+	}
+	return netip.Addr{}
+}
+
+func containsAddr(prefixes []netip.Prefix, addr netip.Addr) bool {
+	for _, prefix := range prefixes {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+func writeRcode(w dns.ResponseWriter, r *dns.Msg, rcode int) {
+	rsp := new(dns.Msg)
+	rsp.SetRcode(r, rcode)
+	if err := w.WriteMsg(rsp); err != nil {
+		log.Err(err.Error())
+	}
+}
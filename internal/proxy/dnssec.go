@@ -0,0 +1,52 @@
+package proxy
+
+import (
+	"github.com/miekg/dns"
+	"github.com/samber/lo"
+)
+
+// advertisedUDPSize is the EDNS0 buffer size we announce to clients, per DNS flag day 2020.
+const advertisedUDPSize = 1232
+
+// setOPT replaces the OPT record copied from upstream with our own,
+// only present when the client sent one, echoing its DO bit. Extended errors from upstream are kept.
+func setOPT(r *dns.Msg, rsp *dns.Msg) {
+	ede := extendedErrors(rsp)
+	rsp.Extra = lo.Filter(rsp.Extra, func(rr dns.RR, _ int) bool {
+		return rr.Header().Rrtype != dns.TypeOPT
+	})
+
+	if opt := r.IsEdns0(); opt != nil {
+		rsp.SetEdns0(advertisedUDPSize, opt.Do())
+		addEDE(rsp, ede...)
+	}
+}
+
+// wantsDNSSEC reports whether the client understands DNSSEC answers, setting DO or, per RFC 6840 section 5.7, AD.
+func wantsDNSSEC(r *dns.Msg) bool {
+	if opt := r.IsEdns0(); opt != nil && opt.Do() {
+		return true
+	}
+	return r.AuthenticatedData
+}
+
+// stripDNSSEC drops the DNSSEC records a client not setting DO didn't ask for, per RFC 3225 section 3.
+// They may be in the cache from a client that did set it.
+func stripDNSSEC(r *dns.Msg, rsp *dns.Msg) {
+	if opt := r.IsEdns0(); opt != nil && opt.Do() {
+		return
+	}
+
+	qtype := r.Question[0].Qtype
+	keep := func(rr dns.RR, _ int) bool {
+		switch t := rr.Header().Rrtype; t {
+		case dns.TypeRRSIG, dns.TypeNSEC, dns.TypeNSEC3:
+			return t == qtype
+		}
+		return true
+	}
+
+	rsp.Answer = lo.Filter(rsp.Answer, keep)
+	rsp.Ns = lo.Filter(rsp.Ns, keep)
+	rsp.Extra = lo.Filter(rsp.Extra, keep)
+}
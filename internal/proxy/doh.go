@@ -0,0 +1,256 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/fudanchii/ssh2dns/internal/config"
+	"github.com/fudanchii/ssh2dns/internal/log"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	dohPath        = "/dns-query"
+	dohContentType = "application/dns-message"
+	dohMaxMsgSize  = dns.MaxMsgSize
+)
+
+// dohServer serves RFC 8484 DNS-over-HTTPS requests,
+// feeding them through the same handler used by the plain DNS listener.
+type dohServer struct {
+	srv      *http.Server
+	listener net.Listener
+	handler  dns.HandlerFunc
+	certFile string
+	keyFile  string
+	cert     atomic.Pointer[tls.Certificate]
+}
+
+func newDoHServer(cfg *config.AppConfig, handler dns.HandlerFunc) (*dohServer, error) {
+	if cfg.DoHCertFile() == "" || cfg.DoHKeyFile() == "" {
+		return nil, fmt.Errorf("DNS-over-HTTPS listener requires both -doh-cert and -doh-key")
+	}
+
+	doh := &dohServer{
+		handler:  handler,
+		certFile: cfg.DoHCertFile(),
+		keyFile:  cfg.DoHKeyFile(),
+	}
+
+	if _, err := doh.loadCertificate(); err != nil {
+		return nil, err
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle(dohPath, doh)
+	doh.srv = &http.Server{
+		Addr:    cfg.DoHAddr(),
+		Handler: mux,
+		TLSConfig: &tls.Config{
+			MinVersion: tls.VersionTLS12,
+			GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+				return doh.cert.Load(), nil
+			},
+		},
+	}
+
+	return doh, nil
+}
+
+func (doh *dohServer) loadCertificate() (*x509.Certificate, error) {
+	cert, err := tls.LoadX509KeyPair(doh.certFile, doh.keyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return nil, err
+	}
+
+	cert.Leaf = leaf
+	doh.cert.Store(&cert)
+
+	return leaf, nil
+}
+
+// reloadCertificate swaps in the certificate from disk,
+// connections already established keep using the previous one.
+func (doh *dohServer) reloadCertificate() error {
+	previous := doh.cert.Load().Leaf
+
+	leaf, err := doh.loadCertificate()
+	if err != nil {
+		return err
+	}
+
+	if previous.Equal(leaf) {
+		log.Info("DNS-over-HTTPS certificate unchanged")
+		return nil
+	}
+
+	log.Info(fmt.Sprintf(
+		"DNS-over-HTTPS certificate changed: %s (expires %s) -> %s (expires %s)",
+		previous.Subject, previous.NotAfter.Format(time.RFC3339),
+		leaf.Subject, leaf.NotAfter.Format(time.RFC3339),
+	))
+
+	return nil
+}
+
+// Serve serves on the listener bound by New, the certificate comes from GetCertificate.
+func (doh *dohServer) Serve() error {
+	if err := doh.srv.ServeTLS(doh.listener, "", ""); err != http.ErrServerClosed {
+		return err
+	}
+	return nil
+}
+
+func (doh *dohServer) Shutdown(ctx context.Context) error {
+	// the listener is only the server's to close once it serves on it
+	doh.listener.Close()
+	return doh.srv.Shutdown(ctx)
+}
+
+func (doh *dohServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var (
+		buf []byte
+		err error
+	)
+
+	switch r.Method {
+	case http.MethodGet:
+		// base64url without padding per RFC 8484, but be lenient with padded input
+		buf, err = base64.RawURLEncoding.DecodeString(strings.TrimRight(r.URL.Query().Get("dns"), "="))
+	case http.MethodPost:
+		if r.Header.Get("Content-Type") != dohContentType {
+			http.Error(w, "unsupported content type", http.StatusUnsupportedMediaType)
+			return
+		}
+		buf, err = io.ReadAll(io.LimitReader(r.Body, dohMaxMsgSize))
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if err != nil || len(buf) == 0 {
+		http.Error(w, "malformed DNS message", http.StatusBadRequest)
+		return
+	}
+
+	req := new(dns.Msg)
+	if err = req.Unpack(buf); err != nil {
+		http.Error(w, "malformed DNS message", http.StatusBadRequest)
+		return
+	}
+
+	rw := &dohResponseWriter{remote: httpRemoteAddr(r)}
+	if local, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+		rw.local = local
+	}
+
+	doh.handler(rw, req)
+
+	if rw.msg == nil {
+		http.Error(w, "lookup failed", http.StatusBadGateway)
+		return
+	}
+
+	out, err := rw.msg.Pack()
+	if err != nil {
+		log.Err(err.Error())
+		http.Error(w, "cannot pack DNS response", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", dohContentType)
+	if ttl, ok := minTTL(rw.msg); ok {
+		w.Header().Set("Cache-Control", fmt.Sprintf("max-age=%d", ttl))
+	}
+
+	if _, err = w.Write(out); err != nil {
+		log.Err(err.Error())
+	}
+}
+
+// dohResponseWriter captures the reply written by the DNS handler
+// so it can be sent back as an HTTP response body.
+type dohResponseWriter struct {
+	local  net.Addr
+	remote net.Addr
+	msg    *dns.Msg
+}
+
+func (w *dohResponseWriter) LocalAddr() net.Addr {
+	return w.local
+}
+
+func (w *dohResponseWriter) RemoteAddr() net.Addr {
+	return w.remote
+}
+
+func (w *dohResponseWriter) WriteMsg(msg *dns.Msg) error {
+	w.msg = msg
+	return nil
+}
+
+func (w *dohResponseWriter) Write(buf []byte) (int, error) {
+	msg := new(dns.Msg)
+	if err := msg.Unpack(buf); err != nil {
+		return 0, err
+	}
+	w.msg = msg
+	return len(buf), nil
+}
+
+func (w *dohResponseWriter) Close() error {
+	return nil
+}
+
+func (w *dohResponseWriter) TsigStatus() error {
+	return nil
+}
+
+func (w *dohResponseWriter) TsigTimersOnly(bool) {}
+
+func (w *dohResponseWriter) Hijack() {}
+
+func httpRemoteAddr(r *http.Request) net.Addr {
+	addrPort, err := netip.ParseAddrPort(r.RemoteAddr)
+	if err != nil {
+		return nil
+	}
+	return net.TCPAddrFromAddrPort(addrPort)
+}
+
+// minTTL returns the lowest TTL across answer and authority records,
+// which bounds how long the HTTP response may be cached.
+func minTTL(msg *dns.Msg) (uint32, bool) {
+	var (
+		ttl   uint32 = math.MaxUint32
+		found bool
+	)
+
+	for _, section := range [][]dns.RR{msg.Answer, msg.Ns} {
+		for _, rr := range section {
+			if rr.Header().Ttl < ttl {
+				ttl = rr.Header().Ttl
+			}
+			found = true
+		}
+	}
+
+	return ttl, found
+}
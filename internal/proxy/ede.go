@@ -0,0 +1,76 @@
+package proxy
+
+import (
+	"context"
+
+	"github.com/fudanchii/ssh2dns/internal/errors"
+	"github.com/miekg/dns"
+)
+
+// extendedErrors returns the extended DNS errors (RFC 8914) carried in the OPT record of m.
+func extendedErrors(m *dns.Msg) []*dns.EDNS0_EDE {
+	opt := m.IsEdns0()
+	if opt == nil {
+		return nil
+	}
+
+	var ede []*dns.EDNS0_EDE
+	for _, o := range opt.Option {
+		if e, ok := o.(*dns.EDNS0_EDE); ok {
+			ede = append(ede, e)
+		}
+	}
+	return ede
+}
+
+// addEDE attaches ede to the OPT record of rsp, clients not doing EDNS get none.
+func addEDE(rsp *dns.Msg, ede ...*dns.EDNS0_EDE) {
+	opt := rsp.IsEdns0()
+	if opt == nil {
+		return
+	}
+	for _, e := range ede {
+		opt.Option = append(opt.Option, e)
+	}
+}
+
+// failureEDE explains err as an extended DNS error, preferring what the upstream said
+// along with its SERVFAIL or REFUSED. Failures without a fitting code get none.
+func failureEDE(err error) []*dns.EDNS0_EDE {
+	var (
+		servfail errors.ServerFailure
+		refused  errors.Refused
+	)
+	if errors.As(err, &servfail) {
+		if ede := extendedErrors(servfail.Rsp); len(ede) > 0 {
+			return ede
+		}
+	}
+	if errors.As(err, &refused) {
+		if ede := extendedErrors(refused.Rsp); len(ede) > 0 {
+			return ede
+		}
+	}
+
+	var code uint16
+	var text string
+	switch {
+	case errors.Is(err, errors.PoolReconnecting{}), errors.Is(err, errors.DNSDialErr{}),
+		errors.As(err, new(errors.PoolExhausted)), errors.As(err, new(errors.SSHAuthFailed)),
+		errors.As(err, new(errors.PinMismatch)), errors.As(err, new(errors.NetworkIssue)):
+		code, text = dns.ExtendedErrorCodeNetworkError, "upstream unreachable"
+	case errors.As(err, new(errors.QueryBudgetExceeded)):
+		code, text = dns.ExtendedErrorCodeOther, "recursion query budget exceeded"
+	case errors.As(err, new(errors.CNAMEChainTooLong)):
+		code, text = dns.ExtendedErrorCodeOther, "CNAME chain too long"
+	case errors.As(err, new(errors.NotCached)):
+		code, text = dns.ExtendedErrorCodeOther, "not cached, lookups are disabled"
+	case errors.Is(err, context.DeadlineExceeded), errors.Is(err, errors.ConnectionTimeout{}),
+		errors.Is(err, errors.SessionsBusy{}), errors.As(err, new(errors.ServerSkipped)):
+		code, text = dns.ExtendedErrorCodeNoReachableAuthority, "no name server answered in time"
+	default:
+		return nil
+	}
+
+	return []*dns.EDNS0_EDE{{InfoCode: code, ExtraText: text}}
+}
@@ -0,0 +1,87 @@
+package proxy
+
+import (
+	"net"
+
+	"github.com/miekg/dns"
+	"github.com/samber/lo"
+)
+
+// dedupRRs returns rrs without duplicate records, keeping the first occurrence.
+// Unlike dns.Dedup it leaves the given records untouched, they may be shared with the cache.
+func dedupRRs(rrs []dns.RR) []dns.RR {
+	unique := make([]dns.RR, 0, len(rrs))
+	for _, rr := range rrs {
+		duplicate := false
+		for _, u := range unique {
+			if dns.IsDuplicate(rr, u) {
+				duplicate = true
+				break
+			}
+		}
+		if !duplicate {
+			unique = append(unique, rr)
+		}
+	}
+	return unique
+}
+
+// udpReplySize returns the largest UDP reply the client advertised it can take,
+// false if the client is not using UDP, thus not bound by it.
+func udpReplySize(w dns.ResponseWriter, r *dns.Msg) (int, bool) {
+	if _, ok := w.RemoteAddr().(*net.UDPAddr); !ok {
+		return 0, false
+	}
+
+	size := dns.MinMsgSize
+	if opt := r.IsEdns0(); opt != nil && int(opt.UDPSize()) > size {
+		size = int(opt.UDPSize())
+	}
+
+	return size, true
+}
+
+// trimExtra drops the additional section of UDP replies which won't fit the client's buffer,
+// the OPT record is kept so the client still sees our EDNS0 parameters.
+func trimExtra(w dns.ResponseWriter, r *dns.Msg, rsp *dns.Msg) {
+	size, udp := udpReplySize(w, r)
+	if !udp || rsp.Len() <= size {
+		return
+	}
+
+	var kept []dns.RR
+	for _, rr := range rsp.Extra {
+		if rr.Header().Rrtype == dns.TypeOPT {
+			kept = append(kept, rr)
+		}
+	}
+	rsp.Extra = kept
+}
+
+// minimize drops what a positive answer doesn't need from rsp, the name servers of the zone
+// and the addresses in the additional section. NSEC, NSEC3, and their RRSIG stay in the authority section,
+// a validating client needs them to check wildcard answers, OPT stays in the additional section.
+func minimize(rsp *dns.Msg) {
+	if rsp.Rcode != dns.RcodeSuccess || len(rsp.Answer) == 0 {
+		return
+	}
+
+	rsp.Ns = lo.Filter(rsp.Ns, func(rr dns.RR, _ int) bool {
+		rrtype := rr.Header().Rrtype
+		if sig, ok := rr.(*dns.RRSIG); ok {
+			rrtype = sig.TypeCovered
+		}
+		return rrtype == dns.TypeNSEC || rrtype == dns.TypeNSEC3
+	})
+	rsp.Extra = lo.Filter(rsp.Extra, func(rr dns.RR, _ int) bool {
+		return rr.Header().Rrtype == dns.TypeOPT
+	})
+}
+
+// truncate cuts UDP replies down to the client's buffer, setting TC so it retries over TCP.
+// TCP replies are written whole.
+func truncate(w dns.ResponseWriter, r *dns.Msg, rsp *dns.Msg) {
+	if size, udp := udpReplySize(w, r); udp {
+		rsp.Truncate(size)
+	}
+}
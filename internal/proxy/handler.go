@@ -3,50 +3,87 @@ package proxy
 import (
 	"context"
 	"fmt"
+	"net"
+	"sync/atomic"
 	"time"
 
 	"github.com/fudanchii/ssh2dns/internal/config"
 	"github.com/fudanchii/ssh2dns/internal/errors"
 	"github.com/fudanchii/ssh2dns/internal/log"
+	"github.com/fudanchii/ssh2dns/internal/metrics"
+	"github.com/fudanchii/ssh2dns/internal/names"
 	"github.com/fudanchii/ssh2dns/internal/recdns"
+	"github.com/fudanchii/ssh2dns/internal/tracing"
 
 	"github.com/miekg/dns"
 	"github.com/sourcegraph/conc/pool"
+	"go.opentelemetry.io/otel/attribute"
+	"golang.org/x/sync/errgroup"
 	"golang.org/x/sync/singleflight"
 )
 
 type proxyRequest struct {
+	ctx        context.Context
 	message    *dns.Msg
 	rspChannel chan *dns.Msg
 	errChannel chan error
 }
 
 type Proxy struct {
-	srv         *dns.Server
+	servers     []*dns.Server
 	workers     *pool.Pool
 	flightGroup singleflight.Group
 	config      *config.AppConfig
 	rdns        *recdns.LookupCoordinator
+	doh         *dohServer
+	limiter     *rateLimiter
+	rotation    atomic.Uint32
+	requests    atomic.Uint64
+
+	// ctx is cancelled on shutdown, aborting lookups still in flight
+	ctx    context.Context
+	cancel context.CancelFunc
 }
 
-func New(cfg *config.AppConfig, clientPool recdns.DNSClientPool) *Proxy {
+func New(cfg *config.AppConfig, rdns *recdns.LookupCoordinator) (*Proxy, error) {
 	var proxy = Proxy{
 		config:  cfg,
 		workers: pool.New().WithMaxGoroutines(cfg.WorkerNum() * 2),
-		srv:     &dns.Server{Addr: cfg.BindAddr(), Net: "udp"},
-		rdns:    recdns.New(cfg, clientPool),
+		rdns:    rdns,
+		limiter: newRateLimiter(cfg),
 	}
+	proxy.ctx, proxy.cancel = context.WithCancel(context.Background())
 
-	dns.HandleFunc(".", proxy.handler)
+	if cfg.DoHAddr() != "" {
+		doh, err := newDoHServer(cfg, proxy.handler)
+		if err != nil {
+			return nil, err
+		}
+		proxy.doh = doh
+	}
+
+	// serve with our own handler rather than the global one, so several proxies can coexist in one program
+	servers, err := bind(cfg, dns.HandlerFunc(proxy.handler))
+	if err != nil {
+		return nil, err
+	}
+	proxy.servers = servers
+
+	if proxy.doh != nil {
+		if proxy.doh.listener, err = bindDoH(cfg); err != nil {
+			closeServers(servers)
+			return nil, err
+		}
+	}
 
-	return &proxy
+	return &proxy, nil
 }
 
 func (proxy *Proxy) handleRequest(req *proxyRequest) {
-	rspMessage, err := proxy.rdns.Handle(req.message)
+	rspMessage, err := proxy.rdns.Handle(req.ctx, req.message)
 
 	if err != nil {
-		req.errChannel <- fmt.Errorf("error handling lookup: %s", err.Error())
+		req.errChannel <- fmt.Errorf("error handling lookup: %w", err)
 		return
 	}
 
@@ -59,40 +96,133 @@ func (proxy *Proxy) handler(w dns.ResponseWriter, r *dns.Msg) {
 		err error
 	)
 
+	client := clientAddr(w)
+
+	if !containsAddr(proxy.config.AllowedClients(), client) {
+		writeRcode(w, r, dns.RcodeRefused)
+		return
+	}
+
+	if proxy.limiter != nil && !proxy.limiter.Allow(client) {
+		if !proxy.config.RateLimitDrop() {
+			writeRcode(w, r, dns.RcodeRefused)
+		}
+		return
+	}
+
+	// only plain queries are served, the miekg/dns listeners let NOTIFY through and DoH checks nothing
+	if r.Opcode != dns.OpcodeQuery {
+		writeRcode(w, r, dns.RcodeNotImplemented)
+		return
+	}
+	if len(r.Question) != 1 {
+		writeRcode(w, r, dns.RcodeFormatError)
+		return
+	}
+
+	// we are no authority for any zone, and transfers don't recurse, don't send them on as queries
+	if qtype := r.Question[0].Qtype; qtype == dns.TypeAXFR || qtype == dns.TypeIXFR {
+		metrics.TransfersRefused.Add(1)
+		writeRcode(w, r, dns.RcodeRefused)
+		return
+	}
+
+	if r.Question[0].Qclass == dns.ClassCHAOS {
+		if err = w.WriteMsg(proxy.chaosReply(r)); err != nil {
+			log.Err(err.Error())
+		}
+		return
+	}
+
+	// recursion only walks the IN hierarchy, forwarders may know other classes
+	if r.Question[0].Qclass != dns.ClassINET && proxy.rdns.Recursive(r.Question[0].Name) {
+		writeRcode(w, r, dns.RcodeRefused)
+		return
+	}
+
 	rsp := new(dns.Msg)
 	rsp.SetReply(r)
 
+	ctx, span := tracing.Start(proxy.ctx, "dns.query",
+		attribute.String("dns.question.name", r.Question[0].Name),
+		attribute.String("dns.question.type", dns.TypeToString[r.Question[0].Qtype]),
+		attribute.String("client.address", client.String()),
+	)
+	defer func() { tracing.End(span, err) }()
+
 	start := time.Now()
 
 	msg, hit := proxy.rdns.CacheLookup(r)
+	span.SetAttributes(attribute.Bool("cache.hit", hit))
+	if hit {
+		log.Debug("cache hit for " + r.Question[0].Name + " " + dns.TypeToString[r.Question[0].Qtype])
+	}
 
-	if !hit {
-		msg, err = proxy.singleFlightRequestHandler(r)
+	if !hit && proxy.config.CacheOnly() {
+		// offline, what is cached is all there is
+		if msg, hit = proxy.rdns.StaleLookup(r); !hit {
+			err = errors.NotCached{N: r.Question[0].Name}
+		}
+	} else if !hit {
+		msg, err = proxy.singleFlightRequestHandler(ctx, r, proxy.requestTimeout(w))
 	}
 
 	end := time.Now()
 
+	if err == nil && msg == nil {
+		err = errors.DNSResponseNilWithoutError{N: r.Question[0].Name}
+	}
+
 	if err != nil {
 		log.Err(err.Error())
-		return
+		rsp = proxy.failureReply(r, err)
+	} else {
+		// NXDOMAIN is an answer too, only the authority section differs from NODATA
+		rsp.Rcode = msg.Rcode
+		rebound := false
+		if len(msg.Answer) > 0 {
+			rsp.Answer = msg.Answer
+			if proxy.config.RebindProtection() && stripRebinding(proxy.config, r, rsp) && !hasType(rsp.Answer, r.Question[0].Qtype) {
+				// no address left, fail rather than pretend the name has none
+				rsp.Rcode = dns.RcodeServerFailure
+				rebound = true
+			}
+			if proxy.config.RotateAnswers() {
+				rsp.Answer = rotateAnswers(rsp.Answer, proxy.rotation.Add(1))
+			}
+		}
+		if len(msg.Ns) > 0 {
+			rsp.Ns = msg.Ns
+		}
+		if len(msg.Extra) > 0 {
+			rsp.Extra = dedupRRs(msg.Extra)
+		}
+		if proxy.config.MinimalResponses() {
+			minimize(rsp)
+		}
+		// RRSIG and NSEC records pass through untouched for clients setting DO
+		rsp.AuthenticatedData = msg.AuthenticatedData && wantsDNSSEC(r)
+		stripDNSSEC(r, rsp)
+		setOPT(r, rsp)
+		if rebound {
+			addEDE(rsp, &dns.EDNS0_EDE{InfoCode: dns.ExtendedErrorCodeFiltered, ExtraText: "private addresses removed by rebinding protection"})
+		}
+		if proxy.config.TrimExtra() {
+			trimExtra(w, r, rsp)
+		}
+		truncate(w, r, rsp)
 	}
 
-	if msg == nil {
-		log.Err(errors.DNSResponseNilWithoutError{N: r.Question[0].Name}.Error())
-		return
-	}
+	span.SetAttributes(attribute.String("dns.rcode", dns.RcodeToString[rsp.Rcode]))
 
-	if len(msg.Answer) > 0 {
-		rsp.Answer = msg.Answer
-	}
-	if len(msg.Ns) > 0 {
-		rsp.Ns = msg.Ns
-	}
-	if len(msg.Extra) > 0 {
-		rsp.Extra = msg.Extra
+	metrics.ReplySize.Observe(int64(rsp.Len()))
+	if rsp.Truncated {
+		metrics.Truncated.Add(1)
 	}
 
-	logRequest(rsp, hit, end.Sub(start))
+	if proxy.sampled() {
+		logRequest(w.RemoteAddr(), rsp, hit, end.Sub(start))
+	}
 
 	if err = w.WriteMsg(rsp); err != nil {
 		log.Err(err.Error())
@@ -100,16 +230,68 @@ func (proxy *Proxy) handler(w dns.ResponseWriter, r *dns.Msg) {
 	}
 }
 
+func (proxy *Proxy) failureReply(r *dns.Msg, err error) *dns.Msg {
+	rsp := new(dns.Msg)
+	rsp.SetRcode(r, dns.RcodeServerFailure)
+
+	var referral errors.Referral
+	if proxy.config.ReturnReferral() && errors.As(err, &referral) {
+		rsp.Ns = referral.Ns
+		rsp.Extra = referral.Extra
+	}
+
+	// tell the client why, when it does EDNS
+	setOPT(r, rsp)
+	addEDE(rsp, failureEDE(err)...)
+
+	return rsp
+}
+
+func (proxy *Proxy) Name() string {
+	return "proxy"
+}
+
+func (proxy *Proxy) Reload() error {
+	if proxy.doh != nil {
+		return proxy.doh.reloadCertificate()
+	}
+	return nil
+}
+
 func (proxy *Proxy) ListenAndServe() error {
-	return proxy.srv.ListenAndServe()
+	if proxy.doh != nil {
+		go func() {
+			log.Info("serving DNS-over-HTTPS on " + proxy.doh.listener.Addr().String())
+			if err := proxy.doh.Serve(); err != nil {
+				log.Err(err.Error())
+			}
+		}()
+	}
+
+	var g errgroup.Group
+	for _, srv := range proxy.servers {
+		srv := srv
+		log.Info(fmt.Sprintf("serving DNS on %s/%s", srv.Addr, srv.Net))
+		g.Go(srv.ActivateAndServe)
+	}
+
+	return g.Wait()
 }
 
 func (proxy *Proxy) Shutdown() {
 	log.Info("stop listening...")
+	proxy.cancel()
 	ctx, cancel := context.WithTimeout(context.TODO(), time.Duration(5)*time.Second)
 	defer cancel()
-	if err := proxy.srv.ShutdownContext(ctx); err != nil {
-		log.Err(err.Error())
+	for _, srv := range proxy.servers {
+		if err := srv.ShutdownContext(ctx); err != nil {
+			log.Err(err.Error())
+		}
+	}
+	if proxy.doh != nil {
+		if err := proxy.doh.Shutdown(ctx); err != nil {
+			log.Err(err.Error())
+		}
 	}
 	log.Info("waiting workers to finish...")
 	proxy.workers.Wait()
@@ -117,12 +299,23 @@ func (proxy *Proxy) Shutdown() {
 	proxy.rdns.Close()
 }
 
-func (proxy *Proxy) singleFlightRequestHandler(r *dns.Msg) (*dns.Msg, error) {
-	rsp, err, _ := proxy.flightGroup.Do(fmt.Sprintf("%s:%d", r.Question[0].Name, r.Question[0].Qtype), func() (interface{}, error) {
+// singleFlightRequestHandler resolves r once for every client asking the same question at the same time
+// and willing to wait as long, timeout is how long. The lookup is bound to ctx and timeout, not to any single client,
+// since they all share it. UDP and TCP clients don't share flights, a UDP deadline would cut a TCP client short.
+func (proxy *Proxy) singleFlightRequestHandler(ctx context.Context, r *dns.Msg, timeout time.Duration) (*dns.Msg, error) {
+	rsp, err, _ := proxy.flightGroup.Do(flightKey(r, timeout), func() (interface{}, error) {
 		rspChannel := make(chan *dns.Msg, 1)
 		errChannel := make(chan error, 1)
 
+		// only the first client asking leads the flight, the others wait on its span
+		ctx, span := tracing.Start(ctx, "singleflight")
+		defer span.End()
+
+		ctx, cancel := context.WithTimeout(ctx, timeout)
+		defer cancel()
+
 		pReq := &proxyRequest{
+			ctx:        ctx,
 			message:    r,
 			rspChannel: rspChannel,
 			errChannel: errChannel,
@@ -135,6 +328,8 @@ func (proxy *Proxy) singleFlightRequestHandler(r *dns.Msg) (*dns.Msg, error) {
 			return msg, nil
 		case err := <-errChannel:
 			return nil, err
+		case <-ctx.Done():
+			return nil, fmt.Errorf("error handling lookup: %w", ctx.Err())
 		}
 	})
 
@@ -146,14 +341,46 @@ func (proxy *Proxy) singleFlightRequestHandler(r *dns.Msg) (*dns.Msg, error) {
 	return rsp.(*dns.Msg), nil
 }
 
-func logRequest(m *dns.Msg, cacheHit bool, d time.Duration) {
+// flightKey tells which requests share a flight, those asking the same question with the same DNSSEC bits,
+// a client setting CD must not hand its unvalidated answer to one that doesn't, nor one without DO its unsigned answer to one with.
+func flightKey(r *dns.Msg, timeout time.Duration) string {
+	do := false
+	if opt := r.IsEdns0(); opt != nil {
+		do = opt.Do()
+	}
+	return fmt.Sprintf("%s:%d:%d:%t:%t:%s", names.Canonical(r.Question[0].Name), r.Question[0].Qtype, r.Question[0].Qclass, do, r.CheckingDisabled, timeout)
+}
+
+// requestTimeout is how long the client of w is likely still waiting for the answer.
+// UDP stub resolvers give up on a query after a few seconds and send it again, -udp-deadline,
+// TCP and DoH clients wait for the lookup and its fallback, each given -lookup-timeout.
+func (proxy *Proxy) requestTimeout(w dns.ResponseWriter) time.Duration {
+	if _, udp := w.RemoteAddr().(*net.UDPAddr); udp {
+		return proxy.config.UDPDeadline()
+	}
+	return 2 * proxy.rdns.Timeout()
+}
+
+// sampled tells whether this request is logged, none with -q, otherwise one every -log-sample.
+func (proxy *Proxy) sampled() bool {
+	if proxy.config.Quiet() {
+		return false
+	}
+	every := uint64(proxy.config.LogSample())
+	return every <= 1 || proxy.requests.Add(1)%every == 0
+}
+
+func logRequest(client net.Addr, m *dns.Msg, cacheHit bool, d time.Duration) {
 	for _, a := range m.Question {
 		log.Info(fmt.Sprintf(
-			"[%s] (%5d) %5s %s %s",
+			"[%s] (%5d) %s %5s %s %s/%d %s",
 			hitOrMiss(cacheHit),
 			m.MsgHdr.Id,
+			client,
 			dns.TypeToString[a.Qtype],
 			a.Name,
+			dns.RcodeToString[m.Rcode],
+			len(m.Answer),
 			d.String(),
 		))
 	}
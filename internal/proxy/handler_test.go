@@ -0,0 +1,122 @@
+package proxy
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/fudanchii/ssh2dns/internal/config"
+	"github.com/fudanchii/ssh2dns/internal/recdns"
+	"github.com/fudanchii/ssh2dns/internal/upstream"
+	"github.com/miekg/dns"
+)
+
+// fakeWriter keeps the messages written to it, as from a UDP client on loopback.
+type fakeWriter struct {
+	written []*dns.Msg
+}
+
+func (w *fakeWriter) LocalAddr() net.Addr {
+	return &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 53}
+}
+
+func (w *fakeWriter) RemoteAddr() net.Addr {
+	return &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 40000}
+}
+
+func (w *fakeWriter) WriteMsg(m *dns.Msg) error {
+	w.written = append(w.written, m)
+	return nil
+}
+
+func (w *fakeWriter) Write(b []byte) (int, error) {
+	m := new(dns.Msg)
+	if err := m.Unpack(b); err != nil {
+		return 0, err
+	}
+	return len(b), w.WriteMsg(m)
+}
+
+func (w *fakeWriter) Close() error        { return nil }
+func (w *fakeWriter) TsigStatus() error   { return nil }
+func (w *fakeWriter) TsigTimersOnly(bool) {}
+func (w *fakeWriter) Hijack()             {}
+
+// newTestProxy makes no lookups, its pool never connects, it is bound to a free loopback port unless opts say otherwise.
+func newTestProxy(t *testing.T, opts config.Options) *Proxy {
+	t.Helper()
+	if opts == nil {
+		opts = config.Options{}
+	}
+	if _, ok := opts["b"]; !ok {
+		opts["b"] = "127.0.0.1:0"
+	}
+
+	cfg, err := config.NewFromOptions(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lc, err := recdns.New(cfg, upstream.NewOfflinePool())
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy, err := New(cfg, lc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(proxy.Shutdown)
+	return proxy
+}
+
+func TestHandlerQuestionCount(t *testing.T) {
+	proxy := newTestProxy(t, nil)
+
+	twice := new(dns.Msg)
+	twice.SetQuestion("example.com.", dns.TypeA)
+	twice.Question = append(twice.Question, twice.Question[0])
+
+	for name, req := range map[string]*dns.Msg{
+		"no question":    {MsgHdr: dns.MsgHdr{Id: 1, Opcode: dns.OpcodeQuery}},
+		"empty question": {MsgHdr: dns.MsgHdr{Id: 2, Opcode: dns.OpcodeQuery}, Question: []dns.Question{}},
+		"two questions":  twice,
+	} {
+		t.Run(name, func(t *testing.T) {
+			w := &fakeWriter{}
+			proxy.handler(w, req)
+
+			if len(w.written) != 1 {
+				t.Fatalf("wrote %d replies, want 1", len(w.written))
+			}
+			if rsp := w.written[0]; rsp.Rcode != dns.RcodeFormatError || rsp.Id != req.Id {
+				t.Errorf("reply %s id %d, want FORMERR id %d", dns.RcodeToString[rsp.Rcode], rsp.Id, req.Id)
+			}
+		})
+	}
+}
+
+func TestFlightKeyDNSSECBits(t *testing.T) {
+	query := func(do, cd bool) *dns.Msg {
+		m := new(dns.Msg)
+		m.SetQuestion("Example.com.", dns.TypeA)
+		m.CheckingDisabled = cd
+		if do {
+			m.SetEdns0(1232, true)
+		}
+		return m
+	}
+
+	keys := map[string][2]bool{}
+	for _, bits := range [][2]bool{{false, false}, {true, false}, {false, true}, {true, true}} {
+		key := flightKey(query(bits[0], bits[1]), time.Second)
+		if other, dup := keys[key]; dup {
+			t.Errorf("do=%v cd=%v shares a flight with do=%v cd=%v", bits[0], bits[1], other[0], other[1])
+		}
+		keys[key] = bits
+	}
+
+	lower := query(false, false)
+	lower.Question[0].Name = "example.com."
+	if flightKey(lower, time.Second) != flightKey(query(false, false), time.Second) {
+		t.Error("names differing in case only fly apart")
+	}
+}
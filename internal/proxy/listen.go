@@ -0,0 +1,129 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+
+	"github.com/fudanchii/ssh2dns/internal/config"
+	"github.com/fudanchii/ssh2dns/internal/errors"
+	"github.com/miekg/dns"
+)
+
+// bind listens on every address for both UDP and TCP, so an address we can't bind
+// fails startup rather than leaving the proxy half reachable.
+// With -reuseport, the sockets allow other processes to bind the same addresses,
+// the kernel then spreads incoming queries across all of them.
+func bind(cfg *config.AppConfig, handler dns.Handler) ([]*dns.Server, error) {
+	var (
+		servers []*dns.Server
+		lc      net.ListenConfig
+		addrs   = cfg.BindAddrs()
+	)
+
+	if len(addrs) == 0 {
+		return nil, fmt.Errorf("no address to bind to")
+	}
+
+	if cfg.ReusePort() {
+		if err := setReusePort(&lc); err != nil {
+			return nil, err
+		}
+	}
+
+	closeAll := func() { closeServers(servers) }
+
+	for _, addr := range addrs {
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			closeAll()
+			return nil, fmt.Errorf("invalid bind address %s: %w", addr, err)
+		}
+
+		pc, err := lc.ListenPacket(context.TODO(), "udp", addr)
+		if err != nil {
+			closeAll()
+			return nil, bindErr(addr, err)
+		}
+		servers = append(servers, &dns.Server{
+			Addr: addr, Net: "udp", PacketConn: pc, Handler: handler,
+			UDPSize: cfg.UDPSize(), ReadTimeout: cfg.ReadTimeout(),
+		})
+		if err := setBuffers(pc, cfg.UDPReadBuffer(), cfg.UDPWriteBuffer()); err != nil {
+			closeAll()
+			return nil, fmt.Errorf("setting socket buffers on %s: %w", addr, err)
+		}
+
+		l, err := lc.Listen(context.TODO(), "tcp", addr)
+		if err != nil {
+			closeAll()
+			return nil, bindErr(addr, err)
+		}
+		servers = append(servers, &dns.Server{
+			Addr: addr, Net: "tcp", Listener: l, Handler: handler,
+			ReadTimeout: cfg.ReadTimeout(),
+		})
+	}
+
+	return servers, nil
+}
+
+// closeServers closes the sockets of servers that never got to serve.
+func closeServers(servers []*dns.Server) {
+	for _, srv := range servers {
+		if srv.PacketConn != nil {
+			srv.PacketConn.Close()
+		}
+		if srv.Listener != nil {
+			srv.Listener.Close()
+		}
+	}
+}
+
+// bindDoH listens on the -doh address, before privileges are dropped like the plain listeners,
+// and with -reuseport the same way.
+func bindDoH(cfg *config.AppConfig) (net.Listener, error) {
+	var lc net.ListenConfig
+
+	if cfg.ReusePort() {
+		if err := setReusePort(&lc); err != nil {
+			return nil, err
+		}
+	}
+
+	l, err := lc.Listen(context.TODO(), "tcp", cfg.DoHAddr())
+	if err != nil {
+		return nil, bindErr(cfg.DoHAddr(), err)
+	}
+	return l, nil
+}
+
+// setBuffers resizes the socket buffers of pc, a zero size keeps the system default.
+// The kernel may cap them, e.g. at net.core.rmem_max on linux.
+func setBuffers(pc net.PacketConn, rcvbuf, sndbuf int) error {
+	conn, ok := pc.(*net.UDPConn)
+	if !ok {
+		return nil
+	}
+	if rcvbuf > 0 {
+		if err := conn.SetReadBuffer(rcvbuf); err != nil {
+			return err
+		}
+	}
+	if sndbuf > 0 {
+		if err := conn.SetWriteBuffer(sndbuf); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// bindErr explains the usual reason binding a port below 1024 is denied.
+func bindErr(addr string, err error) error {
+	_, port, _ := net.SplitHostPort(addr)
+	if n, perr := strconv.Atoi(port); perr == nil && n < 1024 && errors.Is(err, os.ErrPermission) {
+		return fmt.Errorf("%w, binding port %d needs root, or the CAP_NET_BIND_SERVICE capability on linux, see -user to drop root once bound", err, n)
+	}
+	return err
+}
@@ -0,0 +1,159 @@
+package proxy
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/fudanchii/ssh2dns/internal/config"
+	"github.com/miekg/dns"
+)
+
+func TestServeOverIPv6(t *testing.T) {
+	if l, err := net.Listen("tcp6", "[::1]:0"); err != nil {
+		t.Skipf("no IPv6 loopback: %v", err)
+	} else {
+		l.Close()
+	}
+
+	// local routes are answered without any upstream
+	proxy := newTestProxy(t, config.Options{"b": "[::1]:0", "route": "test=local"})
+	go proxy.ListenAndServe()
+
+	for _, srv := range proxy.servers {
+		var addr net.Addr
+		if srv.PacketConn != nil {
+			addr = srv.PacketConn.LocalAddr()
+		} else {
+			addr = srv.Listener.Addr()
+		}
+
+		t.Run(srv.Net, func(t *testing.T) {
+			if host, _, _ := net.SplitHostPort(addr.String()); net.ParseIP(host).To4() != nil {
+				t.Fatalf("bound to %s, want an IPv6 address", addr)
+			}
+
+			client := dns.Client{Net: srv.Net, Timeout: time.Second}
+			req := new(dns.Msg)
+			req.SetQuestion("host.test.", dns.TypeA)
+
+			// the servers start serving in the background
+			var (
+				rsp *dns.Msg
+				err error
+			)
+			for deadline := time.Now().Add(2 * time.Second); time.Now().Before(deadline); time.Sleep(20 * time.Millisecond) {
+				if rsp, _, err = client.Exchange(req, addr.String()); err == nil {
+					break
+				}
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if rsp.Rcode != dns.RcodeNameError {
+				t.Errorf("rcode = %s, want NXDOMAIN from the local route", dns.RcodeToString[rsp.Rcode])
+			}
+		})
+	}
+}
+
+// writeTestCert writes a self-signed certificate and its key to dir.
+func writeTestCert(t *testing.T, dir string) (certFile, keyFile string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &tmpl, &tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certFile, keyFile = filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile
+}
+
+// The DoH address is bound by New, as the plain listeners are, so that it's bound before -user drops privileges.
+func TestDoHBoundOnNew(t *testing.T) {
+	certFile, keyFile := writeTestCert(t, t.TempDir())
+	proxy := newTestProxy(t, config.Options{"doh": "127.0.0.1:0", "route": "test=local", "doh-cert": certFile, "doh-key": keyFile})
+
+	if proxy.doh.listener == nil {
+		t.Fatal("DoH address not bound by New")
+	}
+
+	// nothing serves yet, the kernel still accepts the connection on the bound socket
+	conn, err := net.DialTimeout("tcp", proxy.doh.listener.Addr().String(), time.Second)
+	if err != nil {
+		t.Fatalf("DoH address not listening before ListenAndServe: %v", err)
+	}
+	conn.Close()
+
+	go proxy.ListenAndServe()
+
+	req := new(dns.Msg)
+	req.SetQuestion("host.test.", dns.TypeA)
+	buf, err := req.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := http.Client{
+		Timeout:   time.Second,
+		Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}},
+	}
+	url := "https://" + proxy.doh.listener.Addr().String() + dohPath
+	rsp, err := client.Post(url, dohContentType, bytes.NewReader(buf))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rsp.Body.Close()
+	if rsp.StatusCode != http.StatusOK {
+		t.Fatalf("status = %s, want 200 served on the listener bound by New", rsp.Status)
+	}
+}
+
+func TestDoHBindFailure(t *testing.T) {
+	taken, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer taken.Close()
+
+	certFile, keyFile := writeTestCert(t, t.TempDir())
+	cfg, err := config.NewFromOptions(config.Options{
+		"b": "127.0.0.1:0", "doh": taken.Addr().String(), "doh-cert": certFile, "doh-key": keyFile,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := New(cfg, nil); err == nil {
+		t.Fatal("New succeeded with the DoH address in use")
+	}
+}
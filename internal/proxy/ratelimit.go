@@ -0,0 +1,80 @@
+package proxy
+
+import (
+	"net/netip"
+	"sync"
+	"time"
+
+	"github.com/fudanchii/ssh2dns/internal/config"
+
+	"golang.org/x/time/rate"
+)
+
+const (
+	limiterIdleTimeout = 5 * time.Minute
+)
+
+// rateLimiter keeps a token bucket per client address,
+// buckets idle for longer than limiterIdleTimeout are dropped.
+type rateLimiter struct {
+	mu        sync.Mutex
+	limiters  map[netip.Addr]*clientLimiter
+	limit     rate.Limit
+	burst     int
+	exempt    []netip.Prefix
+	lastSweep time.Time
+}
+
+type clientLimiter struct {
+	*rate.Limiter
+	lastSeen time.Time
+}
+
+func newRateLimiter(cfg *config.AppConfig) *rateLimiter {
+	if cfg.RateLimit() <= 0 {
+		return nil
+	}
+
+	return &rateLimiter{
+		limiters:  map[netip.Addr]*clientLimiter{},
+		limit:     rate.Limit(cfg.RateLimit()),
+		burst:     cfg.RateBurst(),
+		exempt:    cfg.RateExempt(),
+		lastSweep: time.Now(),
+	}
+}
+
+func (rl *rateLimiter) Allow(addr netip.Addr) bool {
+	if !addr.IsValid() || containsAddr(rl.exempt, addr) {
+		return true
+	}
+
+	now := time.Now()
+
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	rl.sweep(now)
+
+	cl, ok := rl.limiters[addr]
+	if !ok {
+		cl = &clientLimiter{Limiter: rate.NewLimiter(rl.limit, rl.burst)}
+		rl.limiters[addr] = cl
+	}
+	cl.lastSeen = now
+
+	return cl.AllowN(now, 1)
+}
+
+func (rl *rateLimiter) sweep(now time.Time) {
+	if now.Sub(rl.lastSweep) < limiterIdleTimeout {
+		return
+	}
+
+	for addr, cl := range rl.limiters {
+		if now.Sub(cl.lastSeen) > limiterIdleTimeout {
+			delete(rl.limiters, addr)
+		}
+	}
+	rl.lastSweep = now
+}
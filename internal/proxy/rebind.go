@@ -0,0 +1,66 @@
+package proxy
+
+import (
+	"net/netip"
+
+	"github.com/fudanchii/ssh2dns/internal/config"
+	"github.com/fudanchii/ssh2dns/internal/log"
+	"github.com/miekg/dns"
+	"github.com/samber/lo"
+)
+
+// cgnat is the shared address space of RFC 6598, private in all but name.
+var cgnat = netip.MustParsePrefix("100.64.0.0/10")
+
+// internalAddr reports whether addr points inside the local network or host,
+// what a rebinding attack would get a public name to resolve to.
+func internalAddr(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	return addr.IsPrivate() || addr.IsLoopback() || addr.IsLinkLocalUnicast() ||
+		addr.IsUnspecified() || cgnat.Contains(addr)
+}
+
+// internalZone reports whether name is one of the -rebind-allow zones or below one.
+func internalZone(cfg *config.AppConfig, name string) bool {
+	for _, zone := range cfg.RebindAllowed() {
+		if dns.IsSubDomain(zone, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// stripRebinding removes the A and AAAA answers pointing to internal addresses,
+// unless the question is for an internal zone. It tells whether any was removed.
+func stripRebinding(cfg *config.AppConfig, r *dns.Msg, rsp *dns.Msg) bool {
+	qname := r.Question[0].Name
+	if internalZone(cfg, qname) {
+		return false
+	}
+
+	kept := lo.Filter(rsp.Answer, func(rr dns.RR, _ int) bool {
+		var ip []byte
+		switch rr := rr.(type) {
+		case *dns.A:
+			ip = rr.A
+		case *dns.AAAA:
+			ip = rr.AAAA
+		default:
+			return true
+		}
+		addr, ok := netip.AddrFromSlice(ip)
+		return !ok || !internalAddr(addr)
+	})
+
+	if len(kept) == len(rsp.Answer) {
+		return false
+	}
+
+	log.Err("dropped internal addresses answered for " + qname + ", possible DNS rebinding")
+	rsp.Answer = kept
+	return true
+}
+
+func hasType(rrs []dns.RR, qtype uint16) bool {
+	return lo.SomeBy(rrs, func(rr dns.RR) bool { return rr.Header().Rrtype == qtype })
+}
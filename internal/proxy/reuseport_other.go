@@ -0,0 +1,13 @@
+//go:build !(linux || darwin || dragonfly || freebsd || netbsd || openbsd)
+
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"runtime"
+)
+
+func setReusePort(lc *net.ListenConfig) error {
+	return fmt.Errorf("-reuseport is not supported on %s", runtime.GOOS)
+}
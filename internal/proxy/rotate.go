@@ -0,0 +1,36 @@
+package proxy
+
+import (
+	"github.com/fudanchii/ssh2dns/internal/names"
+
+	"github.com/miekg/dns"
+)
+
+// rotateAnswers returns a copy of answer where every run of records sharing owner and type
+// is rotated left by n, so each reply leads with a different address, like BIND's cyclic rrset-order.
+// The given slice is left untouched, it may be shared with the cache.
+func rotateAnswers(answer []dns.RR, n uint32) []dns.RR {
+	rotated := make([]dns.RR, 0, len(answer))
+
+	for start := 0; start < len(answer); {
+		end := start + 1
+		for end < len(answer) && sameRRset(answer[start], answer[end]) {
+			end++
+		}
+
+		rrset := answer[start:end]
+		shift := int(n % uint32(len(rrset)))
+		rotated = append(rotated, rrset[shift:]...)
+		rotated = append(rotated, rrset[:shift]...)
+
+		start = end
+	}
+
+	return rotated
+}
+
+func sameRRset(a, b dns.RR) bool {
+	return a.Header().Rrtype == b.Header().Rrtype &&
+		a.Header().Class == b.Header().Class &&
+		names.Equal(a.Header().Name, b.Header().Name)
+}
@@ -0,0 +1,78 @@
+package recdns
+
+import (
+	"github.com/fudanchii/ssh2dns/internal/names"
+	"github.com/miekg/dns"
+	"github.com/samber/lo"
+)
+
+// inBailiwick reports whether name is zone itself or a name below it.
+func inBailiwick(name, zone string) bool {
+	return dns.IsSubDomain(zone, name)
+}
+
+// scrubResponse drops records the server authoritative for zone has no say over,
+// so a rogue server cannot get unrelated names cached or followed.
+// Answers must belong to qname or to the CNAME chain starting from it,
+// delegations must lead towards qname, and additional records must be within zone.
+func scrubResponse(rsp *dns.Msg, qname, zone string) {
+	rsp.Answer = answerChain(rsp.Answer, qname, zone)
+
+	rsp.Ns = lo.Filter(rsp.Ns, func(rr dns.RR, _ int) bool {
+		owner := rr.Header().Name
+		switch rr.Header().Rrtype {
+		case dns.TypeNS, dns.TypeSOA:
+			return inBailiwick(owner, zone) && inBailiwick(qname, owner)
+		}
+		return inBailiwick(owner, zone)
+	})
+
+	rsp.Extra = lo.Filter(rsp.Extra, func(rr dns.RR, _ int) bool {
+		return rr.Header().Rrtype == dns.TypeOPT || inBailiwick(rr.Header().Name, zone)
+	})
+}
+
+// answerChain keeps the answer records owned by qname, or by a target
+// of the CNAME chain starting from qname, preserving their order.
+func answerChain(answer []dns.RR, qname, zone string) []dns.RR {
+	chain := map[string]bool{names.Canonical(qname): true}
+	kept := make([]bool, len(answer))
+
+	// records may come in any order, walk until the chain stops growing
+	for grown := true; grown; {
+		grown = false
+		for i, rr := range answer {
+			owner := rr.Header().Name
+			if kept[i] || !inBailiwick(owner, zone) {
+				continue
+			}
+
+			switch rr := rr.(type) {
+			case *dns.DNAME:
+				kept[i] = coversAny(owner, chain)
+			case *dns.CNAME:
+				if kept[i] = chain[names.Canonical(owner)]; kept[i] {
+					chain[names.Canonical(rr.Target)] = true
+				}
+			default:
+				kept[i] = chain[names.Canonical(owner)]
+			}
+
+			grown = grown || kept[i]
+		}
+	}
+
+	return lo.Filter(answer, func(_ dns.RR, i int) bool {
+		return kept[i]
+	})
+}
+
+// coversAny reports whether a DNAME owned by owner redirects any of names.
+func coversAny(owner string, chain map[string]bool) bool {
+	for name := range chain {
+		if !names.Equal(name, owner) && dns.IsSubDomain(owner, name) {
+			return true
+		}
+	}
+	return false
+}
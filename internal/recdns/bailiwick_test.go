@@ -0,0 +1,107 @@
+package recdns
+
+import (
+	"context"
+	"slices"
+	"testing"
+
+	"github.com/fudanchii/ssh2dns/internal/config"
+	"github.com/miekg/dns"
+)
+
+func TestScrubResponse(t *testing.T) {
+	rsp := new(dns.Msg)
+	rsp.Answer = rrs(t,
+		"www.example.test. 300 IN CNAME web.example.test.",
+		"web.example.test. 300 IN A 192.0.2.80",
+		"bank.example. 300 IN A 192.0.2.66",
+		"other.example.test. 300 IN A 192.0.2.67",
+	)
+	rsp.Ns = rrs(t,
+		"example.test. 300 IN NS ns.example.test.",
+		"example.test. 300 IN NS ns.evil.",
+		"bank.example. 300 IN NS ns.evil.",
+		"test. 300 IN NS ns.evil.",
+	)
+	rsp.Extra = rrs(t,
+		"ns.example.test. 300 IN A 192.0.2.53",
+		"ns.evil. 300 IN A 192.0.2.66",
+		"ns.bank.example. 300 IN A 192.0.2.66",
+	)
+	rsp.SetEdns0(1232, false)
+
+	scrubResponse(rsp, "www.example.test.", "example.test.")
+
+	want := func(section string, got []dns.RR, names ...string) {
+		t.Helper()
+		if len(got) != len(names) {
+			t.Errorf("%s = %v, want only %v", section, got, names)
+			return
+		}
+		for i, rr := range got {
+			if rr.Header().Name != names[i] {
+				t.Errorf("%s = %v, want only %v", section, got, names)
+				return
+			}
+		}
+	}
+	want("answer", rsp.Answer, "www.example.test.", "web.example.test.")
+	// an NS record of the zone may name any server, it is the owner that must be in bailiwick
+	want("authority", rsp.Ns, "example.test.", "example.test.")
+	want("additional", rsp.Extra, "ns.example.test.", ".")
+}
+
+func TestUseNextNSIgnoresOutOfBailiwickGlue(t *testing.T) {
+	client := &fakeClient{answer: func(req *dns.Msg, srv string) (*dns.Msg, error) {
+		rsp := new(dns.Msg)
+		rsp.SetReply(req)
+		rsp.Authoritative = true
+		switch q := req.Question[0]; {
+		case srv == "192.0.2.67:53" && q.Name == "www.example.test.":
+			rsp.Answer = rrs(t, "www.example.test. 300 IN A 192.0.2.80")
+		case srv == "192.0.2.66:53":
+			rsp.Answer = rrs(t, q.Name+" 300 IN A 192.0.2.66")
+		case q.Name == "ns.example.net." && q.Qtype == dns.TypeA:
+			// the roots, standing in for the whole net. tree
+			rsp.Answer = rrs(t, "ns.example.net. 300 IN A 192.0.2.67")
+		default:
+			rsp.Rcode = dns.RcodeNameError
+		}
+		return rsp, nil
+	}}
+
+	for _, parallel := range []string{"1", "3"} {
+		t.Run("ns-parallel "+parallel, func(t *testing.T) {
+			cfg, err := config.NewFromOptions(config.Options{"r": "true", "ns-parallel": parallel})
+			if err != nil {
+				t.Fatal(err)
+			}
+			lc, err := NewWithRootHints(cfg, fakePool{client}, fakeRootHints)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// a referral from test. naming a server of net. along with an address for it
+			referral := new(dns.Msg)
+			referral.Ns = rrs(t, "example.test. 300 IN NS ns.example.net.")
+			referral.Extra = rrs(t, "ns.example.net. 300 IN A 192.0.2.66")
+
+			req := new(dns.Msg)
+			req.SetQuestion("www.example.test.", dns.TypeA)
+			rsp, err := lc.useNextNS(context.Background(), req, referral, "test.")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(rsp.Answer) != 1 || rsp.Answer[0].(*dns.A).A.String() != "192.0.2.80" {
+				t.Errorf("answer = %v, want www.example.test. A 192.0.2.80", rsp.Answer)
+			}
+
+			client.mu.Lock()
+			defer client.mu.Unlock()
+			if slices.Contains(client.queried, "192.0.2.66:53") {
+				t.Errorf("followed out-of-bailiwick glue, queried %v", client.queried)
+			}
+			client.queried = nil
+		})
+	}
+}
@@ -0,0 +1,79 @@
+package recdns
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// breaker skips upstream servers which keep failing, for a cooldown period,
+// so lookups don't waste their deadline on servers known to be dead.
+// It is shared by all lookups, a nil breaker allows everything.
+type breaker struct {
+	mu        sync.Mutex
+	servers   map[string]*serverHealth
+	threshold int
+	cooldown  time.Duration
+}
+
+type serverHealth struct {
+	failures  int
+	openUntil time.Time
+}
+
+func newBreaker(threshold int, cooldown time.Duration) *breaker {
+	if threshold <= 0 {
+		return nil
+	}
+
+	return &breaker{
+		servers:   map[string]*serverHealth{},
+		threshold: threshold,
+		cooldown:  cooldown,
+	}
+}
+
+// Allow reports whether srv may be queried. Once the cooldown passes, srv gets another try,
+// a failure on that try opens the breaker again right away.
+func (b *breaker) Allow(srv net.IP) bool {
+	if b == nil {
+		return true
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	health, ok := b.servers[srv.String()]
+	return !ok || time.Now().After(health.openUntil)
+}
+
+func (b *breaker) Success(srv net.IP) {
+	if b == nil {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	delete(b.servers, srv.String())
+}
+
+func (b *breaker) Failure(srv net.IP) {
+	if b == nil {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	health, ok := b.servers[srv.String()]
+	if !ok {
+		health = &serverHealth{}
+		b.servers[srv.String()] = health
+	}
+
+	health.failures++
+	if health.failures >= b.threshold {
+		health.openUntil = time.Now().Add(b.cooldown)
+	}
+}
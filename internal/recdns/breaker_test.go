@@ -0,0 +1,130 @@
+package recdns
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/fudanchii/ssh2dns/internal/config"
+	"github.com/fudanchii/ssh2dns/internal/errors"
+	"github.com/miekg/dns"
+)
+
+func TestBreakerTripsOnServerFaultsOnly(t *testing.T) {
+	servfail := func(req *dns.Msg, _ string) (*dns.Msg, error) {
+		rsp := new(dns.Msg)
+		rsp.SetRcode(req, dns.RcodeServerFailure)
+		return rsp, nil
+	}
+	failing := func(err error) func(*dns.Msg, string) (*dns.Msg, error) {
+		return func(*dns.Msg, string) (*dns.Msg, error) { return nil, err }
+	}
+
+	tests := []struct {
+		name     string
+		answer   func(*dns.Msg, string) (*dns.Msg, error)
+		wantOpen bool
+	}{
+		{"servfail", servfail, true},
+		{"exchange timeout", failing(errors.DNSReadErr{Cause: errors.ConnectionTimeout{}}), true},
+		{"ssh server cannot connect", failing(errors.DNSDialErr{Cause: errors.ServerUnreachable{Addr: "192.0.2.53:53", Reason: "Connection refused"}}), true},
+		{"dial timing out", failing(errors.DNSDialErr{Cause: errors.ConnectionTimeout{}}), true},
+		{"ssh connection closed", failing(errors.DNSDialErr{Cause: io.EOF}), false},
+		{"forwarding prohibited", failing(errors.DNSDialErr{Cause: fmt.Errorf("ssh: rejected: administratively prohibited")}), false},
+		{"sessions busy", failing(errors.DNSDialErr{Cause: errors.SessionsBusy{}}), false},
+		{"pool exhausted", failing(errors.PoolExhausted{}), false},
+		{"tunnel reconnecting", failing(errors.PoolReconnecting{}), false},
+	}
+
+	srv := net.ParseIP("192.0.2.53")
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, err := config.NewFromOptions(config.Options{"r": "true", "breaker-threshold": "2", "retries": "0"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			lc, err := NewWithRootHints(cfg, fakePool{&fakeClient{answer: tt.answer}}, fakeRootHints)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			req := new(dns.Msg)
+			req.SetQuestion("example.com.", dns.TypeA)
+			for i := 0; i < 3; i++ {
+				if _, err := lc.handleRecursive(context.Background(), req, srv, "com."); err == nil {
+					t.Fatal("exchange succeeded")
+				}
+			}
+
+			if open := !lc.breaker.Allow(srv); open != tt.wantOpen {
+				t.Errorf("breaker open = %v, want %v", open, tt.wantOpen)
+			}
+		})
+	}
+}
+
+func TestBreakerClosesOnAnswer(t *testing.T) {
+	fail := true
+	client := &fakeClient{answer: func(req *dns.Msg, _ string) (*dns.Msg, error) {
+		rsp := new(dns.Msg)
+		rsp.SetReply(req)
+		if fail {
+			rsp.Rcode = dns.RcodeServerFailure
+		} else {
+			rsp.Authoritative = true
+			rsp.Answer = rrs(t, "example.com. 300 IN A 192.0.2.80")
+		}
+		return rsp, nil
+	}}
+
+	cfg, err := config.NewFromOptions(config.Options{"r": "true", "breaker-threshold": "2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	lc, err := NewWithRootHints(cfg, fakePool{client}, fakeRootHints)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv := net.ParseIP("192.0.2.53")
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+
+	// a failure, then an answer, then a failure again never adds up to the threshold
+	for _, f := range []bool{true, false, true} {
+		fail = f
+		lc.handleRecursive(context.Background(), req.Copy(), srv, "com.")
+	}
+	if !lc.breaker.Allow(srv) {
+		t.Error("breaker opened on failures an answer came between")
+	}
+}
+
+func TestUnreachableFamilyLosesPreference(t *testing.T) {
+	unreachable := func(_ *dns.Msg, srv string) (*dns.Msg, error) {
+		return nil, errors.DNSDialErr{Cause: errors.ServerUnreachable{Addr: srv, Reason: "Network is unreachable"}}
+	}
+
+	cfg, err := config.NewFromOptions(config.Options{"r": "true", "prefer": "auto", "retries": "0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	lc, err := NewWithRootHints(cfg, fakePool{&fakeClient{answer: unreachable}}, fakeRootHints)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+	lc.families.Success(net.ParseIP("192.0.2.53"))
+	lc.handleRecursive(context.Background(), req, net.ParseIP("2001:db8::53"), "com.")
+
+	if lc.families.v6First() {
+		t.Error("IPv6 still preferred after the ssh server could not reach an IPv6 name server")
+	}
+	if lc.families.v6.Load() >= 0 {
+		t.Errorf("IPv6 score = %d, want it lowered", lc.families.v6.Load())
+	}
+}
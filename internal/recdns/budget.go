@@ -0,0 +1,38 @@
+package recdns
+
+import (
+	"context"
+	"sync/atomic"
+
+	"github.com/fudanchii/ssh2dns/internal/errors"
+)
+
+// queryBudget caps the upstream queries a single lookup may send,
+// shared by every referral and CNAME chase made on its behalf.
+// Retries of the same query to the same server are not counted again.
+type queryBudget struct {
+	max  int64
+	sent atomic.Int64
+}
+
+type queryBudgetKey struct{}
+
+// withQueryBudget gives ctx a budget of max queries, 0 leaves lookups under ctx unbounded.
+func withQueryBudget(ctx context.Context, max int) context.Context {
+	if max <= 0 {
+		return ctx
+	}
+	return context.WithValue(ctx, queryBudgetKey{}, &queryBudget{max: int64(max)})
+}
+
+// spendQuery takes one query from the budget in ctx, if any.
+func spendQuery(ctx context.Context) error {
+	budget, ok := ctx.Value(queryBudgetKey{}).(*queryBudget)
+	if !ok {
+		return nil
+	}
+	if budget.sent.Add(1) > budget.max {
+		return errors.QueryBudgetExceeded{Max: int(budget.max)}
+	}
+	return nil
+}
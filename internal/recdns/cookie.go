@@ -0,0 +1,113 @@
+package recdns
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"net"
+	"sync"
+
+	"github.com/fudanchii/ssh2dns/internal/errors"
+	"github.com/miekg/dns"
+	"github.com/samber/lo"
+)
+
+const (
+	// clientCookieLen is the fixed client cookie size, server cookies take 8 to 32 bytes more, per RFC 7873 section 4.
+	clientCookieLen    = 8
+	minServerCookieLen = 8
+	maxServerCookieLen = 32
+
+	// cookieUDPSize is the EDNS0 buffer size advertised when a query only needs OPT to carry the cookie.
+	cookieUDPSize = 1232
+)
+
+// cookieJar keeps the DNS cookies of RFC 7873, sent with every upstream query.
+// Client cookies are derived from a secret made at startup and the server address,
+// so each server sees its own. Server cookies are remembered from the last reply of each server.
+// A nil jar sends no cookies.
+type cookieJar struct {
+	secret []byte
+
+	mu      sync.Mutex
+	servers map[string][]byte
+}
+
+func newCookieJar(enabled bool) *cookieJar {
+	if !enabled {
+		return nil
+	}
+
+	secret := make([]byte, 16)
+	if _, err := rand.Read(secret); err != nil {
+		return nil
+	}
+
+	return &cookieJar{secret: secret, servers: map[string][]byte{}}
+}
+
+func (j *cookieJar) clientCookie(srv net.IP) []byte {
+	mac := hmac.New(sha256.New, j.secret)
+	mac.Write(srv.To16())
+	return mac.Sum(nil)[:clientCookieLen]
+}
+
+// attach returns a copy of msg carrying our cookie for srv, along with its server cookie when we have one.
+func (j *cookieJar) attach(msg *dns.Msg, srv net.IP) *dns.Msg {
+	if j == nil {
+		return msg
+	}
+
+	cookie := j.clientCookie(srv)
+	j.mu.Lock()
+	cookie = append(cookie, j.servers[srv.String()]...)
+	j.mu.Unlock()
+
+	msg = msg.Copy()
+	opt := msg.IsEdns0()
+	if opt == nil {
+		msg.SetEdns0(cookieUDPSize, false)
+		opt = msg.IsEdns0()
+	}
+	opt.Option = lo.Filter(opt.Option, func(o dns.EDNS0, _ int) bool {
+		return o.Option() != dns.EDNS0COOKIE
+	})
+	opt.Option = append(opt.Option, &dns.EDNS0_COOKIE{Code: dns.EDNS0COOKIE, Cookie: hex.EncodeToString(cookie)})
+
+	return msg
+}
+
+// check validates the cookie in the reply of srv, remembering its server cookie.
+// Servers not supporting cookies reply without any, that is accepted as is.
+func (j *cookieJar) check(rsp *dns.Msg, srv net.IP) error {
+	if j == nil || rsp == nil {
+		return nil
+	}
+
+	opt := rsp.IsEdns0()
+	if opt == nil {
+		return nil
+	}
+
+	for _, o := range opt.Option {
+		c, ok := o.(*dns.EDNS0_COOKIE)
+		if !ok {
+			continue
+		}
+
+		cookie, err := hex.DecodeString(c.Cookie)
+		if err != nil || len(cookie) < clientCookieLen || !bytes.Equal(cookie[:clientCookieLen], j.clientCookie(srv)) {
+			return errors.CookieMismatch{Server: srv}
+		}
+
+		if server := cookie[clientCookieLen:]; len(server) >= minServerCookieLen && len(server) <= maxServerCookieLen {
+			j.mu.Lock()
+			j.servers[srv.String()] = bytes.Clone(server)
+			j.mu.Unlock()
+		}
+	}
+
+	return nil
+}
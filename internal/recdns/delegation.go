@@ -0,0 +1,93 @@
+package recdns
+
+import (
+	"context"
+
+	"github.com/fudanchii/ssh2dns/internal/names"
+	"github.com/miekg/dns"
+	"github.com/samber/lo"
+)
+
+// cutTrail lists the cached delegations a lookup is already going through,
+// so resolving the address of a name server without glue can't come back to them.
+type cutTrail struct {
+	zone string
+	prev *cutTrail
+}
+
+type cutTrailKey struct{}
+
+func (t *cutTrail) has(zone string) bool {
+	for ; t != nil; t = t.prev {
+		if names.Equal(t.zone, zone) {
+			return true
+		}
+	}
+	return false
+}
+
+// cacheDelegation keeps the NS records of the child zone response refers to,
+// and the glue zone is authoritative for, so later lookups below it skip the servers above.
+func (lc *LookupCoordinator) cacheDelegation(response *dns.Msg, zone string) {
+	if len(response.Answer) > 0 || negative(response) {
+		return
+	}
+
+	ns := lo.Filter(response.Ns, func(rr dns.RR, _ int) bool {
+		return rr.Header().Rrtype == dns.TypeNS
+	})
+	if len(ns) == 0 {
+		return
+	}
+	cut := ns[0].Header().Name
+
+	// the same glue useNextNS would trust coming from zone
+	glue := lo.Filter(response.Extra, func(rr dns.RR, _ int) bool {
+		if !isAddr(rr) {
+			return false
+		}
+		return lo.SomeBy(ns, func(n dns.RR) bool {
+			target := n.(*dns.NS).Ns
+			return names.Equal(rr.Header().Name, target) && inBailiwick(target, zone)
+		})
+	})
+
+	lc.cache.SetDelegation(cut, ns, glue)
+}
+
+// closestDelegation returns the cached referral for the deepest zone cut above qname,
+// skipping those the lookup already goes through.
+func (lc *LookupCoordinator) closestDelegation(ctx context.Context, qname string) (string, *dns.Msg, bool) {
+	trail, _ := ctx.Value(cutTrailKey{}).(*cutTrail)
+
+	for off, end := 0, false; !end; off, end = dns.NextLabel(qname, off) {
+		zone := qname[off:]
+		if trail.has(zone) {
+			continue
+		}
+		if referral, ok := lc.cache.Delegation(zone); ok {
+			return zone, referral, true
+		}
+	}
+
+	return "", nil, false
+}
+
+// tryHandleFromDelegation resolves msg starting from the closest cached delegation,
+// it fails when there is none, or none of its name servers settled the question.
+func (lc *LookupCoordinator) tryHandleFromDelegation(ctx context.Context, msg *dns.Msg) (*dns.Msg, bool, error) {
+	zone, referral, ok := lc.closestDelegation(ctx, msg.Question[0].Name)
+	if !ok {
+		return nil, false, nil
+	}
+
+	trail, _ := ctx.Value(cutTrailKey{}).(*cutTrail)
+	ctx = context.WithValue(ctx, cutTrailKey{}, &cutTrail{zone: zone, prev: trail})
+
+	// the glue was checked against the parent zone when cached, "." keeps it all trusted
+	rsp, err := lc.useNextNS(ctx, msg, referral, ".")
+	if err != nil || !answered(rsp) {
+		return nil, true, err
+	}
+	return rsp, true, nil
+}
@@ -0,0 +1,65 @@
+package recdns
+
+import (
+	"context"
+	"net"
+	"strings"
+
+	"github.com/fudanchii/ssh2dns/internal/config"
+	"github.com/miekg/dns"
+)
+
+const (
+	resolvConf = "/etc/resolv.conf"
+)
+
+// directResolver sends queries straight to a plain DNS server, bypassing the ssh tunnel.
+type directResolver struct {
+	client    *dns.Client
+	tcpClient *dns.Client
+	servers   []string
+}
+
+func newDirectResolver(cfg *config.AppConfig) (*directResolver, error) {
+	servers := []string{}
+
+	if cfg.FallbackDNS() != "" {
+		srv := cfg.FallbackDNS()
+		if _, _, err := net.SplitHostPort(srv); err != nil {
+			srv = net.JoinHostPort(strings.Trim(srv, "[]"), "53")
+		}
+		servers = append(servers, srv)
+	} else {
+		cc, err := dns.ClientConfigFromFile(resolvConf)
+		if err != nil {
+			return nil, err
+		}
+		for _, srv := range cc.Servers {
+			servers = append(servers, net.JoinHostPort(srv, cc.Port))
+		}
+	}
+
+	return &directResolver{
+		client:    &dns.Client{Timeout: cfg.LookupTimeout()},
+		tcpClient: &dns.Client{Net: "tcp", Timeout: cfg.LookupTimeout()},
+		servers:   servers,
+	}, nil
+}
+
+func (dr *directResolver) Exchange(ctx context.Context, msg *dns.Msg) (*dns.Msg, error) {
+	var err error
+
+	for _, srv := range dr.servers {
+		rsp, _, xerr := dr.client.ExchangeContext(ctx, msg, srv)
+		if xerr == nil && rsp.Truncated {
+			// the answer didn't fit in UDP, take it whole over TCP
+			rsp, _, xerr = dr.tcpClient.ExchangeContext(ctx, msg, srv)
+		}
+		if xerr == nil {
+			return rsp, nil
+		}
+		err = xerr
+	}
+
+	return nil, err
+}
@@ -0,0 +1,85 @@
+package recdns
+
+import (
+	"context"
+
+	"github.com/fudanchii/ssh2dns/internal/errors"
+	"github.com/fudanchii/ssh2dns/internal/names"
+	"github.com/miekg/dns"
+)
+
+// synthesizeCNAME returns the CNAME implied by a DNAME covering qname, per RFC 6672.
+// It is nil when the answer already carries a CNAME for qname,
+// or no DNAME in the answer covers it.
+func synthesizeCNAME(answer []dns.RR, qname string) (*dns.CNAME, error) {
+	if cnameFor(answer, qname) != nil {
+		return nil, nil
+	}
+
+	for _, rr := range answer {
+		dname, ok := rr.(*dns.DNAME)
+		if !ok {
+			continue
+		}
+
+		owner := dname.Hdr.Name
+		// DNAME redirects the names below its owner, never the owner itself
+		if names.Equal(owner, qname) || !dns.IsSubDomain(owner, qname) {
+			continue
+		}
+
+		target := qname[:len(qname)-len(owner)] + dns.Fqdn(dname.Target)
+		if _, ok := dns.IsDomainName(target); !ok || len(target) > 255 {
+			return nil, errors.DNAMEOverflow{N: qname, Target: dname.Target}
+		}
+
+		return &dns.CNAME{
+			Hdr: dns.RR_Header{
+				Name:   qname,
+				Rrtype: dns.TypeCNAME,
+				Class:  dname.Hdr.Class,
+				Ttl:    dname.Hdr.Ttl,
+			},
+			Target: target,
+		}, nil
+	}
+
+	return nil, nil
+}
+
+// cnameFor returns the CNAME record owned by name, if any.
+func cnameFor(answer []dns.RR, name string) *dns.CNAME {
+	for _, rr := range answer {
+		if cname, ok := rr.(*dns.CNAME); ok && names.Equal(cname.Hdr.Name, name) {
+			return cname
+		}
+	}
+	return nil
+}
+
+// maxCNAMEChain bounds how many aliases a lookup follows, across answers and re-queries alike.
+const maxCNAMEChain = 8
+
+type cnameDepthKey struct{}
+
+// chainTail follows the CNAMEs in answer starting at qname,
+// returning the last name of the chain along with how many links were followed.
+func chainTail(ctx context.Context, answer []dns.RR, qname string) (string, int, error) {
+	depth, _ := ctx.Value(cnameDepthKey{}).(int)
+	tail := qname
+
+	for cname := cnameFor(answer, tail); cname != nil; cname = cnameFor(answer, tail) {
+		depth++
+		if depth > maxCNAMEChain {
+			return "", depth, errors.CNAMEChainTooLong{N: qname, Max: maxCNAMEChain}
+		}
+		tail = cname.Target
+	}
+
+	return tail, depth, nil
+}
+
+func isCNAMELoop(err error) bool {
+	var tooLong errors.CNAMEChainTooLong
+	return errors.As(err, &tooLong)
+}
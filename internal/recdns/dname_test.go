@@ -0,0 +1,61 @@
+package recdns_test
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/fudanchii/ssh2dns/internal/config"
+	"github.com/fudanchii/ssh2dns/internal/recdnstest"
+	"github.com/miekg/dns"
+)
+
+func TestDNAMERecursion(t *testing.T) {
+	h := recdnstest.NewHierarchy()
+	addZone(t, h, ".", rootIPs, `
+old.	NS	ns.old.
+ns.old.	A	192.0.2.30
+new.	NS	ns.new.
+ns.new.	A	192.0.2.31
+`)
+	addZone(t, h, "old.", []net.IP{net.ParseIP("192.0.2.30")}, `
+example	DNAME	example.new.
+`)
+	addZone(t, h, "new.", []net.IP{net.ParseIP("192.0.2.31")}, `
+www.example	A	192.0.2.80
+`)
+	startHierarchy(t, h)
+
+	lc := newCoordinator(t, h, config.Options{"r": "true", "no-fallback": "true"})
+
+	rsp, err := lc.Handle(context.Background(), question("www.example.old.", dns.TypeA))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var (
+		dname *dns.DNAME
+		cname *dns.CNAME
+		a     *dns.A
+	)
+	for _, rr := range rsp.Answer {
+		switch rr := rr.(type) {
+		case *dns.DNAME:
+			dname = rr
+		case *dns.CNAME:
+			cname = rr
+		case *dns.A:
+			a = rr
+		}
+	}
+
+	if dname == nil || dname.Hdr.Name != "example.old." || dname.Target != "example.new." {
+		t.Errorf("DNAME = %v, want example.old. DNAME example.new.", dname)
+	}
+	if cname == nil || cname.Hdr.Name != "www.example.old." || cname.Target != "www.example.new." {
+		t.Errorf("synthesized CNAME = %v, want www.example.old. CNAME www.example.new.", cname)
+	}
+	if a == nil || a.Hdr.Name != "www.example.new." || a.A.String() != "192.0.2.80" {
+		t.Errorf("final answer = %v, want www.example.new. A 192.0.2.80", a)
+	}
+}
@@ -24,3 +24,13 @@ type PoolItemWrapper[T any] interface {
 	Value() T
 	Release()
 }
+
+// discard gives item back to its pool for good when the pool supports it, e.g. puddle's Destroy,
+// so the next Acquire gets a new connection instead of the same one. Otherwise it is only released.
+func discard[T any](item PoolItemWrapper[T]) {
+	if d, ok := item.(interface{ Destroy() }); ok {
+		d.Destroy()
+		return
+	}
+	item.Release()
+}
@@ -0,0 +1,62 @@
+package recdns
+
+import (
+	"context"
+	"sync"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func rrs(t *testing.T, records ...string) []dns.RR {
+	t.Helper()
+	var out []dns.RR
+	for _, s := range records {
+		rr, err := dns.NewRR(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		out = append(out, rr)
+	}
+	return out
+}
+
+// fakeClient answers with answer(req, srv), recording the servers asked.
+type fakeClient struct {
+	answer func(req *dns.Msg, srv string) (*dns.Msg, error)
+
+	mu      sync.Mutex
+	queried []string
+}
+
+func (c *fakeClient) ExchangeWithContext(_ context.Context, req *dns.Msg, srv string) (*dns.Msg, error) {
+	c.mu.Lock()
+	c.queried = append(c.queried, srv)
+	c.mu.Unlock()
+	return c.answer(req, srv)
+}
+
+func (c *fakeClient) Close() error { return nil }
+
+// fakePool hands out its client to every lookup.
+type fakePool struct{ c *fakeClient }
+
+func (p fakePool) Acquire(context.Context) (PoolItemWrapper[DNSClient], error) {
+	return fakeItem(p), nil
+}
+
+func (p fakePool) Close() {}
+
+type fakeItem struct{ c *fakeClient }
+
+func (i fakeItem) Value() DNSClient { return i.c }
+func (i fakeItem) Release()         {}
+
+const fakeRootHints = `
+.	3600000	NS	a.root-servers.test.
+a.root-servers.test.	3600000	A	192.0.2.1
+.	3600000	NS	b.root-servers.test.
+b.root-servers.test.	3600000	A	192.0.2.2
+.	3600000	NS	c.root-servers.test.
+c.root-servers.test.	3600000	A	192.0.2.3
+`
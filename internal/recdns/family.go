@@ -0,0 +1,104 @@
+package recdns
+
+import (
+	"net"
+	"slices"
+	"sync/atomic"
+
+	"github.com/fudanchii/ssh2dns/internal/config"
+	"github.com/miekg/dns"
+)
+
+// familyScore bounds how far exchanges push the preference of -prefer auto,
+// so a family failing for a while is tried first again soon after it recovers.
+const familyScore = 16
+
+// families orders name server addresses by family, fixed by -prefer v4 or v6,
+// or learned from how exchanges to each family went lately with auto.
+type families struct {
+	prefer string
+	v4, v6 atomic.Int32
+}
+
+func newFamilies(prefer string) *families {
+	return &families{prefer: prefer}
+}
+
+func (f *families) score(ip net.IP) *atomic.Int32 {
+	if ip.To4() != nil {
+		return &f.v4
+	}
+	return &f.v6
+}
+
+// Success and Failure record how an exchange with ip went, a failure weighs more
+// as a timing out family costs a whole hop timeout each time.
+func (f *families) Success(ip net.IP) {
+	f.adjust(ip, 1)
+}
+
+func (f *families) Failure(ip net.IP) {
+	f.adjust(ip, -4)
+}
+
+func (f *families) adjust(ip net.IP, delta int32) {
+	score := f.score(ip)
+	for {
+		old := score.Load()
+		next := min(max(old+delta, -familyScore), familyScore)
+		if score.CompareAndSwap(old, next) {
+			return
+		}
+	}
+}
+
+// v6First tells whether IPv6 addresses are to be tried before IPv4 ones.
+func (f *families) v6First() bool {
+	switch f.prefer {
+	case config.PreferIPv6:
+		return true
+	case config.PreferAuto:
+		return f.v6.Load() > f.v4.Load()
+	}
+	return false
+}
+
+// order sorts ips with the preferred family first, keeping the order within each family.
+func (f *families) order(ips []net.IP) []net.IP {
+	v6First := f.v6First()
+	slices.SortStableFunc(ips, func(a, b net.IP) int {
+		return f.rank(a, v6First) - f.rank(b, v6First)
+	})
+	return ips
+}
+
+// orderServers is order for name servers.
+func (f *families) orderServers(servers []nameServer) []nameServer {
+	v6First := f.v6First()
+	slices.SortStableFunc(servers, func(a, b nameServer) int {
+		return f.rank(a.addr, v6First) - f.rank(b.addr, v6First)
+	})
+	return servers
+}
+
+func (f *families) rank(ip net.IP, v6First bool) int {
+	if (ip.To4() == nil) == v6First {
+		return 0
+	}
+	return 1
+}
+
+// addrOf returns the address of an A or AAAA record, nil for anything else.
+func addrOf(rr dns.RR) net.IP {
+	switch rr := rr.(type) {
+	case *dns.A:
+		return rr.A
+	case *dns.AAAA:
+		return rr.AAAA
+	}
+	return nil
+}
+
+func isAddr(rr dns.RR) bool {
+	return addrOf(rr) != nil
+}
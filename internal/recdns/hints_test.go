@@ -0,0 +1,46 @@
+package recdns_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/fudanchii/ssh2dns/internal/config"
+	"github.com/fudanchii/ssh2dns/internal/errors"
+	"github.com/fudanchii/ssh2dns/internal/recdns"
+	"github.com/fudanchii/ssh2dns/internal/recdnstest"
+)
+
+func TestBadRootHints(t *testing.T) {
+	h := recdnstest.NewHierarchy()
+	addZone(t, h, ".", rootIPs, "")
+	hints := h.RootHints()
+
+	tests := []struct {
+		name  string
+		hints string
+	}{
+		{"empty", ""},
+		{"truncated to one server", hints[:strings.Index(hints, "b.root-servers.test.")]},
+		{"truncated mid record", hints[:len(hints)-6]},
+		{"garbage", "\x00\x01 this is not a zone file {{{\n"},
+		{"html error page", "<html><body>503 Service Unavailable</body></html>\n"},
+	}
+
+	cfg, err := config.NewFromOptions(config.Options{"r": "true"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := recdns.NewWithRootHints(cfg, h.ClientPool(), tt.hints)
+			if !errors.As(err, new(errors.RootHintsUnavailable)) {
+				t.Errorf("err = %v, want RootHintsUnavailable", err)
+			}
+		})
+	}
+
+	if _, err := recdns.NewWithRootHints(cfg, h.ClientPool(), hints); err != nil {
+		t.Errorf("complete hints rejected: %v", err)
+	}
+}
@@ -2,59 +2,221 @@ package recdns
 
 import (
 	"context"
+	"fmt"
+	"io"
 	"net"
 	"slices"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/fudanchii/ssh2dns/internal/cache"
 	"github.com/fudanchii/ssh2dns/internal/config"
 	"github.com/fudanchii/ssh2dns/internal/errors"
+	"github.com/fudanchii/ssh2dns/internal/log"
+	"github.com/fudanchii/ssh2dns/internal/names"
+	"github.com/fudanchii/ssh2dns/internal/tracing"
 	"github.com/miekg/dns"
 	"github.com/samber/lo"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 type LookupCoordinator struct {
 	cache            *cache.Cache
 	rootMap          []*dns.A
-	fallbackTargetNS net.IP
+	fallbackTargetNS []net.IP
+	fallbackNext     atomic.Uint32
 	clientPool       DNSClientPool
 	recursive        bool
+	trace            TraceFunc
+	direct           *directResolver
+	serveStale       bool
+	hopTimeout       time.Duration
+	retries          int
+	breaker          *breaker
+	refreshing       sync.Map
+	queryBudget      int
+	nsParallel       int
+	rootParallel     int
+	families         *families
+	noFallback       bool
+	passRefused      bool
+	dnsPort          string
+	cookies          *cookieJar
+	timeout          time.Duration
+	routeFor         func(string) (config.Route, bool)
 }
 
+// TraceStep describes a single upstream exchange made while resolving a query.
+type TraceStep struct {
+	Server   net.IP
+	Question dns.Question
+	Response *dns.Msg
+	Duration time.Duration
+	Err      error
+}
+
+// TraceFunc receives every upstream exchange, it may be called concurrently.
+type TraceFunc func(TraceStep)
+
 var (
+	// DefaultTimeout is the default of -lookup-timeout.
+	//
+	// Deprecated: every LookupCoordinator has its own timeout, from AppConfig.LookupTimeout,
+	// changing this has no effect.
 	DefaultTimeout time.Duration = time.Duration(5) * time.Second
 )
 
-func New(cfg *config.AppConfig, clientPool DNSClientPool) *LookupCoordinator {
+const (
+	// minRootServers is the least number of root server addresses
+	// recursive lookup can reasonably work with.
+	minRootServers = 3
+
+	// largeBufferSize is the EDNS0 buffer size advertised when retrying truncated replies.
+	largeBufferSize = 4096
+
+	// retryBackoff is the wait before the first retry, doubled on every following one.
+	retryBackoff = 100 * time.Millisecond
+)
+
+func New(cfg *config.AppConfig, clientPool DNSClientPool) (*LookupCoordinator, error) {
+	return NewWithRootHints(cfg, clientPool, rootHints)
+}
+
+// NewWithRootHints is New with the given root hints, in zone file format,
+// instead of the built-in ones, e.g. to resolve against a private or fake root.
+func NewWithRootHints(cfg *config.AppConfig, clientPool DNSClientPool, hints string) (*LookupCoordinator, error) {
 	cc := cache.New(cfg)
 	lc := &LookupCoordinator{
 		cache:            cc,
 		rootMap:          []*dns.A{},
-		fallbackTargetNS: cfg.TargetServerIPv4(),
+		fallbackTargetNS: cfg.TargetServers(),
 		clientPool:       clientPool,
 		recursive:        cfg.RecursiveLookup(),
+		serveStale:       cfg.ServeStale() > 0,
+		hopTimeout:       time.Duration(cfg.ConnTimeout()) * time.Second,
+		retries:          cfg.Retries(),
+		breaker:          newBreaker(cfg.BreakerThreshold(), cfg.BreakerCooldown()),
+		queryBudget:      cfg.QueryBudget(),
+		nsParallel:       cfg.NSParallel(),
+		rootParallel:     cfg.RootParallel(),
+		families:         newFamilies(cfg.PreferFamily()),
+		noFallback:       cfg.NoFallback(),
+		passRefused:      cfg.PassRefused(),
+		dnsPort:          strconv.Itoa(cfg.DNSPort()),
+		cookies:          newCookieJar(!cfg.NoCookies()),
+		timeout:          cfg.LookupTimeout(),
+		routeFor:         cfg.RouteFor,
+	}
+	if err := lc.setup(hints); err != nil {
+		return nil, err
 	}
-	lc.setup()
-	return lc
+	if cfg.InsecureFallback() {
+		direct, err := newDirectResolver(cfg)
+		if err != nil {
+			return nil, err
+		}
+		lc.direct = direct
+	}
+	return lc, nil
 }
 
-func (lc *LookupCoordinator) handleRecursive(ctx context.Context, msg *dns.Msg, srv net.IP) (*dns.Msg, error) {
+// handleRecursive asks srv, a name server authoritative for zone, about msg.
+func (lc *LookupCoordinator) handleRecursive(ctx context.Context, msg *dns.Msg, srv net.IP, zone string) (_ *dns.Msg, err error) {
+	ctx, span := tracing.Start(ctx, "recdns.hop",
+		attribute.String("dns.question.name", msg.Question[0].Name),
+		attribute.String("dns.server", srv.String()),
+		attribute.String("dns.zone", zone),
+	)
+	defer func() { tracing.End(span, err) }()
+
 	if ctx.Err() != nil {
 		return nil, ctx.Err()
 	}
 
-	cli, err := lc.clientPool.Acquire(ctx)
+	if !lc.breaker.Allow(srv) {
+		return nil, errors.ServerSkipped{Server: srv}
+	}
+
+	if err := spendQuery(ctx); err != nil {
+		return nil, err
+	}
+
+	cli, err := lc.acquire(ctx)
 	if err != nil {
 		return nil, err
 	}
 
-	defer cli.Release()
+	defer func() {
+		if cli != nil {
+			cli.Release()
+		}
+	}()
 
-	rspMsg, err := cli.Value().ExchangeWithContext(ctx, msg, strings.Join([]string{srv.String(), "53"}, ":"))
+	rspMsg, err := lc.exchange(ctx, cli.Value(), msg, srv)
+	for attempt := 0; err != nil && transient(err) && attempt < lc.retries; attempt++ {
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(retryBackoff << attempt):
+		}
+		rspMsg, err = lc.exchange(ctx, cli.Value(), msg, srv)
+	}
+	if err != nil && transient(err) && ctx.Err() == nil {
+		// the connection we hold may be the broken part rather than the server, try once more on a fresh one
+		discard(cli)
+		if cli, err = lc.acquire(ctx); err != nil {
+			cli = nil
+			return nil, err
+		}
+		rspMsg, err = lc.exchange(ctx, cli.Value(), msg, srv)
+	}
 	if err != nil {
+		// running out of the lookup deadline is not the server's fault, nor is a tunnel that is down
+		if ctx.Err() == nil && serverFault(err) {
+			lc.breaker.Failure(srv)
+			lc.families.Failure(srv)
+		}
 		return nil, err
 	}
+	// a server failing every query is no better than a dead one, though it is reachable
+	lc.families.Success(srv)
+	if rspMsg.Rcode == dns.RcodeServerFailure && len(rspMsg.Answer) == 0 {
+		lc.breaker.Failure(srv)
+	} else {
+		lc.breaker.Success(srv)
+	}
+
+	if rspMsg.Truncated {
+		// replies over the tunnel are already on TCP and shouldn't be truncated,
+		// ask once more advertising a large buffer before giving up on this server
+		rspMsg, err = lc.exchange(ctx, cli.Value(), withLargeBuffer(msg), srv)
+		if err == nil && rspMsg.Truncated {
+			err = errors.TruncatedResponse{Server: srv}
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	scrubResponse(rspMsg, msg.Question[0].Name, zone)
+
+	// rate limited or against its policy, a forwarder may well answer the next time or the next one will
+	if rspMsg.Rcode == dns.RcodeRefused && len(rspMsg.Answer) == 0 {
+		return nil, errors.Refused{Server: srv, Rsp: rspMsg}
+	}
+	if rspMsg.Rcode == dns.RcodeServerFailure && len(rspMsg.Answer) == 0 {
+		return nil, errors.ServerFailure{Server: srv, Rsp: rspMsg}
+	}
+
+	// the name doesn't exist, or has nothing of the asked type, that settles it
+	if len(rspMsg.Answer) == 0 && negative(rspMsg) {
+		lc.cache.Set(msg, rspMsg)
+		return rspMsg, nil
+	}
 
 	if len(rspMsg.Answer) > 0 {
 		rspMsg, err := lc.assertAnswerForQuestion(ctx, msg, rspMsg)
@@ -62,19 +224,148 @@ func (lc *LookupCoordinator) handleRecursive(ctx context.Context, msg *dns.Msg,
 			lc.cache.Set(msg, rspMsg)
 			return rspMsg, nil
 		}
+
+		// the server answered, but not for what we asked,
+		// following its authority section would only lead back to it.
+		if _, ok := err.(errors.NoAnswerForQuestion); ok {
+			return nil, err
+		}
+		if isCNAMELoop(err) {
+			return nil, err
+		}
+	}
+
+	lc.cacheDelegation(rspMsg, zone)
+
+	return lc.useNextNS(ctx, msg, rspMsg, zone)
+}
+
+// exchange sends msg to srv once, within the per server deadline.
+func (lc *LookupCoordinator) exchange(ctx context.Context, cli DNSClient, msg *dns.Msg, srv net.IP) (*dns.Msg, error) {
+	// a single unresponsive server must not eat the whole lookup deadline
+	if lc.hopTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, lc.hopTimeout)
+		defer cancel()
+	}
+
+	start := time.Now()
+	rspMsg, err := lc.exchangeCookie(ctx, cli, msg, srv)
+	if err == nil && rspMsg.Rcode == dns.RcodeBadCookie {
+		// the server wants a fresh server cookie, which we now have from its reply
+		rspMsg, err = lc.exchangeCookie(ctx, cli, msg, srv)
+	}
+	elapsed := time.Since(start)
+	if lc.trace != nil {
+		lc.trace(TraceStep{
+			Server:   srv,
+			Question: msg.Question[0],
+			Response: rspMsg,
+			Duration: elapsed,
+			Err:      err,
+		})
+	}
+
+	q := msg.Question[0]
+	if err != nil {
+		log.Debug(fmt.Sprintf("%s %s @%s failed after %s: %s", q.Name, dns.TypeToString[q.Qtype], srv, elapsed, err.Error()))
+	} else {
+		log.Debug(fmt.Sprintf("%s %s @%s: %s, answer: %d, authority: %d in %s",
+			q.Name, dns.TypeToString[q.Qtype], srv, dns.RcodeToString[rspMsg.Rcode], len(rspMsg.Answer), len(rspMsg.Ns), elapsed))
 	}
 
-	return lc.useNextNS(ctx, msg, rspMsg)
+	return rspMsg, err
 }
 
-func (lc *LookupCoordinator) useNextNS(ctx context.Context, msg *dns.Msg, response *dns.Msg) (*dns.Msg, error) {
+// exchangeCookie sends msg along with our DNS cookie for srv, and checks the one it gets back.
+func (lc *LookupCoordinator) exchangeCookie(ctx context.Context, cli DNSClient, msg *dns.Msg, srv net.IP) (*dns.Msg, error) {
+	rspMsg, err := cli.ExchangeWithContext(ctx, lc.cookies.attach(msg, srv), net.JoinHostPort(srv.String(), lc.dnsPort))
+	if err != nil {
+		return nil, err
+	}
+	if err := checkReply(msg, rspMsg, srv); err != nil {
+		return nil, err
+	}
+	if err := lc.cookies.check(rspMsg, srv); err != nil {
+		return nil, err
+	}
+	return rspMsg, nil
+}
+
+// checkReply makes sure rsp answers msg, a reply crossed with another query's on a shared or reused stream
+// would otherwise be taken for the answer. Servers may leave out the question when failing the query.
+func checkReply(msg, rsp *dns.Msg, srv net.IP) error {
+	if rsp.Id != msg.Id {
+		return errors.ResponseMismatch{Server: srv, Reason: fmt.Sprintf("id %d, expected %d", rsp.Id, msg.Id)}
+	}
+
+	if len(rsp.Question) == 0 && rsp.Rcode != dns.RcodeSuccess {
+		return nil
+	}
+
+	q := msg.Question[0]
+	if len(rsp.Question) != 1 || !strings.EqualFold(rsp.Question[0].Name, q.Name) ||
+		rsp.Question[0].Qtype != q.Qtype || rsp.Question[0].Qclass != q.Qclass {
+		return errors.ResponseMismatch{Server: srv, Reason: "question differs"}
+	}
+
+	return nil
+}
+
+// serverFault tells whether err is the doing of the server asked, it can't be reached or didn't answer in time,
+// rather than of the tunnel, which would have every server look dead while the tunnel is down.
+func serverFault(err error) bool {
+	if errors.As(err, new(errors.PoolExhausted)) || errors.Is(err, errors.PoolReconnecting{}) ||
+		errors.Is(err, errors.SessionsBusy{}) {
+		return false
+	}
+
+	// a channel the ssh server couldn't open to the server, or not in time, is the server unreachable,
+	// any other dial error, e.g. a closed ssh connection, is the tunnel's
+	if errors.Is(err, errors.DNSDialErr{}) {
+		return errors.As(err, new(errors.ServerUnreachable)) || errors.Is(err, errors.ConnectionTimeout{})
+	}
+
+	var netErr net.Error
+	return errors.Is(err, errors.ConnectionTimeout{}) || errors.Is(err, context.DeadlineExceeded) ||
+		(errors.As(err, &netErr) && netErr.Timeout())
+}
+
+// transient reports whether err is a hiccup on the tunneled stream, e.g. a reset connection or a crossed reply,
+// as opposed to a server not answering in time, which retrying the same server won't fix.
+func transient(err error) bool {
+	if errors.Is(err, errors.ConnectionTimeout{}) {
+		return false
+	}
+	if errors.As(err, new(errors.ResponseMismatch)) {
+		return true
+	}
+	return errors.Is(err, errors.DNSReadErr{}) || errors.Is(err, errors.DNSWriteErr{})
+}
+
+func (lc *LookupCoordinator) useNextNS(ctx context.Context, msg *dns.Msg, response *dns.Msg, zone string) (*dns.Msg, error) {
 	var (
 		err     error
 		result  *dns.Msg
 		nextSrv []dns.RR
 		extra   []dns.RR
+		raced   = map[string]bool{}
 	)
 
+	// race the name servers we already know the addresses of, before looking up the rest one by one
+	if lc.nsParallel > 1 {
+		glued := gluedServers(response, zone)
+		if len(glued) > 0 {
+			result, err = lc.raceServers(ctx, msg, glued, lc.nsParallel)
+			if err == nil && result != nil {
+				return result, nil
+			}
+			for _, srv := range glued {
+				raced[srv.addr.String()] = true
+			}
+		}
+	}
+
 	for _, ns := range response.Ns {
 		if ctx.Err() != nil {
 			return nil, ctx.Err()
@@ -93,22 +384,27 @@ func (lc *LookupCoordinator) useNextNS(ctx context.Context, msg *dns.Msg, respon
 			nextNsString = nextNs.Ns
 		}
 
-		if len(response.Extra) > 0 {
-			nextSrv = lo.Filter(response.Extra, func(item dns.RR, _ int) bool {
-				if item.Header().Rrtype == dns.TypeA {
-					return item.Header().Name == nextNsString
-				}
-				return false
-			})
+		// glue is only trusted from servers authoritative for the name server's zone
+		nextSrv = lo.Filter(response.Extra, func(item dns.RR, _ int) bool {
+			if isAddr(item) {
+				return names.Equal(item.Header().Name, nextNsString) && inBailiwick(nextNsString, zone)
+			}
+			return false
+		})
+		extra = response.Extra
 
-			extra = response.Extra
-		} else {
-			nsQMsg := newQuestionMsg(nextNsString)
+		if len(nextSrv) == 0 {
+			// no usable glue, resolve the name server address ourselves
+			nsQMsg := newQuestionMsg(nextNsString, dns.TypeA)
 			nextNsAnswer, exist := lc.CacheLookup(nsQMsg)
+			trace.SpanFromContext(ctx).AddEvent("name server address lookup", trace.WithAttributes(
+				attribute.String("dns.ns", nextNsString),
+				attribute.Bool("cache.hit", exist),
+			))
 			if !exist {
 				nextNsAnswer, err = lc.tryHandleFromRoots(ctx, nsQMsg)
 				if err != nil {
-					return nil, err
+					continue
 				}
 			}
 
@@ -124,55 +420,174 @@ func (lc *LookupCoordinator) useNextNS(ctx context.Context, msg *dns.Msg, respon
 			continue
 		}
 
-		for _, nextDNS := range nextSrv {
+		for _, newSrv := range lc.families.order(lo.Map(nextSrv, func(rr dns.RR, _ int) net.IP { return addrOf(rr) })) {
 			if ctx.Err() != nil {
 				return nil, ctx.Err()
 			}
 
-			newSrv := nextDNS.(*dns.A).A
-			result, err = lc.handleRecursive(ctx, msg, newSrv)
-			if err != nil || result == nil || len(result.Answer) < 1 {
+			if raced[newSrv.String()] {
+				continue
+			}
+			result, err = lc.handleRecursive(ctx, msg, newSrv, ns.Header().Name)
+			if err != nil || !answered(result) {
 				continue
 			}
 			return result, nil
 		}
 	}
+
+	// keep the deepest referral we got, it tells the most about where resolution stalled
+	var referral errors.Referral
+	if len(response.Ns) > 0 && !errors.As(err, &referral) {
+		err = errors.Referral{Ns: response.Ns, Extra: response.Extra, Err: err}
+	}
+
+	return nil, err
+}
+
+// Lookup resolves name for qtype and qclass, a shorthand for Handle building the question itself.
+// The lookup gives up once ctx is done, or after Timeout, whichever comes first.
+func (lc *LookupCoordinator) Lookup(ctx context.Context, name string, qtype, qclass uint16) (*dns.Msg, error) {
+	msg := newQuestionMsg(dns.Fqdn(name), qtype)
+	msg.Question[0].Qclass = qclass
+	return lc.Handle(ctx, msg)
+}
+
+// Handle resolves msg, giving up once ctx is done.
+func (lc *LookupCoordinator) Handle(ctx context.Context, msg *dns.Msg) (rsp *dns.Msg, err error) {
+	ctx, span := tracing.Start(ctx, "recdns.lookup",
+		attribute.String("dns.question.name", msg.Question[0].Name),
+		attribute.String("dns.question.type", dns.TypeToString[msg.Question[0].Qtype]),
+	)
+	defer func() { tracing.End(span, err) }()
+
+	rsp, err = lc.handle(ctx, msg)
+	if err != nil && lc.direct != nil && errors.Is(err, errors.PoolReconnecting{}) {
+		log.Err("tunnel is down, resolving " + msg.Question[0].Name + " directly via insecure fallback!")
+
+		ctx, cancel := context.WithTimeout(ctx, lc.timeout)
+		defer cancel()
+		rsp, err = lc.direct.Exchange(ctx, msg)
+	}
+
+	if err != nil && lc.serveStale {
+		if stale, expired, found := lc.cache.GetStale(msg); found {
+			log.Err("cannot resolve " + msg.Question[0].Name + ", serving stale answer: " + err.Error())
+			if expired {
+				lc.refresh(msg)
+			}
+			return stale, nil
+		}
+	}
+
+	return rsp, err
+}
+
+// refresh retries msg in the background so a fresh answer replaces the stale one,
+// at most one refresh per question is in flight.
+func (lc *LookupCoordinator) refresh(msg *dns.Msg) {
+	q := msg.Question[0]
+	key := q.Name + ":" + dns.TypeToString[q.Qtype] + ":" + dns.ClassToString[q.Qclass]
+	if _, inflight := lc.refreshing.LoadOrStore(key, struct{}{}); inflight {
+		return
+	}
+
+	go func() {
+		defer lc.refreshing.Delete(key)
+		// not bound to the request, the client already got the stale answer
+		if _, err := lc.handle(context.TODO(), msg.Copy()); err != nil {
+			log.Err("background refresh of " + q.Name + " failed: " + err.Error())
+		}
+	}()
+}
+
+// forward asks the -dns servers in turn, starting from the next one in round-robin order,
+// until one settles the question. One refusing it is skipped too, unless -pass-refused.
+func (lc *LookupCoordinator) forward(ctx context.Context, msg *dns.Msg, servers []net.IP) (*dns.Msg, error) {
+	var err error = errors.NoAnswerForQuestion{N: msg.Question[0].Name, Qtype: msg.Question[0].Qtype}
+
+	var (
+		refused  errors.Refused
+		refusals int
+	)
+
+	start := int(lc.fallbackNext.Add(1))
+	for i := range servers {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+
+		srv := servers[(start+i)%len(servers)]
+		answer, xerr := lc.handleRecursive(ctx, msg, srv, ".")
+		if xerr == nil && answered(answer) {
+			return answer, nil
+		}
+		if errors.As(xerr, &refused) {
+			if lc.passRefused {
+				return refused.Rsp, nil
+			}
+			refusals++
+		}
+		if xerr != nil {
+			err = xerr
+		}
+	}
+
+	// every one of them refused, that is the answer
+	if refusals > 0 && refusals == len(servers) {
+		return refused.Rsp, nil
+	}
+
 	return nil, err
 }
 
-func (lc *LookupCoordinator) Handle(msg *dns.Msg) (*dns.Msg, error) {
+func (lc *LookupCoordinator) handle(parent context.Context, msg *dns.Msg) (*dns.Msg, error) {
 	errChan := make(chan error, 1)
 	msgChan := make(chan *dns.Msg, 1)
-	ctx, cancel := context.WithTimeout(context.TODO(), DefaultTimeout)
+
+	how := lc.strategyFor(msg.Question[0].Name)
+	if how.local {
+		return localReply(msg), nil
+	}
+
+	// every query of this lookup, the fallback included, goes over the same tunnel
+	parent, unpin := withClientPin(parent, lc.clientPool)
+	defer unpin()
+
+	ctx, cancel := context.WithTimeout(parent, lc.stageTimeout(parent, how))
 	defer cancel()
 
 	fallbackLookup := func(err error) (*dns.Msg, error) {
-		if err != nil && !lc.recursive {
+		// forwarding has nothing else to fall back to, and recursion may be told not to
+		if err != nil && (!how.recursive || lc.noFallback) {
 			return nil, err
 		}
-		ctx, cancel := context.WithTimeout(context.TODO(), DefaultTimeout)
+		if parent.Err() != nil {
+			return nil, errors.LookupFailed{N: msg.Question[0].Name}.Wrap(parent.Err())
+		}
+		ctx, cancel := context.WithTimeout(parent, lc.timeout)
 		defer cancel()
-		answer, err := lc.handleRecursive(ctx, msg, lc.fallbackTargetNS)
+		answer, err := lc.forward(ctx, msg, how.servers)
 		if err != nil {
-			return nil, errors.DomainNotFound{N: msg.Question[0].Name}.Wrap(err)
+			return nil, errors.LookupFailed{N: msg.Question[0].Name}.Wrap(err)
 		}
 		return answer, nil
 	}
 
 	go func() {
 		var (
-			msg *dns.Msg
+			rsp *dns.Msg
 			err error
 		)
-		if lc.recursive {
-			msg, err = lc.tryHandleFromRoots(ctx, msg)
+		if how.recursive {
+			rsp, err = lc.tryHandleFromRoots(withQueryBudget(ctx, lc.queryBudget), msg)
 		} else {
-			msg, err = fallbackLookup(nil)
+			rsp, err = fallbackLookup(nil)
 		}
 		if err != nil {
 			errChan <- err
 		} else {
-			msgChan <- msg
+			msgChan <- rsp
 		}
 	}()
 
@@ -182,22 +597,42 @@ func (lc *LookupCoordinator) Handle(msg *dns.Msg) (*dns.Msg, error) {
 	case err := <-errChan:
 		return fallbackLookup(err)
 	case <-ctx.Done():
-		return fallbackLookup(errors.DomainNotFound{N: msg.Question[0].Name}.Wrap(ctx.Err()))
+		return fallbackLookup(errors.LookupFailed{N: msg.Question[0].Name}.Wrap(ctx.Err()))
 	}
 }
 
-func (lc *LookupCoordinator) tryHandleFromRoots(ctx context.Context, msg *dns.Msg) (answerMsg *dns.Msg, err error) {
-	for _, ns := range lc.rootMap {
-		if ctx.Err() != nil {
-			return nil, ctx.Err()
-		}
+// stageTimeout is how long the first stage of a lookup may take, -lookup-timeout unless the caller
+// gives up sooner than the recursion and its fallback together, then each gets half of what is left.
+func (lc *LookupCoordinator) stageTimeout(parent context.Context, how strategy) time.Duration {
+	if !how.recursive || lc.noFallback {
+		return lc.timeout
+	}
+	deadline, ok := parent.Deadline()
+	if !ok {
+		return lc.timeout
+	}
+	if share := time.Until(deadline) / 2; share < lc.timeout {
+		return share
+	}
+	return lc.timeout
+}
 
-		answerMsg, err = lc.handleRecursive(ctx, msg, ns.A)
-		if err == nil && answerMsg != nil && len(answerMsg.Answer) > 0 {
-			return answerMsg, nil
-		}
+func (lc *LookupCoordinator) tryHandleFromRoots(ctx context.Context, msg *dns.Msg) (*dns.Msg, error) {
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
 	}
-	return nil, err
+
+	// a warm cache knows a closer delegation, the roots are only needed when it fails
+	rsp, tried, err := lc.tryHandleFromDelegation(ctx, msg)
+	if err == nil && rsp != nil {
+		return rsp, nil
+	}
+	if tried && (isCNAMELoop(err) || ctx.Err() != nil) {
+		return nil, err
+	}
+
+	// a few roots at once, so an unreachable one doesn't hold every cold lookup for its timeout
+	return lc.raceServers(ctx, msg, lc.shuffledRoots(), lc.rootParallel)
 }
 
 func (lc *LookupCoordinator) assertAnswerForQuestion(ctx context.Context, question *dns.Msg, answer *dns.Msg) (*dns.Msg, error) {
@@ -205,38 +640,87 @@ func (lc *LookupCoordinator) assertAnswerForQuestion(ctx context.Context, questi
 		return nil, ctx.Err()
 	}
 
-	if slices.ContainsFunc(answer.Answer, func(rr dns.RR) bool {
-		return rr.Header().Rrtype == question.Question[0].Qtype
+	qtype := question.Question[0].Qtype
+
+	if qtype == dns.TypeANY || slices.ContainsFunc(answer.Answer, func(rr dns.RR) bool {
+		return rr.Header().Rrtype == qtype
 	}) {
 		return answer, nil
 	}
 
-	if answer.Answer[0].Header().Rrtype == dns.TypeCNAME && !slices.ContainsFunc(answer.Answer, func(rr dns.RR) bool {
-		return rr.Header().Rrtype == dns.TypeA
-	}) {
-		cname, _ := answer.Answer[0].(*dns.CNAME)
-		cnameQMsg := newQuestionMsg(cname.Target)
-		newAnswer, err := lc.tryHandleFromRoots(ctx, cnameQMsg)
+	qname := question.Question[0].Name
+
+	// servers predating RFC 6672 may send the DNAME alone, synthesize the CNAME ourselves
+	synthesized, err := synthesizeCNAME(answer.Answer, qname)
+	if err != nil {
+		return nil, err
+	}
+	if synthesized != nil {
+		answer.Answer = append(answer.Answer, synthesized)
+	}
+
+	tail, depth, err := chainTail(ctx, answer.Answer, qname)
+	if err != nil {
+		return nil, err
+	}
+
+	// the server already told the alias target doesn't exist
+	if !names.Equal(tail, qname) && answer.Rcode == dns.RcodeNameError {
+		return answer, nil
+	}
+
+	// no records of the asked type, chase the end of the CNAME chain with the same type,
+	// e.g. an MX question must not settle for the A records alongside the CNAME.
+	if !names.Equal(tail, qname) {
+		cnameQMsg := withDNSSECFlags(newQuestionMsg(tail, qtype), question)
+		cnameQMsg.Question[0].Qclass = question.Question[0].Qclass
+		newAnswer, err := lc.tryHandleFromRoots(context.WithValue(ctx, cnameDepthKey{}, depth), cnameQMsg)
 		if err != nil {
 			return nil, err
 		}
 		answer.Answer = append(answer.Answer, newAnswer.Answer...)
+		if len(newAnswer.Answer) == 0 {
+			// the target is NXDOMAIN or NODATA, so is the alias
+			answer.Rcode = newAnswer.Rcode
+			answer.Ns = newAnswer.Ns
+		}
 		return answer, nil
 	}
 
-	return answer, nil
+	return nil, errors.NoAnswerForQuestion{N: qname, Qtype: qtype}
 }
 
-func (lc *LookupCoordinator) setup() {
-	r := strings.NewReader(rootHints)
+func (lc *LookupCoordinator) setup(hints string) error {
+	r := strings.NewReader(hints)
 	zp := dns.NewZoneParser(r, ".", "root.hints")
 	for rr, ok := zp.Next(); ok; rr, ok = zp.Next() {
 		if a, ok := rr.(*dns.A); ok {
 			lc.rootMap = append(lc.rootMap, a)
-			lc.cache.SetFromRR(rr)
+			lc.cache.SetHint(rr)
 		}
 
 	}
+
+	if err := zp.Err(); err != nil {
+		return errors.RootHintsUnavailable{Err: err}
+	}
+
+	if len(lc.rootMap) < minRootServers {
+		return errors.RootHintsUnavailable{Found: len(lc.rootMap), Min: minRootServers}
+	}
+
+	return nil
+}
+
+// Timeout is how long a lookup is given, recursion and the fallback each get that much again.
+func (lc *LookupCoordinator) Timeout() time.Duration {
+	return lc.timeout
+}
+
+// SetTrace registers fn to be called on every upstream exchange, nil disables tracing.
+// It must be called before the coordinator starts handling queries.
+func (lc *LookupCoordinator) SetTrace(fn TraceFunc) {
+	lc.trace = fn
 }
 
 func (lc *LookupCoordinator) Close() {
@@ -247,8 +731,70 @@ func (lc *LookupCoordinator) CacheLookup(req *dns.Msg) (*dns.Msg, bool) {
 	return lc.cache.Get(req)
 }
 
-func newQuestionMsg(domain string) *dns.Msg {
+// StaleLookup returns the cached reply for req even past its expiry, within -serve-stale,
+// with short TTLs, see cache.Cache.GetStale. Nothing is found with -serve-stale disabled.
+func (lc *LookupCoordinator) StaleLookup(req *dns.Msg) (*dns.Msg, bool) {
+	if !lc.serveStale {
+		return nil, false
+	}
+	rsp, _, found := lc.cache.GetStale(req)
+	return rsp, found
+}
+
+// FlushCache forgets every cached answer and delegation, the root hints stay.
+func (lc *LookupCoordinator) FlushCache() {
+	lc.cache.Flush()
+}
+
+// DeleteCache removes the cached answers for name and qtype, see cache.Cache.Delete.
+func (lc *LookupCoordinator) DeleteCache(name string, qtype uint16) int {
+	return lc.cache.Delete(name, qtype)
+}
+
+func (lc *LookupCoordinator) Name() string {
+	return "cache"
+}
+
+// Reload flushes the cache, so answers poisoned or gone stale upstream are looked up again.
+func (lc *LookupCoordinator) Reload() error {
+	lc.FlushCache()
+	return nil
+}
+
+// DumpCache writes the cached entries to w, see cache.Cache.Dump.
+func (lc *LookupCoordinator) DumpCache(w io.Writer) error {
+	return lc.cache.Dump(w)
+}
+
+// CacheLen is the number of cached entries.
+func (lc *LookupCoordinator) CacheLen() int {
+	return lc.cache.Len()
+}
+
+// withLargeBuffer returns a copy of msg advertising an EDNS0 buffer of at least largeBufferSize.
+func withLargeBuffer(msg *dns.Msg) *dns.Msg {
+	large := msg.Copy()
+	if opt := large.IsEdns0(); opt != nil {
+		if opt.UDPSize() < largeBufferSize {
+			opt.SetUDPSize(largeBufferSize)
+		}
+		return large
+	}
+	return large.SetEdns0(largeBufferSize, false)
+}
+
+// withDNSSECFlags carries the CD bit and the EDNS0 DO bit of orig over to msg,
+// so queries made on behalf of a client ask for what the client asked.
+func withDNSSECFlags(msg *dns.Msg, orig *dns.Msg) *dns.Msg {
+	msg.CheckingDisabled = orig.CheckingDisabled
+	if opt := orig.IsEdns0(); opt != nil && opt.Do() {
+		msg.SetEdns0(opt.UDPSize(), true)
+	}
+	return msg
+}
+
+func newQuestionMsg(domain string, qtype uint16) *dns.Msg {
 	msg := &dns.Msg{}
-	msg.SetQuestion(domain, dns.TypeA)
+	msg.SetQuestion(domain, qtype)
 	return msg
 }
@@ -0,0 +1,253 @@
+package recdns_test
+
+import (
+	"context"
+	"net"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/fudanchii/ssh2dns/internal/config"
+	"github.com/fudanchii/ssh2dns/internal/recdns"
+	"github.com/fudanchii/ssh2dns/internal/recdnstest"
+	"github.com/miekg/dns"
+)
+
+var rootIPs = []net.IP{net.ParseIP("192.0.2.1"), net.ParseIP("192.0.2.2"), net.ParseIP("192.0.2.3")}
+
+// startHierarchy starts h once its zones are added, closing it when the test ends.
+func startHierarchy(t *testing.T, h *recdnstest.Hierarchy) {
+	t.Helper()
+	if err := h.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(h.Close)
+}
+
+func addZone(t *testing.T, h *recdnstest.Hierarchy, zone string, ips []net.IP, records string) *recdnstest.Zone {
+	t.Helper()
+	z, err := h.AddZone(zone, ips, "$TTL 300\n"+records)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return z
+}
+
+func newCoordinator(t *testing.T, h *recdnstest.Hierarchy, opts config.Options) *recdns.LookupCoordinator {
+	t.Helper()
+	cfg, err := config.NewFromOptions(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lc, err := recdns.NewWithRootHints(cfg, h.ClientPool(), h.RootHints())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return lc
+}
+
+func question(name string, qtype uint16) *dns.Msg {
+	m := new(dns.Msg)
+	m.SetQuestion(name, qtype)
+	return m
+}
+
+func TestFallbackWithinCallerDeadline(t *testing.T) {
+	h := recdnstest.NewHierarchy()
+	addZone(t, h, ".", rootIPs, `
+com.	NS	ns.com.
+ns.com.	A	192.0.2.10
+`)
+	slow := addZone(t, h, "com.", []net.IP{net.ParseIP("192.0.2.10")}, "")
+	slow.Delay = 10 * time.Second
+	// what -dns points at
+	addZone(t, h, "example.com.", []net.IP{net.ParseIP("192.0.2.53")}, `
+@	A	192.0.2.80
+`)
+	startHierarchy(t, h)
+
+	lc := newCoordinator(t, h, config.Options{
+		"r":              "true",
+		"dns":            "192.0.2.53",
+		"lookup-timeout": "1s",
+		"t":              "0",
+	})
+
+	// as a UDP client with -udp-deadline equal to -lookup-timeout
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	rsp, err := lc.Handle(ctx, question("example.com.", dns.TypeA))
+	if err != nil {
+		t.Fatalf("lookup failed instead of falling back: %v", err)
+	}
+	if len(rsp.Answer) != 1 || rsp.Answer[0].(*dns.A).A.String() != "192.0.2.80" {
+		t.Errorf("answer = %v, want the one from -dns", rsp.Answer)
+	}
+}
+
+func TestReverseLookup(t *testing.T) {
+	h := recdnstest.NewHierarchy()
+	addZone(t, h, ".", rootIPs, `
+arpa.	NS	ns.arpa.
+ns.arpa.	A	192.0.2.20
+`)
+	addZone(t, h, "arpa.", []net.IP{net.ParseIP("192.0.2.20")}, `
+in-addr.arpa.	NS	ns.in-addr.arpa.
+ns.in-addr.arpa.	A	192.0.2.21
+`)
+	addZone(t, h, "in-addr.arpa.", []net.IP{net.ParseIP("192.0.2.21")}, `
+8.in-addr.arpa.	NS	ns.8.in-addr.arpa.
+ns.8.in-addr.arpa.	A	192.0.2.22
+`)
+	addZone(t, h, "8.in-addr.arpa.", []net.IP{net.ParseIP("192.0.2.22")}, `
+8.8.8.8.in-addr.arpa.	PTR	dns.google.
+`)
+	startHierarchy(t, h)
+
+	lc := newCoordinator(t, h, config.Options{"r": "true", "no-fallback": "true"})
+
+	rsp, err := lc.Handle(context.Background(), question("8.8.8.8.in-addr.arpa.", dns.TypePTR))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rsp.Answer) != 1 {
+		t.Fatalf("answer = %v, want one PTR", rsp.Answer)
+	}
+	if ptr, ok := rsp.Answer[0].(*dns.PTR); !ok || ptr.Ptr != "dns.google." {
+		t.Errorf("answer = %v, want PTR dns.google.", rsp.Answer[0])
+	}
+	for _, srv := range []string{"192.0.2.20:53", "192.0.2.21:53", "192.0.2.22:53"} {
+		if !slices.Contains(h.Client().Queried(), srv) {
+			t.Errorf("%s was never asked, queried %v", srv, h.Client().Queried())
+		}
+	}
+
+	rsp, err = lc.Handle(context.Background(), question("4.4.8.8.in-addr.arpa.", dns.TypePTR))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rsp.Rcode != dns.RcodeNameError {
+		t.Errorf("rcode = %s, want NXDOMAIN for a missing reverse name", dns.RcodeToString[rsp.Rcode])
+	}
+}
+
+func TestOutOfBailiwickGlueIgnored(t *testing.T) {
+	evil := net.ParseIP("192.0.2.66")
+
+	h := recdnstest.NewHierarchy()
+	addZone(t, h, ".", rootIPs, `
+test.	NS	ns.test.
+ns.test.	A	192.0.2.10
+net.	NS	ns.net.
+ns.net.	A	192.0.2.11
+`)
+	// test. has no say over the addresses of net. names, its glue for them is a lie
+	addZone(t, h, "test.", []net.IP{net.ParseIP("192.0.2.10")}, `
+example	NS	ns.example.net.
+ns.example.net.	A	192.0.2.66
+`)
+	addZone(t, h, "net.", []net.IP{net.ParseIP("192.0.2.11")}, `
+ns.example	A	192.0.2.67
+`)
+	addZone(t, h, "example.test.", []net.IP{net.ParseIP("192.0.2.67")}, `
+www	A	192.0.2.80
+`)
+	addZone(t, h, "bank.", []net.IP{evil}, `
+www.example.test.	A	192.0.2.66
+`)
+	startHierarchy(t, h)
+
+	for _, parallel := range []string{"1", "3"} {
+		t.Run("ns-parallel "+parallel, func(t *testing.T) {
+			lc := newCoordinator(t, h, config.Options{"r": "true", "no-fallback": "true", "ns-parallel": parallel})
+
+			rsp, err := lc.Handle(context.Background(), question("www.example.test.", dns.TypeA))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(rsp.Answer) != 1 || rsp.Answer[0].(*dns.A).A.String() != "192.0.2.80" {
+				t.Errorf("answer = %v, want www.example.test. A 192.0.2.80", rsp.Answer)
+			}
+			if slices.Contains(h.Client().Queried(), net.JoinHostPort(evil.String(), "53")) {
+				t.Errorf("followed out-of-bailiwick glue, queried %v", h.Client().Queried())
+			}
+		})
+	}
+}
+
+func TestHopTimeoutCutsSlowServer(t *testing.T) {
+	h := recdnstest.NewHierarchy()
+	addZone(t, h, ".", rootIPs, `
+test.	NS	ns.test.
+ns.test.	A	192.0.2.40
+`)
+	slow := addZone(t, h, "test.", []net.IP{net.ParseIP("192.0.2.40")}, `
+www	A	192.0.2.80
+`)
+	slow.Delay = 10 * time.Second
+	startHierarchy(t, h)
+
+	lc := newCoordinator(t, h, config.Options{
+		"r":              "true",
+		"no-fallback":    "true",
+		"t":              "1",
+		"lookup-timeout": "5s",
+		"retries":        "0",
+	})
+
+	start := time.Now()
+	_, err := lc.Handle(context.Background(), question("www.test.", dns.TypeA))
+	elapsed := time.Since(start)
+
+	if err == nil {
+		t.Fatal("lookup through a server slower than -t succeeded")
+	}
+	if elapsed > 3*time.Second {
+		t.Errorf("lookup took %s, the slow server was not cut short by -t", elapsed)
+	}
+}
+
+// Under a UDP client's -udp-deadline, the recursion only gets half of it before falling back,
+// the default -t must still cut a slow server short for the next one within that half.
+func TestHopTimeoutCutsSlowServerUnderCallerDeadline(t *testing.T) {
+	h := recdnstest.NewHierarchy()
+	addZone(t, h, ".", rootIPs, `
+test.	NS	ns1.test.
+test.	NS	ns2.test.
+ns1.test.	A	192.0.2.40
+ns2.test.	A	192.0.2.41
+`)
+	// whatever 192.0.2.40 serves, it's too slow to matter
+	slow := addZone(t, h, "slow.", []net.IP{net.ParseIP("192.0.2.40")}, "")
+	slow.Delay = 10 * time.Second
+	addZone(t, h, "test.", []net.IP{net.ParseIP("192.0.2.41")}, `
+www	A	192.0.2.80
+`)
+	// what -dns points at, answering differently to tell a fallback apart
+	addZone(t, h, "www.test.", []net.IP{net.ParseIP("192.0.2.53")}, `
+@	A	192.0.2.99
+`)
+	startHierarchy(t, h)
+
+	lc := newCoordinator(t, h, config.Options{
+		"r":       "true",
+		"dns":     "192.0.2.53",
+		"retries": "0",
+	})
+
+	// as a UDP client with the default -udp-deadline
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	rsp, err := lc.Handle(ctx, question("www.test.", dns.TypeA))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if queried := h.Client().Queried(); !slices.Contains(queried, "192.0.2.40:53") {
+		t.Fatalf("the slow server was never asked, queried %v", queried)
+	}
+	if len(rsp.Answer) != 1 || rsp.Answer[0].(*dns.A).A.String() != "192.0.2.80" {
+		t.Errorf("answer = %v, want the one recursion finds past the slow server", rsp.Answer)
+	}
+}
@@ -0,0 +1,34 @@
+package recdns
+
+import "github.com/miekg/dns"
+
+// negative reports whether rsp settles the question without records,
+// either NXDOMAIN, the name doesn't exist, or NODATA, the name has no records of the asked type.
+// Both come with the zone SOA in the authority section, a referral does not.
+// Some authoritative servers leave the SOA out of NODATA, an empty answer with the AA bit
+// and no delegation is just as final, asking the other servers of the zone won't change it.
+func negative(rsp *dns.Msg) bool {
+	if rsp.Rcode == dns.RcodeNameError {
+		return true
+	}
+
+	if rsp.Rcode != dns.RcodeSuccess || len(rsp.Answer) > 0 {
+		return false
+	}
+
+	referral := false
+	for _, rr := range rsp.Ns {
+		switch rr.Header().Rrtype {
+		case dns.TypeSOA:
+			return true
+		case dns.TypeNS:
+			referral = true
+		}
+	}
+	return rsp.Authoritative && !referral
+}
+
+// answered reports whether rsp is final, with answers or negative.
+func answered(rsp *dns.Msg) bool {
+	return rsp != nil && (len(rsp.Answer) > 0 || negative(rsp))
+}
@@ -0,0 +1,120 @@
+package recdns
+
+import (
+	"context"
+	"sync"
+)
+
+// clientPin hands the same pooled client to every upstream query of one lookup,
+// referrals, CNAME chases, and name server lookups alike, rather than each acquiring its own.
+// The client is acquired on first use, and given back once the lookup is over
+// and the last query using it is done.
+type clientPin struct {
+	pool DNSClientPool
+
+	mu      sync.Mutex
+	current *pinnedClient
+	done    bool
+}
+
+type pinnedClient struct {
+	pin    *clientPin
+	item   PoolItemWrapper[DNSClient]
+	users  int
+	broken bool
+}
+
+type clientPinKey struct{}
+
+// withClientPin pins a client for lookups under ctx, the returned func unpins it.
+// A ctx already carrying a pin keeps it, the outermost lookup unpins.
+func withClientPin(ctx context.Context, pool DNSClientPool) (context.Context, func()) {
+	if _, ok := ctx.Value(clientPinKey{}).(*clientPin); ok {
+		return ctx, func() {}
+	}
+
+	pin := &clientPin{pool: pool}
+	return context.WithValue(ctx, clientPinKey{}, pin), pin.unpin
+}
+
+// acquire returns the client pinned in ctx, or one straight from the pool without a pin,
+// or once the lookup holding it is over.
+func (lc *LookupCoordinator) acquire(ctx context.Context) (PoolItemWrapper[DNSClient], error) {
+	pin, ok := ctx.Value(clientPinKey{}).(*clientPin)
+	if !ok {
+		return lc.clientPool.Acquire(ctx)
+	}
+
+	pin.mu.Lock()
+	defer pin.mu.Unlock()
+
+	if pin.done {
+		return lc.clientPool.Acquire(ctx)
+	}
+
+	if pin.current == nil {
+		item, err := pin.pool.Acquire(ctx)
+		if err != nil {
+			return nil, err
+		}
+		pin.current = &pinnedClient{pin: pin, item: item}
+	}
+
+	pin.current.users++
+	return pinnedUse{pin.current}, nil
+}
+
+func (pin *clientPin) unpin() {
+	pin.mu.Lock()
+	defer pin.mu.Unlock()
+
+	pin.done = true
+	if pc := pin.current; pc != nil {
+		pin.current = nil
+		pc.settle()
+	}
+}
+
+// settle gives the client back to the pool once nobody uses it and no new query will get it,
+// the pin mutex must be held.
+func (pc *pinnedClient) settle() {
+	if pc.users > 0 || pc.pin.current == pc {
+		return
+	}
+	if pc.broken {
+		discard(pc.item)
+		return
+	}
+	pc.item.Release()
+}
+
+// pinnedUse is one query's hold on the pinned client.
+type pinnedUse struct {
+	pc *pinnedClient
+}
+
+func (u pinnedUse) Value() DNSClient {
+	return u.pc.item.Value()
+}
+
+func (u pinnedUse) Release() {
+	u.pc.pin.mu.Lock()
+	defer u.pc.pin.mu.Unlock()
+
+	u.pc.users--
+	u.pc.settle()
+}
+
+// Destroy unpins a client found broken, the queries after it get a fresh one,
+// those still using it finish before it is destroyed.
+func (u pinnedUse) Destroy() {
+	u.pc.pin.mu.Lock()
+	defer u.pc.pin.mu.Unlock()
+
+	u.pc.broken = true
+	if u.pc.pin.current == u.pc {
+		u.pc.pin.current = nil
+	}
+	u.pc.users--
+	u.pc.settle()
+}
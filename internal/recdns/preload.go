@@ -0,0 +1,86 @@
+package recdns
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"sync/atomic"
+
+	"github.com/fudanchii/ssh2dns/internal/log"
+	"github.com/fudanchii/ssh2dns/internal/names"
+	"github.com/miekg/dns"
+	"github.com/sourcegraph/conc/pool"
+)
+
+// Preload resolves every question listed in file so the answers are cached before anyone asks,
+// running at most workers lookups at once. Each line holds a name and a query type,
+// e.g. `intranet.example.com. A`, blank lines and lines starting with # are ignored.
+func (lc *LookupCoordinator) Preload(file string, workers int) error {
+	questions, err := readPreloadList(file)
+	if err != nil {
+		return err
+	}
+
+	var resolved atomic.Int32
+	p := pool.New().WithMaxGoroutines(workers)
+	for _, q := range questions {
+		q := q
+		p.Go(func() {
+			qtype := dns.TypeToString[q.Qtype]
+			if _, err := lc.Handle(context.TODO(), newQuestionMsg(q.Name, q.Qtype)); err != nil {
+				log.Err(fmt.Sprintf("cannot preload %s %s: %s", q.Name, qtype, err.Error()))
+				return
+			}
+			resolved.Add(1)
+			log.Info(fmt.Sprintf("preloaded %s %s", q.Name, qtype))
+		})
+	}
+	p.Wait()
+
+	log.Info(fmt.Sprintf("preloaded %d of %d names from %s", resolved.Load(), len(questions), file))
+
+	return nil
+}
+
+func readPreloadList(file string) ([]dns.Question, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var (
+		questions []dns.Question
+		lineNum   int
+	)
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		lineNum++
+
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%s:%d: expected a name and a query type", file, lineNum)
+		}
+
+		qtype, ok := dns.StringToType[strings.ToUpper(fields[1])]
+		if !ok {
+			return nil, fmt.Errorf("%s:%d: unknown query type %s", file, lineNum, fields[1])
+		}
+
+		if _, ok := dns.IsDomainName(fields[0]); !ok {
+			return nil, fmt.Errorf("%s:%d: invalid name %s", file, lineNum, fields[0])
+		}
+
+		questions = append(questions, dns.Question{Name: names.Canonical(fields[0]), Qtype: qtype, Qclass: dns.ClassINET})
+	}
+
+	return questions, scanner.Err()
+}
@@ -0,0 +1,93 @@
+package recdns
+
+import (
+	"context"
+	"math/rand"
+	"net"
+
+	"github.com/fudanchii/ssh2dns/internal/names"
+	"github.com/miekg/dns"
+)
+
+// nameServer is an address to ask, along with the zone it was delegated.
+type nameServer struct {
+	addr net.IP
+	zone string
+}
+
+// gluedServers lists the addresses of every name server in the referral that came with usable glue,
+// in the order the referral gave them.
+func gluedServers(response *dns.Msg, zone string) []nameServer {
+	var servers []nameServer
+
+	for _, rr := range response.Ns {
+		ns, ok := rr.(*dns.NS)
+		if !ok || !inBailiwick(ns.Ns, zone) {
+			continue
+		}
+		for _, extra := range response.Extra {
+			if addr := addrOf(extra); addr != nil && names.Equal(extra.Header().Name, ns.Ns) {
+				servers = append(servers, nameServer{addr: addr, zone: ns.Hdr.Name})
+			}
+		}
+	}
+
+	return servers
+}
+
+// shuffledRoots returns the root server addresses in random order, spreading load across them.
+func (lc *LookupCoordinator) shuffledRoots() []nameServer {
+	roots := make([]nameServer, 0, len(lc.rootMap))
+	for _, i := range rand.Perm(len(lc.rootMap)) {
+		roots = append(roots, nameServer{addr: lc.rootMap[i].A, zone: "."})
+	}
+	return roots
+}
+
+// raceServers asks up to parallel of servers at once, starting the next one as soon as another fails,
+// and returns the first reply settling the question. The queries still in flight are then cancelled.
+func (lc *LookupCoordinator) raceServers(ctx context.Context, msg *dns.Msg, servers []nameServer, parallel int) (*dns.Msg, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type outcome struct {
+		rsp *dns.Msg
+		err error
+	}
+
+	// buffered for every server, so the losers never block after we return
+	outcomes := make(chan outcome, len(servers))
+	launch := func(srv nameServer) {
+		go func() {
+			rsp, err := lc.handleRecursive(ctx, msg.Copy(), srv.addr, srv.zone)
+			outcomes <- outcome{rsp, err}
+		}()
+	}
+
+	next := 0
+	for ; next < len(servers) && next < max(parallel, 1); next++ {
+		launch(servers[next])
+	}
+
+	var err error
+	for pending := next; pending > 0; pending-- {
+		out := <-outcomes
+		if out.err == nil && answered(out.rsp) {
+			return out.rsp, nil
+		}
+		if out.err != nil {
+			err = out.err
+		}
+		// another server would only walk the same chain again
+		if isCNAMELoop(err) {
+			return nil, err
+		}
+		if next < len(servers) {
+			launch(servers[next])
+			next++
+			pending++
+		}
+	}
+
+	return nil, err
+}
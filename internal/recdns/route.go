@@ -0,0 +1,45 @@
+package recdns
+
+import (
+	"net"
+
+	"github.com/fudanchii/ssh2dns/internal/config"
+
+	"github.com/miekg/dns"
+)
+
+// strategy is how a single lookup is resolved, from -r and -dns unless a -route covers the name.
+type strategy struct {
+	recursive bool
+	local     bool
+	servers   []net.IP
+}
+
+func (lc *LookupCoordinator) strategyFor(name string) strategy {
+	route, ok := lc.routeFor(name)
+	if !ok {
+		return strategy{recursive: lc.recursive, servers: lc.fallbackTargetNS}
+	}
+
+	switch route.Strategy {
+	case config.RouteLocal:
+		return strategy{local: true}
+	case config.RouteRecursive:
+		// a routed zone falls back to -dns like the rest when recursion fails
+		return strategy{recursive: true, servers: lc.fallbackTargetNS}
+	}
+	return strategy{servers: route.Servers}
+}
+
+// localReply denies the name exists, zones routed locally are never asked upstream.
+func localReply(msg *dns.Msg) *dns.Msg {
+	rsp := new(dns.Msg)
+	rsp.SetRcode(msg, dns.RcodeNameError)
+	rsp.Authoritative = true
+	return rsp
+}
+
+// Recursive reports whether name is resolved recursively, from the roots, rather than forwarded.
+func (lc *LookupCoordinator) Recursive(name string) bool {
+	return lc.strategyFor(name).recursive
+}
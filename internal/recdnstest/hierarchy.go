@@ -0,0 +1,238 @@
+// Package recdnstest stands up a fake DNS hierarchy, root, TLDs, and authoritative zones,
+// on local miekg/dns servers, so recursive lookups can be exercised deterministically
+// without the ssh tunnel or the real internet.
+package recdnstest
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fudanchii/ssh2dns/internal/log"
+	"github.com/fudanchii/ssh2dns/internal/recdns"
+	"github.com/miekg/dns"
+)
+
+// Hierarchy routes queries for the zones' name server addresses to local servers.
+// Name server addresses are only labels, e.g. from 192.0.2.0/24, nothing listens on them.
+type Hierarchy struct {
+	mu      sync.Mutex
+	zones   map[string]*Zone
+	servers []*dns.Server
+	addrs   map[string]string
+	client  *Client
+
+	// done releases the answers zones are still holding back on Close
+	done chan struct{}
+}
+
+func NewHierarchy() *Hierarchy {
+	h := &Hierarchy{
+		zones: map[string]*Zone{},
+		addrs: map[string]string{},
+		done:  make(chan struct{}),
+	}
+	// past the defaults of 2s, so exchanges are cut short by the caller's deadline, e.g. -t, alone
+	h.client = &Client{hierarchy: h, client: dns.Client{Net: "tcp", Timeout: time.Minute}}
+	return h
+}
+
+// AddZone adds an authoritative zone served by ips, the records are in zone file format,
+// with names relative to zone unless fully qualified. A SOA is made up when none is given.
+func (h *Hierarchy) AddZone(zone string, ips []net.IP, records string) (*Zone, error) {
+	zone = dns.Fqdn(zone)
+	z := &Zone{Name: zone, IPs: ips}
+
+	zp := dns.NewZoneParser(strings.NewReader(records), zone, zone)
+	for rr, ok := zp.Next(); ok; rr, ok = zp.Next() {
+		if soa, isSOA := rr.(*dns.SOA); isSOA {
+			z.soa = soa
+			continue
+		}
+		z.records = append(z.records, rr)
+	}
+	if err := zp.Err(); err != nil {
+		return nil, err
+	}
+
+	if z.soa == nil {
+		z.soa = &dns.SOA{
+			Hdr:     dns.RR_Header{Name: zone, Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: 3600},
+			Ns:      "ns." + zone,
+			Mbox:    "hostmaster." + zone,
+			Serial:  1,
+			Refresh: 3600,
+			Retry:   600,
+			Expire:  86400,
+			Minttl:  300,
+		}
+	}
+
+	h.mu.Lock()
+	h.zones[zone] = z
+	h.mu.Unlock()
+
+	return z, nil
+}
+
+// Start listens on a local TCP port for every zone.
+func (h *Hierarchy) Start() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for _, z := range h.zones {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			h.shutdown()
+			return err
+		}
+
+		started := make(chan struct{})
+		srv := &dns.Server{
+			Listener:          listener,
+			Net:               "tcp",
+			Handler:           h.zoneHandler(z),
+			NotifyStartedFunc: func() { close(started) },
+		}
+		go srv.ActivateAndServe()
+		<-started
+
+		h.servers = append(h.servers, srv)
+		for _, ip := range z.IPs {
+			h.addrs[net.JoinHostPort(ip.String(), "53")] = listener.Addr().String()
+		}
+	}
+
+	return nil
+}
+
+func (h *Hierarchy) Close() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	select {
+	case <-h.done:
+	default:
+		close(h.done)
+	}
+	h.shutdown()
+}
+
+func (h *Hierarchy) shutdown() {
+	for _, srv := range h.servers {
+		srv.Shutdown()
+	}
+	h.servers = nil
+}
+
+// RootHints lists the root zone name servers, to be given to recdns.NewWithRootHints.
+func (h *Hierarchy) RootHints() string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	root, ok := h.zones["."]
+	if !ok {
+		return ""
+	}
+
+	var hints strings.Builder
+	for i, ip := range root.IPs {
+		ns := fmt.Sprintf("%c.root-servers.test.", 'a'+i)
+		fmt.Fprintf(&hints, ".\t3600000\tNS\t%s\n", ns)
+		fmt.Fprintf(&hints, "%s\t3600000\tA\t%s\n", ns, ip)
+	}
+	return hints.String()
+}
+
+// ClientPool returns a pool handing out Client.
+func (h *Hierarchy) ClientPool() recdns.DNSClientPool {
+	return &pool{client: h.client}
+}
+
+// Client returns the client exchanging with the hierarchy's servers, telling which of them were queried.
+func (h *Hierarchy) Client() *Client {
+	return h.client
+}
+
+func (h *Hierarchy) resolveAddr(srv string) (string, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	addr, ok := h.addrs[srv]
+	return addr, ok
+}
+
+func (h *Hierarchy) zoneHandler(z *Zone) dns.HandlerFunc {
+	return func(w dns.ResponseWriter, r *dns.Msg) {
+		if z.Delay > 0 {
+			select {
+			case <-time.After(z.Delay):
+			case <-h.done:
+				return
+			}
+		}
+		if err := w.WriteMsg(z.answer(r)); err != nil {
+			log.Err(fmt.Sprintf("zone %s: cannot answer %s: %s", z.Name, w.RemoteAddr(), err))
+		}
+	}
+}
+
+// Client is a recdns.DNSClient talking to the hierarchy, it records every server it was asked to query.
+type Client struct {
+	hierarchy *Hierarchy
+	client    dns.Client
+
+	mu      sync.Mutex
+	queried []string
+}
+
+func (c *Client) ExchangeWithContext(ctx context.Context, req *dns.Msg, srv string) (*dns.Msg, error) {
+	c.mu.Lock()
+	c.queried = append(c.queried, srv)
+	c.mu.Unlock()
+
+	addr, ok := c.hierarchy.resolveAddr(srv)
+	if !ok {
+		return nil, fmt.Errorf("no fake server at %s", srv)
+	}
+
+	rsp, _, err := c.client.ExchangeContext(ctx, req, addr)
+	return rsp, err
+}
+
+func (c *Client) Close() error {
+	return nil
+}
+
+// Queried returns the servers asked so far, in order.
+func (c *Client) Queried() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]string(nil), c.queried...)
+}
+
+type pool struct {
+	client *Client
+}
+
+func (p *pool) Acquire(ctx context.Context) (recdns.PoolItemWrapper[recdns.DNSClient], error) {
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	return item{p.client}, nil
+}
+
+func (p *pool) Close() {}
+
+type item struct {
+	client *Client
+}
+
+func (i item) Value() recdns.DNSClient {
+	return i.client
+}
+
+func (i item) Release() {}
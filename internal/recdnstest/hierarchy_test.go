@@ -0,0 +1,72 @@
+package recdnstest
+
+import (
+	"context"
+	"net"
+	"slices"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestZoneAnswers(t *testing.T) {
+	h := NewHierarchy()
+	if _, err := h.AddZone(".", []net.IP{net.ParseIP("192.0.2.1")}, `$TTL 300
+test.	NS	ns.test.
+ns.test.	A	192.0.2.10
+`); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := h.AddZone("test.", []net.IP{net.ParseIP("192.0.2.10")}, `$TTL 300
+www	A	192.0.2.80
+old	DNAME	new.test.
+`); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+
+	exchange := func(srv, name string) *dns.Msg {
+		t.Helper()
+		req := new(dns.Msg)
+		req.SetQuestion(name, dns.TypeA)
+		rsp, err := h.Client().ExchangeWithContext(context.Background(), req, srv)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return rsp
+	}
+
+	rsp := exchange("192.0.2.1:53", "www.test.")
+	if rsp.Authoritative || len(rsp.Ns) != 1 || len(rsp.Extra) != 1 {
+		t.Errorf("root answered %v, want a referral to test. with glue", rsp)
+	}
+
+	rsp = exchange("192.0.2.10:53", "www.test.")
+	if !rsp.Authoritative || len(rsp.Answer) != 1 {
+		t.Errorf("test. answered %v, want the A record", rsp)
+	}
+
+	rsp = exchange("192.0.2.10:53", "missing.test.")
+	if rsp.Rcode != dns.RcodeNameError || len(rsp.Ns) != 1 {
+		t.Errorf("test. answered %v, want NXDOMAIN with the SOA", rsp)
+	}
+
+	rsp = exchange("192.0.2.10:53", "www.old.test.")
+	if len(rsp.Answer) != 1 || rsp.Answer[0].Header().Rrtype != dns.TypeDNAME {
+		t.Errorf("test. answered %v, want the DNAME", rsp)
+	}
+
+	want := []string{"192.0.2.1:53", "192.0.2.10:53", "192.0.2.10:53", "192.0.2.10:53"}
+	if got := h.Client().Queried(); !slices.Equal(got, want) {
+		t.Errorf("queried %v, want %v", got, want)
+	}
+
+	req := new(dns.Msg)
+	req.SetQuestion("www.test.", dns.TypeA)
+	if _, err := h.Client().ExchangeWithContext(context.Background(), req, "198.51.100.1:53"); err == nil {
+		t.Error("exchange with an address no zone is served on succeeded")
+	}
+}
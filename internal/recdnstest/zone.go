@@ -0,0 +1,108 @@
+package recdnstest
+
+import (
+	"net"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Zone is the data of one authoritative zone, served by the listed name server addresses.
+type Zone struct {
+	Name string
+	IPs  []net.IP
+	// Delay holds every answer back this long, making the zone's servers slow ones
+	Delay   time.Duration
+	records []dns.RR
+	soa     *dns.SOA
+}
+
+// answer behaves like an authoritative server for the zone,
+// answering from its records, referring to delegated children, or denying the name.
+func (z *Zone) answer(req *dns.Msg) *dns.Msg {
+	rsp := new(dns.Msg)
+	rsp.SetReply(req)
+
+	q := req.Question[0]
+
+	if ns := z.delegation(q.Name); len(ns) > 0 {
+		rsp.Ns = ns
+		rsp.Extra = z.glue(ns)
+		return rsp
+	}
+
+	rsp.Authoritative = true
+
+	for _, rr := range z.records {
+		if dname, ok := rr.(*dns.DNAME); ok && below(q.Name, dname.Hdr.Name) {
+			rsp.Answer = append(rsp.Answer, dname)
+			return rsp
+		}
+	}
+
+	nameExists := false
+	for _, rr := range z.records {
+		if !strings.EqualFold(rr.Header().Name, q.Name) {
+			continue
+		}
+		nameExists = true
+
+		if rr.Header().Rrtype == q.Qtype || q.Qtype == dns.TypeANY || rr.Header().Rrtype == dns.TypeCNAME {
+			rsp.Answer = append(rsp.Answer, rr)
+		}
+	}
+
+	if len(rsp.Answer) > 0 {
+		return rsp
+	}
+
+	if !nameExists {
+		rsp.Rcode = dns.RcodeNameError
+	}
+	rsp.Ns = []dns.RR{z.soa}
+
+	return rsp
+}
+
+// delegation returns the NS records of the closest child zone cut above name, if any.
+func (z *Zone) delegation(name string) []dns.RR {
+	var (
+		cut string
+		ns  []dns.RR
+	)
+
+	for _, rr := range z.records {
+		owner := rr.Header().Name
+		if rr.Header().Rrtype != dns.TypeNS || strings.EqualFold(owner, z.Name) || !dns.IsSubDomain(owner, name) {
+			continue
+		}
+
+		if len(owner) > len(cut) {
+			cut, ns = owner, nil
+		}
+		if strings.EqualFold(owner, cut) {
+			ns = append(ns, rr)
+		}
+	}
+
+	return ns
+}
+
+func (z *Zone) glue(ns []dns.RR) []dns.RR {
+	var glue []dns.RR
+	for _, rr := range ns {
+		target := rr.(*dns.NS).Ns
+		for _, record := range z.records {
+			if rrtype := record.Header().Rrtype; (rrtype == dns.TypeA || rrtype == dns.TypeAAAA) && strings.EqualFold(record.Header().Name, target) {
+				glue = append(glue, record)
+			}
+		}
+	}
+	return glue
+}
+
+// below reports whether name is strictly below owner.
+func below(name, owner string) bool {
+	return !strings.EqualFold(name, owner) && dns.IsSubDomain(owner, name)
+}
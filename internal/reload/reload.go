@@ -0,0 +1,26 @@
+package reload
+
+import (
+	"fmt"
+
+	"github.com/fudanchii/ssh2dns/internal/log"
+)
+
+// Reloader is implemented by subsystems that can re-read their
+// configuration or backing files at runtime, e.g. on SIGHUP.
+// Reload should log what actually changed.
+type Reloader interface {
+	Name() string
+	Reload() error
+}
+
+// All reloads every given subsystem in order, a failing reload
+// is logged and does not prevent the rest from reloading.
+func All(reloaders ...Reloader) {
+	for _, r := range reloaders {
+		log.Info("reloading " + r.Name() + "...")
+		if err := r.Reload(); err != nil {
+			log.Err(fmt.Sprintf("cannot reload %s: %s", r.Name(), err.Error()))
+		}
+	}
+}
@@ -7,83 +7,300 @@ import (
 	"net"
 	"os"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
 
 	"github.com/fudanchii/ssh2dns/internal/config"
 	"github.com/fudanchii/ssh2dns/internal/errors"
 	"github.com/fudanchii/ssh2dns/internal/log"
+	"github.com/fudanchii/ssh2dns/internal/metrics"
 	"github.com/fudanchii/ssh2dns/internal/recdns"
+	"github.com/fudanchii/ssh2dns/internal/tracing"
 	"github.com/jackc/puddle/v2"
 	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+	"golang.org/x/sync/semaphore"
 )
 
 const (
 	maxErrThreshold = 5
+
+	// lifetimeJitter is the largest fraction taken off -max-lifetime for a single connection,
+	// so those made together at startup are not all recycled at once.
+	lifetimeJitter = 0.2
+
+	// maxStartupBackoff caps the wait between attempts at the first connection with -wait-for-upstream.
+	maxStartupBackoff = 30 * time.Second
 )
 
 var (
 	errResetErrCount = fmt.Errorf("reset")
-	errReconnecting  = fmt.Errorf("reconnecting")
 )
 
 type Client struct {
 	*ssh.Client
+	hops        []*ssh.Client
 	errLoopBack chan<- error
+
+	// sessions bounds the channels opened at once over this client,
+	// so we stay within the server's MaxSessions, nil means unbounded.
+	sessions *semaphore.Weighted
+
+	// dialTimeout bounds opening a channel on top of the caller's context, 0 means unbounded.
+	dialTimeout time.Duration
+
+	// conns keeps connections open between exchanges, nil when -keepalive is 0.
+	conns *connCache
+
+	// maxMsgSize bounds the replies read from upstream servers.
+	maxMsgSize int
+}
+
+// sessionConn releases its session slot once closed.
+type sessionConn struct {
+	net.Conn
+	release func()
+	once    sync.Once
+}
+
+func (sc *sessionConn) Close() error {
+	sc.once.Do(sc.release)
+	return sc.Conn.Close()
+}
+
+func (cli *Client) Close() error {
+	cli.conns.closeAll()
+	err := cli.Client.Close()
+	closeClients(cli.hops)
+	return err
+}
+
+type dialResult struct {
+	conn net.Conn
+	err  error
 }
 
 func (cli *Client) DialTCPWithContext(ctx context.Context, addr string) (net.Conn, error) {
 	var (
-		errResultChannel chan error    = make(chan error, 1)
-		connChannel      chan net.Conn = make(chan net.Conn, 1)
+		resultChannel chan dialResult = make(chan dialResult, 1)
 	)
 
 	if ctx.Err() != nil {
 		return nil, ctx.Err()
 	}
 
+	if cli.dialTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, cli.dialTimeout)
+		defer cancel()
+	}
+
+	release := func() {}
+	if cli.sessions != nil {
+		if err := cli.sessions.Acquire(ctx, 1); err != nil {
+			return nil, errors.SessionsBusy{}
+		}
+		release = func() { cli.sessions.Release(1) }
+	}
+
 	go func() {
 		conn, err := cli.Dial("tcp", addr)
 		if err != nil {
-			errResultChannel <- err
+			release()
+			// the connection from the ssh server to addr failed, other addresses may well work
+			var openErr *ssh.OpenChannelError
+			if errors.As(err, &openErr) && openErr.Reason == ssh.ConnectionFailed {
+				err = errors.ServerUnreachable{Addr: addr, Reason: openErr.Message}
+			}
+			resultChannel <- dialResult{err: err}
 			return
 		}
-		connChannel <- conn
+		resultChannel <- dialResult{conn: &sessionConn{Conn: conn, release: release}}
 	}()
 
 	select {
 	case <-ctx.Done():
+		// the dial itself can't be cancelled, close the connection if it still completes
+		go func() {
+			if result := <-resultChannel; result.conn != nil {
+				result.conn.Close()
+			}
+		}()
 		return nil, errors.ConnectionTimeout{}
-	case err := <-errResultChannel:
-		return nil, err
-	case conn := <-connChannel:
-		return conn, nil
+	case result := <-resultChannel:
+		return result.conn, result.err
 	}
 }
 
-func createNewClient(cfg *config.AppConfig, signer ssh.Signer, echan chan<- error) puddle.Constructor[recdns.DNSClient] {
+// createNewClient dials with whatever signers returns at the time, so reloaded keys apply to new connections.
+func createNewClient(cfg *config.AppConfig, signers func() []ssh.Signer, echan chan<- error) puddle.Constructor[recdns.DNSClient] {
 	return func(_ context.Context) (recdns.DNSClient, error) {
-		client, err := ssh.Dial("tcp", cfg.RemoteAddr(), &ssh.ClientConfig{
-			User:            cfg.RemoteUser(),
-			Auth:            []ssh.AuthMethod{ssh.PublicKeys(signer)},
-			HostKeyCallback: safeHostKeyCallback(cfg),
-			HostKeyAlgorithms: []string{
-				"ssh-ed25519",
-				"ecdsa-sha2-nistp521",
-				"ecdsa-sha2-nistp384",
-				"ecdsa-sha2-nistp256",
-				"ssh-rsa",
-			},
-		})
+		client, hops, err := dialChain(cfg, signers())
 		if err != nil {
 			return nil, err
 		}
 
 		log.Info("connected to " + cfg.RemoteAddr())
-		return &Client{
+		cli := &Client{
 			Client:      client,
+			hops:        hops,
 			errLoopBack: echan,
-		}, nil
+			dialTimeout: connTimeout(cfg),
+			conns:       newConnCache(cfg.KeepAlive(), cfg.MaxSessions()),
+			maxMsgSize:  cfg.MaxMsgSize(),
+		}
+		if cfg.MaxSessions() > 0 {
+			cli.sessions = semaphore.NewWeighted(int64(cfg.MaxSessions()))
+		}
+		return cli, nil
+	}
+}
+
+type hop struct {
+	user string
+	addr string
+}
+
+func parseHop(spec, defaultUser string) hop {
+	h := hop{user: defaultUser, addr: spec}
+
+	if idx := strings.LastIndex(spec, "@"); idx >= 0 {
+		h.user, h.addr = spec[:idx], spec[idx+1:]
+	}
+
+	if _, _, err := net.SplitHostPort(h.addr); err != nil {
+		h.addr = net.JoinHostPort(strings.Trim(h.addr, "[]"), "22")
+	}
+
+	return h
+}
+
+func clientConfig(cfg *config.AppConfig, h hop, signers []ssh.Signer) *ssh.ClientConfig {
+	return &ssh.ClientConfig{
+		Timeout:         connTimeout(cfg),
+		User:            h.user,
+		Auth:            []ssh.AuthMethod{ssh.PublicKeys(signers...)},
+		HostKeyCallback: safeHostKeyCallback(cfg, h.addr),
+		HostKeyAlgorithms: []string{
+			"ssh-ed25519",
+			"ecdsa-sha2-nistp521",
+			"ecdsa-sha2-nistp384",
+			"ecdsa-sha2-nistp256",
+			"ssh-rsa",
+		},
+	}
+}
+
+// dialChain connects to the ssh server through each configured jump host in order,
+// every hop is dialed over the previous hop's connection.
+// It returns the final client, and the intermediate hop clients which must be closed along with it.
+func dialChain(cfg *config.AppConfig, signers []ssh.Signer) (*ssh.Client, []*ssh.Client, error) {
+	var (
+		client *ssh.Client
+		err    error
+		chain  []hop
+	)
+
+	for _, spec := range cfg.JumpHosts() {
+		chain = append(chain, parseHop(spec, cfg.RemoteUser()))
+	}
+	chain = append(chain, hop{user: cfg.RemoteUser(), addr: cfg.RemoteAddr()})
+
+	clients := make([]*ssh.Client, 0, len(chain))
+	for _, h := range chain {
+		var conn net.Conn
+
+		if client == nil {
+			conn, err = dialFirstHop(cfg, h.addr)
+		} else {
+			conn, err = client.Dial("tcp", h.addr)
+		}
+
+		if err == nil {
+			client, err = handshake(conn, h, clientConfig(cfg, h, signers), signers)
+		}
+
+		if err != nil {
+			closeClients(clients)
+			return nil, nil, fmt.Errorf("cannot connect to %s: %w", h.addr, err)
+		}
+
+		clients = append(clients, client)
+	}
+
+	return client, clients[:len(clients)-1], nil
+}
+
+// handshake establishes the ssh connection over conn, giving up after the configured timeout.
+// Channels tunneled through a jump host don't support deadlines,
+// so the connection is closed instead to unblock the handshake.
+func handshake(conn net.Conn, h hop, sshCfg *ssh.ClientConfig, signers []ssh.Signer) (*ssh.Client, error) {
+	if sshCfg.Timeout > 0 {
+		timer := time.AfterFunc(sshCfg.Timeout, func() { conn.Close() })
+		defer timer.Stop()
+	}
+
+	// remember why the server was refused, crypto/ssh only tells the handshake failed
+	var (
+		banner     string
+		hostKeyErr error
+	)
+	sshCfg.BannerCallback = func(msg string) error {
+		banner = strings.TrimSpace(msg)
+		return nil
+	}
+	verify := sshCfg.HostKeyCallback
+	sshCfg.HostKeyCallback = func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		hostKeyErr = verify(hostname, remote, key)
+		return hostKeyErr
+	}
+
+	c, chans, reqs, err := ssh.NewClientConn(conn, h.addr, sshCfg)
+	if err != nil {
+		conn.Close()
+		return nil, authError(h, err, hostKeyErr, banner, signers)
+	}
+
+	return ssh.NewClient(c, chans, reqs), nil
+}
+
+// authError tells a rejected host key or user key apart from network errors, which are returned as is.
+func authError(h hop, err, hostKeyErr error, banner string, signers []ssh.Signer) error {
+	authErr := errors.SSHAuthFailed{User: h.user, Addr: h.addr, Banner: banner, Err: err}
+
+	switch {
+	case hostKeyErr != nil:
+		authErr.Reason = "host key rejected"
+		authErr.Err = hostKeyErr
+	case strings.Contains(err.Error(), "unable to authenticate"):
+		authErr.Reason = "no offered key accepted"
+		for _, signer := range signers {
+			pk := signer.PublicKey()
+			authErr.Keys = append(authErr.Keys, pk.Type()+" "+ssh.FingerprintSHA256(pk))
+		}
+	default:
+		return err
+	}
+
+	return authErr
+}
+
+func connTimeout(cfg *config.AppConfig) time.Duration {
+	return time.Duration(cfg.ConnTimeout()) * time.Second
+}
+
+// connContext bounds connecting to the ssh server by -t, if set.
+func connContext(cfg *config.AppConfig) (context.Context, context.CancelFunc) {
+	if timeout := connTimeout(cfg); timeout > 0 {
+		return context.WithTimeout(context.TODO(), timeout)
+	}
+	return context.WithCancel(context.TODO())
+}
+
+func closeClients(clients []*ssh.Client) {
+	for i := len(clients) - 1; i >= 0; i-- {
+		clients[i].Close()
 	}
 }
 
@@ -94,6 +311,31 @@ func dropClient(cli recdns.DNSClient) {
 	}
 }
 
+// newSigners loads every readable private key in pkfiles, in order.
+// Keys failing to load are skipped, as long as at least one of them loads.
+func newSigners(pkfiles []string) ([]ssh.Signer, error) {
+	var (
+		signers []ssh.Signer
+		lastErr error = fmt.Errorf("no identity file given")
+	)
+
+	for _, pkfile := range pkfiles {
+		signer, err := newSigner(pkfile)
+		if err != nil {
+			log.Err(fmt.Sprintf("skipping identity file %s: %s", pkfile, err.Error()))
+			lastErr = err
+			continue
+		}
+		signers = append(signers, signer)
+	}
+
+	if len(signers) == 0 {
+		return nil, lastErr
+	}
+
+	return signers, nil
+}
+
 func newSigner(pkfile string) (ssh.Signer, error) {
 	pk, err := os.ReadFile(pkfile)
 	if err != nil {
@@ -109,61 +351,136 @@ func newSigner(pkfile string) (ssh.Signer, error) {
 }
 
 type ClientPool struct {
-	pool         *puddle.Pool[recdns.DNSClient]
+	pool         atomic.Pointer[puddle.Pool[recdns.DNSClient]]
 	config       *config.AppConfig
-	signer       ssh.Signer
 	errCounter   atomic.Uint32
 	reconnecting atomic.Bool
+
+	// swapping is set while a standby pool is connecting to replace this one,
+	// swapMu keeps Close from missing the pool swapped in
+	swapping atomic.Bool
+	swapMu   sync.Mutex
+
+	// echan takes the exchange errors of every connection, whichever pool it is from
+	echan chan error
+
+	// signers is read by the pool constructor and replaced on reload
+	signersMu sync.RWMutex
+	signers   []ssh.Signer
+
+	// warm wakes the spare connection maintainer, done stops it
+	warm      chan struct{}
+	done      chan struct{}
+	closeOnce sync.Once
 }
 
 func NewClientPool(cfg *config.AppConfig) (recdns.DNSClientPool, error) {
-	signer, err := newSigner(cfg.PrivKeyFile())
+	signers, err := newSigners(cfg.PrivKeyFiles())
 	if err != nil {
 		return nil, err
 	}
 
-	echan := make(chan error, maxErrThreshold)
-
-	ppool, err := puddle.NewPool(&puddle.Config[recdns.DNSClient]{
-		Constructor: createNewClient(cfg, signer, echan),
-		Destructor:  dropClient,
-		MaxSize:     int32(cfg.WorkerNum()),
-	})
+	cp := &ClientPool{
+		signers:      signers,
+		config:       cfg,
+		errCounter:   atomic.Uint32{},
+		reconnecting: atomic.Bool{},
+		echan:        make(chan error, maxErrThreshold),
+		warm:         make(chan struct{}, 1),
+		done:         make(chan struct{}),
+	}
 
+	ppool, err := cp.newPool()
 	if err != nil {
 		return nil, err
 	}
 
-	initCtx, cancel := context.WithTimeout(context.TODO(), recdns.DefaultTimeout)
-	defer cancel()
-
 	// try connecting first, bailout if we can't connect at init
-	cli, err := ppool.Acquire(initCtx)
-	if err != nil {
+	if err := connectFirst(cfg, ppool); err != nil {
 		return nil, err
 	}
-	cli.Release()
 
-	cp := &ClientPool{
-		pool:         ppool,
-		signer:       signer,
-		config:       cfg,
-		errCounter:   atomic.Uint32{},
-		reconnecting: atomic.Bool{},
-	}
+	cp.pool.Store(ppool)
 
-	go cp.trackErrLoopback(echan)
+	go cp.trackErrLoopback()
+
+	if minIdle := cfg.MinIdle(); minIdle > 0 {
+		go cp.keepWarm(minIdle)
+		cp.wake()
+	}
 
 	return cp, nil
 }
 
-func (cp *ClientPool) trackErrLoopback(echan <-chan error) {
-	var (
-		sleepDuration time.Duration = 3 * time.Second
-	)
+// connectFirst makes the first connection of ppool, trying again with backoff for up to -wait-for-upstream
+// while the ssh server is unreachable, e.g. still booting. Rejected keys don't get any better by waiting.
+func connectFirst(cfg *config.AppConfig, ppool *puddle.Pool[recdns.DNSClient]) error {
+	deadline := time.Now().Add(cfg.WaitForUpstream())
+	backoff := time.Second
+
+	for {
+		initCtx, cancel := connContext(cfg)
+		cli, err := ppool.Acquire(initCtx)
+		cancel()
+		if err == nil {
+			cli.Release()
+			return nil
+		}
 
-	for err := range echan {
-		if cp.reconnecting.Load() {
+		if errors.As(err, new(errors.SSHAuthFailed)) || time.Now().Add(backoff).After(deadline) {
+			return err
+		}
+
+		log.Err(fmt.Sprintf("cannot connect yet, trying again in %s: %s", backoff, err.Error()))
+		time.Sleep(backoff)
+		backoff = min(backoff*2, maxStartupBackoff)
+	}
+}
+
+// newPool makes a pool of ssh connections, each connecting on first use.
+func (cp *ClientPool) newPool() (*puddle.Pool[recdns.DNSClient], error) {
+	return puddle.NewPool(&puddle.Config[recdns.DNSClient]{
+		Constructor: createNewClient(cp.config, cp.currentSigners, cp.echan),
+		Destructor:  dropClient,
+		MaxSize:     int32(cp.config.WorkerNum()),
+	})
+}
+
+func (cp *ClientPool) currentSigners() []ssh.Signer {
+	cp.signersMu.RLock()
+	defer cp.signersMu.RUnlock()
+	return cp.signers
+}
+
+func (cp *ClientPool) Name() string {
+	return "ssh identities"
+}
+
+// Reload reads the identity files again, connections made from now on authenticate with the new keys.
+// Live connections keep going until they are recycled. The old keys stay when none of the files load.
+func (cp *ClientPool) Reload() error {
+	signers, err := newSigners(cp.config.PrivKeyFiles())
+	if err != nil {
+		return err
+	}
+
+	cp.signersMu.Lock()
+	cp.signers = signers
+	cp.signersMu.Unlock()
+
+	return nil
+}
+
+// Reset closes every ssh connection, idle ones at once and those in use once released,
+// the following lookups connect anew.
+func (cp *ClientPool) Reset() {
+	log.Info("resetting ssh connections...")
+	cp.pool.Load().Reset()
+}
+
+func (cp *ClientPool) trackErrLoopback() {
+	for err := range cp.echan {
+		if cp.swapping.Load() {
 			continue
 		}
 
@@ -173,48 +490,189 @@ func (cp *ClientPool) trackErrLoopback(echan <-chan error) {
 		}
 
 		cp.errCounter.Add(1)
-		if cp.errCounter.Load() >= maxErrThreshold {
-			go func() {
-				log.Info("error threshold reached, reset connection pool...")
-				cp.pool.Reset()
-				cp.reconnecting.Store(true)
-
-				// try reconnect
-				for {
-					log.Info("reconnecting...")
-					ctx, cancel := context.WithTimeout(context.TODO(), recdns.DefaultTimeout)
-					cli, err := cp.pool.Acquire(ctx)
-					cancel()
-
-					if err == nil {
-						cli.Release()
-						cp.reconnecting.Store(false)
-						log.Info("reconnected!")
-						cp.errCounter.Store(0)
-						break
-					}
+		if cp.errCounter.Load() >= maxErrThreshold && cp.swapping.CompareAndSwap(false, true) {
+			go cp.swapPool()
+		}
+	}
+}
 
-					log.Err(fmt.Sprintf("error when reconnecting: %s", err.Error()))
-					time.Sleep(sleepDuration)
-				}
-			}()
+// swapPool replaces the pool with a fresh one once that one is connected,
+// lookups keep going over the old connections meanwhile. Only when the fresh pool cannot connect either,
+// the ssh server itself being unreachable, are lookups turned away until it does.
+// The old pool is drained in the background, connections in use finish their exchange first.
+func (cp *ClientPool) swapPool() {
+	var (
+		sleepDuration time.Duration = 3 * time.Second
+	)
+
+	defer cp.swapping.Store(false)
+
+	log.Info("error threshold reached, connecting a standby pool...")
+	fresh, err := cp.newPool()
+	if err != nil {
+		log.Err(fmt.Sprintf("cannot create a standby pool: %s", err.Error()))
+		return
+	}
+
+	for {
+		ctx, cancel := connContext(cp.config)
+		cli, err := fresh.Acquire(ctx)
+		cancel()
+
+		if err == nil {
+			cli.Release()
+			break
 		}
+
+		log.Err(fmt.Sprintf("error when connecting the standby pool: %s", err.Error()))
+		cp.reconnecting.Store(true)
+
+		select {
+		case <-cp.done:
+			fresh.Close()
+			return
+		case <-time.After(sleepDuration):
+		}
+		log.Info("reconnecting...")
+	}
+
+	cp.swapMu.Lock()
+	select {
+	case <-cp.done:
+		cp.swapMu.Unlock()
+		fresh.Close()
+		return
+	default:
 	}
+	old := cp.pool.Swap(fresh)
+	cp.swapMu.Unlock()
+
+	cp.errCounter.Store(0)
+	cp.reconnecting.Store(false)
+	log.Info("switched to the standby pool!")
+	cp.wake()
+
+	go old.Close()
 }
 
-func (cp *ClientPool) Acquire(ctx context.Context) (recdns.PoolItemWrapper[recdns.DNSClient], error) {
+func (cp *ClientPool) Acquire(ctx context.Context) (_ recdns.PoolItemWrapper[recdns.DNSClient], err error) {
+	ctx, span := tracing.Start(ctx, "ssh.pool.acquire")
+	defer func() { tracing.End(span, err) }()
+
 	if cp.reconnecting.Load() {
 		log.Info("cannot acquire new connection, wait until reconnected...")
-		return nil, errReconnecting
+		return nil, errors.PoolReconnecting{}
 	}
-	return cp.pool.Acquire(ctx)
+
+	for {
+		pool := cp.pool.Load()
+		start := time.Now()
+		res, bounded, err := cp.acquireFrom(ctx, pool)
+		metrics.AcquireWait.Observe(time.Since(start))
+		if err != nil {
+			// swapped out while we were at it, the pool in its place has connections for us
+			if errors.Is(err, puddle.ErrClosedPool) && cp.pool.Load() != pool {
+				continue
+			}
+			if bounded && ctx.Err() == nil && errors.Is(err, context.DeadlineExceeded) {
+				metrics.PoolExhausted.Add(1)
+				return nil, errors.PoolExhausted{Wait: cp.config.AcquireTimeout()}
+			}
+			return nil, err
+		}
+
+		if !cp.stale(res) {
+			cp.wake()
+			return res, nil
+		}
+
+		// destroyed resource will be reconstructed on the next Acquire
+		res.Destroy()
+	}
+}
+
+// acquireFrom takes a connection from pool, waiting at most -acquire-timeout for one to be released
+// when all of them are in use, so lookups fail fast under load instead of queueing indefinitely.
+// A connection idle or yet to be made is not waited for, making one is bounded by -t instead.
+// It tells whether the wait was bounded, another lookup taking the last free connection first
+// leaves it to the lookup deadline.
+func (cp *ClientPool) acquireFrom(ctx context.Context, pool *puddle.Pool[recdns.DNSClient]) (*puddle.Resource[recdns.DNSClient], bool, error) {
+	wait := cp.config.AcquireTimeout()
+	if stat := pool.Stat(); wait <= 0 || stat.AcquiredResources() < stat.MaxResources() {
+		res, err := pool.Acquire(ctx)
+		return res, false, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, wait)
+	defer cancel()
+	res, err := pool.Acquire(ctx)
+	return res, true, err
+}
+
+// stale reports whether the client outlived its configured lifetime or idle time.
+func (cp *ClientPool) stale(res *puddle.Resource[recdns.DNSClient]) bool {
+	if lifetime := cp.config.MaxConnLifetime(); lifetime > 0 && time.Since(res.CreationTime()) > jitterLifetime(lifetime, res.CreationTime()) {
+		return true
+	}
+
+	if idle := cp.config.MaxConnIdleTime(); idle > 0 && res.IdleDuration() > idle {
+		return true
+	}
+
+	return false
+}
+
+// jitterLifetime shortens lifetime by up to lifetimeJitter of it, never lengthening it past -max-lifetime.
+// The amount comes from the creation time, so it stays the same for the whole life of a connection
+// while connections made even microseconds apart get different ones.
+func jitterLifetime(lifetime time.Duration, created time.Time) time.Duration {
+	frac := float64(uint64(created.UnixNano())/uint64(time.Microsecond)%1000) / 1000
+	return lifetime - time.Duration(float64(lifetime)*lifetimeJitter*frac)
+}
+
+// PoolStat is a snapshot of the connection pool, for diagnostics.
+type PoolStat struct {
+	Total        int32
+	Idle         int32
+	Acquired     int32
+	Constructing int32
+	MaxSize      int32
+	ErrCount     uint32
+	Reconnecting bool
+}
+
+func (s PoolStat) String() string {
+	return fmt.Sprintf(
+		"connections: total=%d/%d idle=%d acquired=%d constructing=%d, errors=%d/%d, reconnecting=%t",
+		s.Total, s.MaxSize, s.Idle, s.Acquired, s.Constructing, s.ErrCount, maxErrThreshold, s.Reconnecting,
+	)
+}
+
+func (cp *ClientPool) Stat() PoolStat {
+	stat := cp.pool.Load().Stat()
+	return PoolStat{
+		Total:        stat.TotalResources(),
+		Idle:         stat.IdleResources(),
+		Acquired:     stat.AcquiredResources(),
+		Constructing: stat.ConstructingResources(),
+		MaxSize:      stat.MaxResources(),
+		ErrCount:     cp.errCounter.Load(),
+		Reconnecting: cp.reconnecting.Load(),
+	}
+}
+
+func (cp *ClientPool) String() string {
+	return cp.Stat().String()
 }
 
 func (cp *ClientPool) Close() {
-	cp.pool.Close()
+	cp.swapMu.Lock()
+	cp.closeOnce.Do(func() { close(cp.done) })
+	cp.swapMu.Unlock()
+	cp.pool.Load().Close()
 }
 
-func safeHostKeyCallback(cfg *config.AppConfig) ssh.HostKeyCallback {
+func safeHostKeyCallback(cfg *config.AppConfig, addr string) ssh.HostKeyCallback {
 	var (
 		err    error
 		hk     []byte
@@ -240,7 +698,7 @@ func safeHostKeyCallback(cfg *config.AppConfig) ssh.HostKeyCallback {
 			}
 
 			if err == io.EOF {
-				err = fmt.Errorf("No valid key found for host: " + cfg.RemoteAddr())
+				err = fmt.Errorf("No valid key found for host: " + addr)
 				goto bailOut
 			}
 
@@ -249,14 +707,12 @@ func safeHostKeyCallback(cfg *config.AppConfig) ssh.HostKeyCallback {
 			}
 
 			for _, host := range hosts {
-				host = strings.ReplaceAll(host, "[", "")
-				host = strings.ReplaceAll(host, "]", "")
-				if host == cfg.RemoteAddr() ||
-					(host+":22") == cfg.RemoteAddr() {
+				// known_hosts leaves out port 22 and brackets any other, v6 addresses included
+				if knownhosts.Normalize(host) == knownhosts.Normalize(addr) {
 					if marker == "revoked" {
 						err = fmt.Errorf(
 							"found valid key for %s, but the key has been revoked",
-							cfg.RemoteAddr(),
+							addr,
 						)
 						goto bailOut
 					}
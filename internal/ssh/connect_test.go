@@ -0,0 +1,76 @@
+package ssh
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/fudanchii/ssh2dns/internal/config"
+	"github.com/fudanchii/ssh2dns/internal/errors"
+	"github.com/fudanchii/ssh2dns/internal/recdns"
+	"github.com/jackc/puddle/v2"
+	"github.com/miekg/dns"
+)
+
+type nopClient struct{}
+
+func (nopClient) ExchangeWithContext(context.Context, *dns.Msg, string) (*dns.Msg, error) {
+	return nil, nil
+}
+
+func (nopClient) Close() error { return nil }
+
+// newSlowPool is a pool of one connection taking connect long to make.
+func newSlowPool(t *testing.T, acquireTimeout string, connect time.Duration) *ClientPool {
+	t.Helper()
+	cfg, err := config.NewFromOptions(config.Options{"acquire-timeout": acquireTimeout})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pool, err := puddle.NewPool(&puddle.Config[recdns.DNSClient]{
+		Constructor: func(context.Context) (recdns.DNSClient, error) {
+			time.Sleep(connect)
+			return nopClient{}, nil
+		},
+		Destructor: func(recdns.DNSClient) {},
+		MaxSize:    1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(pool.Close)
+
+	cp := &ClientPool{config: cfg}
+	cp.pool.Store(pool)
+	return cp
+}
+
+func TestAcquireTimeoutSparesNewConnections(t *testing.T) {
+	cp := newSlowPool(t, "100ms", 300*time.Millisecond)
+
+	item, err := cp.Acquire(context.Background())
+	if err != nil {
+		t.Fatalf("connecting slower than -acquire-timeout failed the acquire: %v", err)
+	}
+	item.Release()
+}
+
+func TestAcquireTimeoutBoundsWaitForBusyPool(t *testing.T) {
+	cp := newSlowPool(t, "100ms", 0)
+
+	held, err := cp.Acquire(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer held.Release()
+
+	start := time.Now()
+	_, err = cp.Acquire(context.Background())
+	if !errors.As(err, new(errors.PoolExhausted)) {
+		t.Fatalf("err = %v, want PoolExhausted", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("gave up after %s, want about -acquire-timeout", elapsed)
+	}
+}
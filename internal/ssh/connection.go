@@ -12,14 +12,19 @@ import (
 
 type Connection struct {
 	net.Conn
+
+	// MaxMsgSize bounds the length a reply may announce, 0 allows up to the 65535 bytes of the framing.
+	MaxMsgSize int
 }
 
+// ReadMsgWithContext reads a reply until ctx is done. The connection is then closed,
+// unblocking the pending read, ssh channels have no deadline to do that, so it is unusable afterwards.
 func (pc *Connection) ReadMsgWithContext(ctx context.Context) (*dns.Msg, error) {
 	errChan := make(chan error, 1)
 	msgChan := make(chan *dns.Msg, 1)
 
 	go func() {
-		msg, err := pc.ReadMsg()
+		msg, err := pc.readMsg(ctx)
 		if err != nil {
 			errChan <- err
 			return
@@ -30,6 +35,7 @@ func (pc *Connection) ReadMsgWithContext(ctx context.Context) (*dns.Msg, error)
 
 	select {
 	case <-ctx.Done():
+		pc.Close()
 		return nil, errors.ConnectionTimeout{}
 	case err := <-errChan:
 		return nil, err
@@ -40,7 +46,11 @@ func (pc *Connection) ReadMsgWithContext(ctx context.Context) (*dns.Msg, error)
 
 // https://github.com/miekg/dns/blob/164b22ef9acc6ebfaef7169ab51caaef67390823/client.go#L191
 func (pc *Connection) ReadMsg() (*dns.Msg, error) {
-	p, err := pc.ReadMsgHdr(nil)
+	return pc.readMsg(context.Background())
+}
+
+func (pc *Connection) readMsg(ctx context.Context) (*dns.Msg, error) {
+	p, err := pc.readMsgHdr(ctx)
 
 	if err != nil {
 		return nil, err
@@ -60,18 +70,29 @@ func (pc *Connection) ReadMsg() (*dns.Msg, error) {
 
 // https://github.com/miekg/dns/blob/164b22ef9acc6ebfaef7169ab51caaef67390823/client.go#L217
 func (pc *Connection) ReadMsgHdr(h *dns.Header) ([]byte, error) {
-	l, err := tcpMsgLen(pc)
+	return pc.readMsgHdr(context.Background())
+}
+
+// readMsgHdr reads a length prefixed message, refusing lengths over MaxMsgSize before allocating anything,
+// and giving up between reads once ctx is done.
+func (pc *Connection) readMsgHdr(ctx context.Context) ([]byte, error) {
+	l, err := tcpMsgLen(ctx, pc)
 
 	if err != nil {
 		return nil, err
 	}
 
+	if pc.MaxMsgSize > 0 && l > pc.MaxMsgSize {
+		return nil, errors.MessageTooLarge{Len: l, Max: pc.MaxMsgSize}
+	}
+
 	p := make([]byte, l)
-	_, err = tcpRead(pc, p)
+	_, err = tcpRead(ctx, pc, p)
 
 	return p, err
 }
 
+// WriteMsgWithContext writes msg until ctx is done, then closes the connection like ReadMsgWithContext.
 func (pc *Connection) WriteMsgWithContext(ctx context.Context, msg *dns.Msg) error {
 	errChan := make(chan error, 1)
 	go func() {
@@ -80,6 +101,7 @@ func (pc *Connection) WriteMsgWithContext(ctx context.Context, msg *dns.Msg) err
 
 	select {
 	case <-ctx.Done():
+		pc.Close()
 		return errors.ConnectionTimeout{}
 	case err := <-errChan:
 		return err
@@ -113,40 +135,31 @@ func (pc *Connection) Write(buff []byte) (int, error) {
 
 // https://github.com/miekg/dns/blob/164b22ef9acc6ebfaef7169ab51caaef67390823/client.go#L262
 // tcpMsgLen is a helper func to read first two bytes of stream as uint16 packet length.
-func tcpMsgLen(t io.Reader) (int, error) {
+// As seen with some routers, the two bytes may come in separate reads.
+func tcpMsgLen(ctx context.Context, t io.Reader) (int, error) {
 	p := []byte{0, 0}
-	n, err := t.Read(p)
-	if err != nil {
+	if _, err := tcpRead(ctx, t, p); err != nil {
 		return 0, err
 	}
 
-	// As seen with my local router/switch, returns 1 byte on the above read,
-	// resulting a a ShortRead. Just write it out (instead of loop) and read the
-	// other byte.
-	if n == 1 {
-		_, err := t.Read(p[1:])
-		if err != nil {
-			return 0, err
-		}
-	}
-
 	l := binary.BigEndian.Uint16(p)
 	return int(l), nil
 }
 
 // https://github.com/miekg/dns/blob/164b22ef9acc6ebfaef7169ab51caaef67390823/client.go#L291
-// tcpRead calls TCPConn.Read enough times to fill allocated buffer.
-func tcpRead(t io.Reader, p []byte) (int, error) {
-	n, err := t.Read(p)
-	if err != nil {
-		return n, err
-	}
+// tcpRead calls TCPConn.Read enough times to fill allocated buffer,
+// a server trickling bytes stops being waited for once ctx is done.
+func tcpRead(ctx context.Context, t io.Reader, p []byte) (int, error) {
+	n := 0
 	for n < len(p) {
+		if ctx.Err() != nil {
+			return n, errors.ConnectionTimeout{}
+		}
 		j, err := t.Read(p[n:])
+		n += j
 		if err != nil {
 			return n, err
 		}
-		n += j
 	}
-	return n, err
+	return n, nil
 }
@@ -0,0 +1,53 @@
+package ssh
+
+import (
+	"context"
+	"io"
+	"net"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/fudanchii/ssh2dns/internal/errors"
+	"github.com/miekg/dns"
+)
+
+func TestCanceledExchangesLeaveNoGoroutines(t *testing.T) {
+	const n = 50
+
+	base := runtime.NumGoroutine()
+
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		client, server := net.Pipe()
+		// the server reads the queries but never answers, as an upstream gone silent
+		go io.Copy(io.Discard, server)
+		t.Cleanup(func() { server.Close() })
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			ctx, cancel := context.WithCancel(context.Background())
+			time.AfterFunc(10*time.Millisecond, cancel)
+
+			req := new(dns.Msg)
+			req.SetQuestion("example.com.", dns.TypeA)
+			_, err := exchangeOn(ctx, &Connection{Conn: client}, req)
+			if !errors.Is(err, errors.ConnectionTimeout{}) {
+				t.Errorf("err = %v, want ConnectionTimeout", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	// the io.Copy goroutines return once their pipe is closed by the timeout too
+	deadline := time.Now().Add(2 * time.Second)
+	for runtime.NumGoroutine() > base && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got := runtime.NumGoroutine(); got > base {
+		t.Errorf("%d goroutines left behind by %d canceled exchanges", got-base, n)
+	}
+}
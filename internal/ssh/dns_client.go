@@ -2,12 +2,31 @@ package ssh
 
 import (
 	"context"
+	"fmt"
 
 	"github.com/fudanchii/ssh2dns/internal/errors"
 	"github.com/miekg/dns"
 )
 
+// ExchangeWithContext sends req to srv over a tunneled TCP connection,
+// ssh can only forward TCP streams so there is no UDP path to the upstream.
+// A connection kept from a previous exchange with srv is used first, if any.
 func (sshCli *Client) ExchangeWithContext(ctx context.Context, req *dns.Msg, srv string) (*dns.Msg, error) {
+	if dnsConn := sshCli.conns.get(srv); dnsConn != nil {
+		rspMsg, err := exchangeOn(ctx, dnsConn, req)
+		if err == nil {
+			sshCli.conns.put(srv, dnsConn)
+			go func() { sshCli.errLoopBack <- errResetErrCount }()
+			return rspMsg, nil
+		}
+
+		// the server may have closed the idle connection meanwhile, go on with a fresh one
+		dnsConn.Close()
+		if ctx.Err() != nil {
+			return nil, err
+		}
+	}
+
 	conn, err := sshCli.DialTCPWithContext(ctx, srv)
 	if err != nil {
 		retErr := errors.DNSDialErr{Cause: err}
@@ -15,19 +34,39 @@ func (sshCli *Client) ExchangeWithContext(ctx context.Context, req *dns.Msg, srv
 		return nil, retErr
 	}
 
-	defer conn.Close()
+	dnsConn := &Connection{Conn: conn, MaxMsgSize: sshCli.maxMsgSize}
+	rspMsg, err := exchangeOn(ctx, dnsConn, req)
+	if err != nil {
+		dnsConn.Close()
+		return nil, err
+	}
+
+	sshCli.conns.put(srv, dnsConn)
 
-	dnsConn := &Connection{Conn: conn}
-	if err = dnsConn.WriteMsgWithContext(ctx, req); err != nil {
+	go func() { sshCli.errLoopBack <- errResetErrCount }()
+
+	return rspMsg, nil
+}
+
+func exchangeOn(ctx context.Context, dnsConn *Connection, req *dns.Msg) (*dns.Msg, error) {
+	if err := dnsConn.WriteMsgWithContext(ctx, req); err != nil {
 		return nil, errors.DNSWriteErr{Cause: err}
 	}
 
 	rspMsg, err := dnsConn.ReadMsgWithContext(ctx)
 	if err != nil {
+		// the server will send the same next time, nothing for a retry to fix
+		var tooLarge errors.MessageTooLarge
+		if errors.As(err, &tooLarge) {
+			return nil, err
+		}
 		return nil, errors.DNSReadErr{Cause: err}
 	}
 
-	go func() { sshCli.errLoopBack <- errResetErrCount }()
+	// the stream is out of step with our queries, a reply to an abandoned one likely
+	if rspMsg.Id != req.Id {
+		return nil, errors.DNSReadErr{Cause: fmt.Errorf("reply id %d doesn't match query id %d", rspMsg.Id, req.Id)}
+	}
 
 	return rspMsg, nil
 }
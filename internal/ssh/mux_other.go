@@ -0,0 +1,15 @@
+//go:build !unix
+
+package ssh
+
+import (
+	"fmt"
+	"runtime"
+
+	"github.com/fudanchii/ssh2dns/internal/config"
+	"github.com/fudanchii/ssh2dns/internal/recdns"
+)
+
+func NewMuxClient(cfg *config.AppConfig) (recdns.DNSClient, error) {
+	return nil, fmt.Errorf("-control-path is not supported on %s", runtime.GOOS)
+}
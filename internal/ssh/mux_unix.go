@@ -0,0 +1,304 @@
+//go:build unix
+
+package ssh
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/fudanchii/ssh2dns/internal/config"
+	"github.com/fudanchii/ssh2dns/internal/errors"
+	"github.com/fudanchii/ssh2dns/internal/log"
+	"github.com/fudanchii/ssh2dns/internal/recdns"
+	"github.com/miekg/dns"
+)
+
+// OpenSSH multiplexing protocol, see PROTOCOL.mux in the OpenSSH sources.
+const (
+	muxProtocolVersion = 4
+
+	muxMsgHello          uint32 = 0x00000001
+	muxCAliveCheck       uint32 = 0x10000004
+	muxCNewStdioFwd      uint32 = 0x10000008
+	muxSPermissionDenied uint32 = 0x80000002
+	muxSFailure          uint32 = 0x80000003
+	muxSAlive            uint32 = 0x80000005
+	muxSSessionOpened    uint32 = 0x80000006
+
+	// muxMaxPacket bounds the replies read from the master, which are all short.
+	muxMaxPacket = 256 * 1024
+)
+
+// MuxClient tunnels exchanges through the ssh connection of a running OpenSSH ControlMaster,
+// so ssh2dns doesn't authenticate on its own. Every tunneled connection is a stdio forwarding,
+// as with ssh -W, over a control connection of its own, so the client is safe for concurrent use.
+type MuxClient struct {
+	path        string
+	dialTimeout time.Duration
+	conns       *connCache
+	maxMsgSize  int
+	requestID   atomic.Uint32
+}
+
+// NewMuxClient uses the ControlMaster listening on -control-path, failing if it doesn't answer.
+func NewMuxClient(cfg *config.AppConfig) (recdns.DNSClient, error) {
+	mc := &MuxClient{
+		path:        cfg.ControlPath(),
+		dialTimeout: connTimeout(cfg),
+		conns:       newConnCache(cfg.KeepAlive(), cfg.MaxSessions()),
+		maxMsgSize:  cfg.MaxMsgSize(),
+	}
+
+	ctx, cancel := connContext(cfg)
+	defer cancel()
+
+	pid, err := mc.aliveCheck(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("cannot use ssh control socket %s: %w", mc.path, err)
+	}
+	log.Info(fmt.Sprintf("using ssh control master %s (pid %d)", mc.path, pid))
+
+	return mc, nil
+}
+
+// ExchangeWithContext sends req to srv over a connection forwarded by the master,
+// reusing one kept from a previous exchange with srv first, if any.
+func (mc *MuxClient) ExchangeWithContext(ctx context.Context, req *dns.Msg, srv string) (*dns.Msg, error) {
+	if dnsConn := mc.conns.get(srv); dnsConn != nil {
+		rspMsg, err := exchangeOn(ctx, dnsConn, req)
+		if err == nil {
+			mc.conns.put(srv, dnsConn)
+			return rspMsg, nil
+		}
+
+		dnsConn.Close()
+		if ctx.Err() != nil {
+			return nil, err
+		}
+	}
+
+	conn, err := mc.dial(ctx, srv)
+	if err != nil {
+		return nil, errors.DNSDialErr{Cause: err}
+	}
+
+	dnsConn := &Connection{Conn: conn, MaxMsgSize: mc.maxMsgSize}
+	rspMsg, err := exchangeOn(ctx, dnsConn, req)
+	if err != nil {
+		dnsConn.Close()
+		return nil, err
+	}
+
+	mc.conns.put(srv, dnsConn)
+
+	return rspMsg, nil
+}
+
+func (mc *MuxClient) Close() error {
+	mc.conns.closeAll()
+	return nil
+}
+
+// aliveCheck asks the master for its pid, telling whether it is there at all.
+func (mc *MuxClient) aliveCheck(ctx context.Context) (uint32, error) {
+	ctrl, err := mc.control(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer ctrl.Close()
+
+	rid := mc.requestID.Add(1)
+	if err := writeMuxPacket(ctrl, muxCAliveCheck, rid); err != nil {
+		return 0, err
+	}
+
+	rsp, err := readMuxReply(ctrl, rid, muxSAlive)
+	if err != nil {
+		return 0, err
+	}
+	if len(rsp) < 4 {
+		return 0, fmt.Errorf("short alive reply from ssh control master")
+	}
+	return binary.BigEndian.Uint32(rsp), nil
+}
+
+// dial has the master open a direct-tcpip channel to addr. Its data goes through one end of a socket pair,
+// handed to the master as the stdin and stdout of the forwarding, we keep the other.
+func (mc *MuxClient) dial(ctx context.Context, addr string) (net.Conn, error) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return nil, err
+	}
+
+	if mc.dialTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, mc.dialTimeout)
+		defer cancel()
+	}
+
+	ctrl, err := mc.control(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := mc.stdioForward(ctrl, host, uint32(port))
+	if err != nil {
+		ctrl.Close()
+		return nil, err
+	}
+	ctrl.SetDeadline(time.Time{})
+
+	return conn, nil
+}
+
+func (mc *MuxClient) stdioForward(ctrl *net.UnixConn, host string, port uint32) (net.Conn, error) {
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM, 0)
+	if err != nil {
+		return nil, err
+	}
+	ours, theirs := os.NewFile(uintptr(fds[0]), "mux"), os.NewFile(uintptr(fds[1]), "mux")
+	// the master keeps a copy of its end once sent
+	defer theirs.Close()
+	defer ours.Close()
+
+	rid := mc.requestID.Add(1)
+	if err := writeMuxPacket(ctrl, muxCNewStdioFwd, rid, "", host, port); err != nil {
+		return nil, err
+	}
+	// once for stdin, once for stdout
+	for i := 0; i < 2; i++ {
+		if _, _, err := ctrl.WriteMsgUnix([]byte{0}, syscall.UnixRights(int(theirs.Fd())), nil); err != nil {
+			return nil, err
+		}
+	}
+
+	if _, err := readMuxReply(ctrl, rid, muxSSessionOpened); err != nil {
+		return nil, err
+	}
+
+	conn, err := net.FileConn(ours)
+	if err != nil {
+		return nil, err
+	}
+	return &muxConn{Conn: conn, ctrl: ctrl}, nil
+}
+
+// control opens a control connection to the master and exchanges the hello messages.
+func (mc *MuxClient) control(ctx context.Context) (*net.UnixConn, error) {
+	var d net.Dialer
+	c, err := d.DialContext(ctx, "unix", mc.path)
+	if err != nil {
+		return nil, err
+	}
+	ctrl := c.(*net.UnixConn)
+	if deadline, ok := ctx.Deadline(); ok {
+		ctrl.SetDeadline(deadline)
+	}
+
+	if err := writeMuxPacket(ctrl, muxMsgHello, uint32(muxProtocolVersion)); err != nil {
+		ctrl.Close()
+		return nil, err
+	}
+	typ, payload, err := readMuxPacket(ctrl)
+	if err == nil && typ != muxMsgHello {
+		err = fmt.Errorf("ssh control master sent message %#x instead of hello", typ)
+	}
+	if err == nil && (len(payload) < 4 || binary.BigEndian.Uint32(payload) != muxProtocolVersion) {
+		err = fmt.Errorf("ssh control master speaks an unsupported mux protocol version")
+	}
+	if err != nil {
+		ctrl.Close()
+		return nil, err
+	}
+
+	return ctrl, nil
+}
+
+// muxConn is the data end of a stdio forwarding, the master closes the channel
+// once its control connection goes away, so both are closed together.
+type muxConn struct {
+	net.Conn
+	ctrl *net.UnixConn
+	once sync.Once
+}
+
+func (mc *muxConn) Close() error {
+	err := mc.Conn.Close()
+	mc.once.Do(func() { mc.ctrl.Close() })
+	return err
+}
+
+// writeMuxPacket sends a message of type typ, fields are either uint32 or string.
+func writeMuxPacket(w io.Writer, typ uint32, fields ...interface{}) error {
+	payload := binary.BigEndian.AppendUint32(nil, typ)
+	for _, f := range fields {
+		switch v := f.(type) {
+		case uint32:
+			payload = binary.BigEndian.AppendUint32(payload, v)
+		case string:
+			payload = binary.BigEndian.AppendUint32(payload, uint32(len(v)))
+			payload = append(payload, v...)
+		}
+	}
+
+	_, err := w.Write(append(binary.BigEndian.AppendUint32(nil, uint32(len(payload))), payload...))
+	return err
+}
+
+// readMuxPacket reads one message, returning its type and what follows.
+func readMuxPacket(r io.Reader) (uint32, []byte, error) {
+	var hdr [4]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return 0, nil, err
+	}
+	n := binary.BigEndian.Uint32(hdr[:])
+	if n < 4 || n > muxMaxPacket {
+		return 0, nil, fmt.Errorf("bad packet length %d from ssh control master", n)
+	}
+
+	packet := make([]byte, n)
+	if _, err := io.ReadFull(r, packet); err != nil {
+		return 0, nil, err
+	}
+	return binary.BigEndian.Uint32(packet), packet[4:], nil
+}
+
+// readMuxReply reads the reply to request rid, returning what follows the request id when it is of type want.
+func readMuxReply(r io.Reader, rid, want uint32) ([]byte, error) {
+	typ, payload, err := readMuxPacket(r)
+	if err != nil {
+		return nil, err
+	}
+	if len(payload) < 4 || binary.BigEndian.Uint32(payload) != rid {
+		return nil, fmt.Errorf("ssh control master answered another request")
+	}
+	payload = payload[4:]
+
+	switch typ {
+	case want:
+		return payload, nil
+	case muxSPermissionDenied, muxSFailure:
+		reason := ""
+		if len(payload) >= 4 {
+			if n := binary.BigEndian.Uint32(payload); int(n) <= len(payload)-4 {
+				reason = string(payload[4 : 4+n])
+			}
+		}
+		return nil, fmt.Errorf("ssh control master refused: %s", reason)
+	default:
+		return nil, fmt.Errorf("unexpected message %#x from ssh control master", typ)
+	}
+}
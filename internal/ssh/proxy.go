@@ -0,0 +1,118 @@
+package ssh
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/fudanchii/ssh2dns/internal/config"
+	"golang.org/x/net/proxy"
+)
+
+// dialFirstHop opens the TCP connection to the first ssh server of the chain,
+// through -ssh-proxy when set. The hops after it are reached over ssh, the proxy isn't involved anymore.
+func dialFirstHop(cfg *config.AppConfig, addr string) (net.Conn, error) {
+	ctx := context.Background()
+	if timeout := connTimeout(cfg); timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	dialer := &net.Dialer{}
+
+	proxyURL := cfg.SSHProxy()
+	if proxyURL == nil {
+		return dialer.DialContext(ctx, "tcp", addr)
+	}
+
+	switch proxyURL.Scheme {
+	case config.ProxySOCKS5:
+		return dialSOCKS5(ctx, dialer, proxyURL, addr)
+	case config.ProxyHTTP:
+		return dialHTTPConnect(ctx, dialer, proxyURL, addr)
+	}
+
+	return nil, fmt.Errorf("unsupported -ssh-proxy scheme %s", proxyURL.Scheme)
+}
+
+func dialSOCKS5(ctx context.Context, dialer *net.Dialer, proxyURL *url.URL, addr string) (net.Conn, error) {
+	var auth *proxy.Auth
+	if proxyURL.User != nil {
+		password, _ := proxyURL.User.Password()
+		auth = &proxy.Auth{User: proxyURL.User.Username(), Password: password}
+	}
+
+	socks, err := proxy.SOCKS5("tcp", proxyURL.Host, auth, dialer)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := socks.(proxy.ContextDialer).DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("socks5 proxy %s: %w", proxyURL.Host, err)
+	}
+	return conn, nil
+}
+
+// dialHTTPConnect asks an HTTP proxy to CONNECT to addr, the returned connection then carries the ssh stream.
+func dialHTTPConnect(ctx context.Context, dialer *net.Dialer, proxyURL *url.URL, addr string) (net.Conn, error) {
+	conn, err := dialer.DialContext(ctx, "tcp", proxyURL.Host)
+	if err != nil {
+		return nil, fmt.Errorf("http proxy %s: %w", proxyURL.Host, err)
+	}
+
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: http.Header{},
+	}
+	if proxyURL.User != nil {
+		password, _ := proxyURL.User.Password()
+		credentials := base64.StdEncoding.EncodeToString([]byte(proxyURL.User.Username() + ":" + password))
+		req.Header.Set("Proxy-Authorization", "Basic "+credentials)
+	}
+
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("http proxy %s: %w", proxyURL.Host, err)
+	}
+
+	br := bufio.NewReader(conn)
+	rsp, err := http.ReadResponse(br, req)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("http proxy %s: %w", proxyURL.Host, err)
+	}
+	rsp.Body.Close()
+
+	if rsp.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, fmt.Errorf("http proxy %s refused to connect to %s: %s", proxyURL.Host, addr, rsp.Status)
+	}
+
+	conn.SetDeadline(time.Time{})
+
+	// the ssh server speaks first, its version line may already be buffered along with the proxy reply
+	return &bufferedConn{Conn: conn, r: br}, nil
+}
+
+// bufferedConn reads what was buffered while reading the proxy reply before the rest of the connection.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (bc *bufferedConn) Read(p []byte) (int, error) {
+	return bc.r.Read(p)
+}
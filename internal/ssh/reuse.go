@@ -0,0 +1,124 @@
+package ssh
+
+import (
+	"sync"
+	"time"
+)
+
+// maxIdleConns bounds the tunneled connections kept open per ssh client.
+const maxIdleConns = 4
+
+type idleConn struct {
+	conn  *Connection
+	since time.Time
+}
+
+// connCache keeps tunneled connections to upstream servers open after an exchange,
+// so the next query to the same server skips opening a new channel. A nil connCache keeps nothing.
+type connCache struct {
+	mu      sync.Mutex
+	idle    map[string][]idleConn
+	count   int
+	max     int
+	timeout time.Duration
+}
+
+// newConnCache returns a connCache closing connections idle for longer than timeout,
+// or nil when timeout is 0. Idle connections hold a session slot,
+// so at most half of maxSessions are kept when the server limits them.
+func newConnCache(timeout time.Duration, maxSessions int) *connCache {
+	if timeout <= 0 {
+		return nil
+	}
+
+	max := maxIdleConns
+	if maxSessions > 0 {
+		max = min(max, maxSessions/2)
+	}
+	if max == 0 {
+		return nil
+	}
+
+	return &connCache{idle: map[string][]idleConn{}, max: max, timeout: timeout}
+}
+
+// get takes an idle connection to srv out of the cache, nil if there is none.
+func (cc *connCache) get(srv string) *Connection {
+	if cc == nil {
+		return nil
+	}
+
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+
+	cc.evictLocked(time.Now())
+
+	conns := cc.idle[srv]
+	if len(conns) == 0 {
+		return nil
+	}
+
+	last := conns[len(conns)-1]
+	cc.idle[srv] = conns[:len(conns)-1]
+	cc.count--
+
+	return last.conn
+}
+
+// put keeps conn for the next exchange with srv, closing it when the cache is full.
+func (cc *connCache) put(srv string, conn *Connection) {
+	if cc == nil {
+		conn.Close()
+		return
+	}
+
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+
+	now := time.Now()
+	cc.evictLocked(now)
+
+	if cc.count >= cc.max {
+		conn.Close()
+		return
+	}
+
+	cc.idle[srv] = append(cc.idle[srv], idleConn{conn: conn, since: now})
+	cc.count++
+}
+
+func (cc *connCache) evictLocked(now time.Time) {
+	for srv, conns := range cc.idle {
+		kept := conns[:0]
+		for _, ic := range conns {
+			if now.Sub(ic.since) > cc.timeout {
+				ic.conn.Close()
+				cc.count--
+				continue
+			}
+			kept = append(kept, ic)
+		}
+		if len(kept) == 0 {
+			delete(cc.idle, srv)
+			continue
+		}
+		cc.idle[srv] = kept
+	}
+}
+
+func (cc *connCache) closeAll() {
+	if cc == nil {
+		return
+	}
+
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+
+	for _, conns := range cc.idle {
+		for _, ic := range conns {
+			ic.conn.Close()
+		}
+	}
+	cc.idle = map[string][]idleConn{}
+	cc.count = 0
+}
@@ -0,0 +1,58 @@
+package ssh
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/fudanchii/ssh2dns/internal/log"
+)
+
+// warmInterval is how often the spare connections are checked besides after every Acquire,
+// catching those dropped by -max-idle or -max-lifetime.
+const warmInterval = 5 * time.Second
+
+// keepWarm keeps at least minIdle connections idle, established ahead of bursts
+// so they don't each wait for a full ssh handshake, and never more than the pool size.
+// It returns once the pool is closed.
+func (cp *ClientPool) keepWarm(minIdle int) {
+	ticker := time.NewTicker(warmInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-cp.done:
+			return
+		case <-ticker.C:
+		case <-cp.warm:
+		}
+
+		if cp.reconnecting.Load() {
+			continue
+		}
+
+		for {
+			pool := cp.pool.Load()
+			stat := pool.Stat()
+			spare := stat.IdleResources() + stat.ConstructingResources()
+			if int(spare) >= minIdle || stat.TotalResources() >= stat.MaxResources() {
+				break
+			}
+
+			ctx, cancel := connContext(cp.config)
+			err := pool.CreateResource(ctx)
+			cancel()
+			if err != nil {
+				log.Err(fmt.Sprintf("cannot establish a spare connection: %s", err.Error()))
+				break
+			}
+		}
+	}
+}
+
+// wake asks keepWarm to top up the spare connections, without waiting for it.
+func (cp *ClientPool) wake() {
+	select {
+	case cp.warm <- struct{}{}:
+	default:
+	}
+}
@@ -0,0 +1,68 @@
+// Package tracing emits OpenTelemetry spans for the lookup pipeline,
+// exported over OTLP/HTTP when -otlp-endpoint is given, discarded otherwise.
+package tracing
+
+import (
+	"context"
+	"strings"
+
+	"github.com/fudanchii/ssh2dns/internal/version"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.21.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracer follows the global provider, which does nothing until Setup installs one.
+var tracer = otel.Tracer("github.com/fudanchii/ssh2dns")
+
+// Setup exports spans to the OTLP/HTTP collector at endpoint, host:port over TLS,
+// or an http:// URL for plain HTTP. The returned func flushes and stops the exporter.
+func Setup(ctx context.Context, endpoint, instance string) (func(context.Context) error, error) {
+	opts := []otlptracehttp.Option{}
+	switch {
+	case strings.HasPrefix(endpoint, "http://"):
+		opts = append(opts, otlptracehttp.WithEndpoint(strings.TrimPrefix(endpoint, "http://")), otlptracehttp.WithInsecure())
+	default:
+		opts = append(opts, otlptracehttp.WithEndpoint(strings.TrimPrefix(endpoint, "https://")))
+	}
+
+	exporter, err := otlptracehttp.New(ctx, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	attrs := []attribute.KeyValue{
+		semconv.ServiceName("ssh2dns"),
+		semconv.ServiceVersion(version.String()),
+	}
+	if instance != "" {
+		attrs = append(attrs, semconv.ServiceInstanceID(instance))
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewWithAttributes(semconv.SchemaURL, attrs...)),
+	)
+	otel.SetTracerProvider(provider)
+
+	return provider.Shutdown, nil
+}
+
+// Start begins a span named name as a child of the span in ctx, if any.
+func Start(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return tracer.Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// End records err, if any, on span and ends it.
+func End(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
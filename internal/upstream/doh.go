@@ -0,0 +1,92 @@
+package upstream
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+
+	"github.com/fudanchii/ssh2dns/internal/config"
+	"github.com/fudanchii/ssh2dns/internal/errors"
+	"github.com/miekg/dns"
+)
+
+const dohContentType = "application/dns-message"
+
+// dohClient sends queries to an RFC 8484 DNS-over-HTTPS resolver.
+type dohClient struct {
+	url  string
+	http *http.Client
+}
+
+func newDoHClient(cfg *config.AppConfig) (*dohClient, error) {
+	u, err := url.Parse(cfg.UpstreamAddr())
+	if err != nil {
+		return nil, err
+	}
+
+	if u.Scheme != "https" {
+		return nil, fmt.Errorf("DNS-over-HTTPS upstream must be an https URL, got %s", cfg.UpstreamAddr())
+	}
+
+	tlsCfg, err := tlsConfig(cfg, u.Hostname())
+	if err != nil {
+		return nil, err
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsCfg
+
+	return &dohClient{url: u.String(), http: &http.Client{Transport: transport}}, nil
+}
+
+func (dc *dohClient) ExchangeWithContext(ctx context.Context, req *dns.Msg, _ string) (*dns.Msg, error) {
+	// RFC 8484 section 4.1 asks for ID 0, so replies stay cacheable by HTTP caches
+	query := req.Copy()
+	query.Id = 0
+
+	buf, err := query.Pack()
+	if err != nil {
+		return nil, errors.DNSWriteErr{Cause: err}
+	}
+
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, dc.url, bytes.NewReader(buf))
+	if err != nil {
+		return nil, errors.DNSWriteErr{Cause: err}
+	}
+	httpReq.Header.Set("Content-Type", dohContentType)
+	httpReq.Header.Set("Accept", dohContentType)
+
+	httpRsp, err := dc.http.Do(httpReq)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, errors.DNSDialErr{Cause: errors.ConnectionTimeout{}}
+		}
+		return nil, errors.DNSDialErr{Cause: err}
+	}
+	defer httpRsp.Body.Close()
+
+	if httpRsp.StatusCode != http.StatusOK {
+		return nil, errors.DNSReadErr{Cause: fmt.Errorf("%s answered %s", dc.url, httpRsp.Status)}
+	}
+
+	body, err := io.ReadAll(io.LimitReader(httpRsp.Body, dns.MaxMsgSize))
+	if err != nil {
+		return nil, errors.DNSReadErr{Cause: err}
+	}
+
+	rsp := new(dns.Msg)
+	if err = rsp.Unpack(body); err != nil {
+		return nil, errors.DNSReadErr{Cause: err}
+	}
+	rsp.Id = req.Id
+
+	return rsp, nil
+}
+
+func (dc *dohClient) Close() error {
+	dc.http.CloseIdleConnections()
+	return nil
+}
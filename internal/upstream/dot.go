@@ -0,0 +1,58 @@
+package upstream
+
+import (
+	"context"
+	"net"
+	"strings"
+
+	"github.com/fudanchii/ssh2dns/internal/config"
+	"github.com/fudanchii/ssh2dns/internal/errors"
+	"github.com/miekg/dns"
+)
+
+// dotClient sends queries to an RFC 7858 DNS-over-TLS resolver.
+type dotClient struct {
+	addr   string
+	client *dns.Client
+
+	// padding is the block size queries are padded to, 0 disables
+	padding int
+}
+
+func newDoTClient(cfg *config.AppConfig) (*dotClient, error) {
+	addr := cfg.UpstreamAddr()
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		addr = net.JoinHostPort(strings.Trim(addr, "[]"), "853")
+	}
+
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	tlsCfg, err := tlsConfig(cfg, host)
+	if err != nil {
+		return nil, err
+	}
+
+	return &dotClient{
+		addr:    addr,
+		client:  &dns.Client{Net: "tcp-tls", TLSConfig: tlsCfg},
+		padding: cfg.UpstreamPadding(),
+	}, nil
+}
+
+func (dc *dotClient) ExchangeWithContext(ctx context.Context, req *dns.Msg, _ string) (*dns.Msg, error) {
+	rsp, _, err := dc.client.ExchangeContext(ctx, pad(req, dc.padding), dc.addr)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, errors.DNSReadErr{Cause: errors.ConnectionTimeout{}}
+		}
+		return nil, errors.DNSReadErr{Cause: err}
+	}
+	return rsp, nil
+}
+
+func (dc *dotClient) Close() error {
+	return nil
+}
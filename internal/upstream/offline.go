@@ -0,0 +1,22 @@
+package upstream
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/fudanchii/ssh2dns/internal/recdns"
+)
+
+// NewOfflinePool returns a pool that never connects anywhere, for -cache-only,
+// every Acquire fails so a lookup made anyway ends in SERVFAIL rather than leaving the host.
+func NewOfflinePool() recdns.DNSClientPool {
+	return offlinePool{}
+}
+
+type offlinePool struct{}
+
+func (offlinePool) Acquire(context.Context) (recdns.PoolItemWrapper[recdns.DNSClient], error) {
+	return nil, fmt.Errorf("no upstream with -cache-only")
+}
+
+func (offlinePool) Close() {}
@@ -0,0 +1,41 @@
+package upstream
+
+import (
+	"github.com/miekg/dns"
+	"github.com/samber/lo"
+)
+
+const (
+	// paddingUDPSize is the EDNS0 buffer size advertised when a query only needs OPT to carry the padding.
+	paddingUDPSize = 1232
+
+	// optionHeaderLen is the option code and length preceding the padding bytes.
+	optionHeaderLen = 4
+)
+
+// pad returns a copy of msg whose wire length is a multiple of block, as RFC 7830 padding,
+// block 0 leaves msg as is.
+func pad(msg *dns.Msg, block int) *dns.Msg {
+	if block <= 0 {
+		return msg
+	}
+
+	msg = msg.Copy()
+	opt := msg.IsEdns0()
+	if opt == nil {
+		msg.SetEdns0(paddingUDPSize, false)
+		opt = msg.IsEdns0()
+	}
+	opt.Option = lo.Filter(opt.Option, func(o dns.EDNS0, _ int) bool {
+		return o.Option() != dns.EDNS0PADDING
+	})
+
+	size := msg.Len() + optionHeaderLen
+	padding := (block - size%block) % block
+	if size+padding > dns.MaxMsgSize {
+		padding = 0
+	}
+	opt.Option = append(opt.Option, &dns.EDNS0_PADDING{Padding: make([]byte, padding)})
+
+	return msg
+}
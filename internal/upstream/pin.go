@@ -0,0 +1,66 @@
+package upstream
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"strings"
+
+	"github.com/fudanchii/ssh2dns/internal/config"
+	"github.com/fudanchii/ssh2dns/internal/errors"
+)
+
+// tlsConfig returns the TLS settings to reach serverName with.
+// When -upstream-pin is given, the server is trusted by its leaf key alone,
+// the system trust store has no say since the local network is what we distrust.
+// The settings are made once, unlike the -doh listener certificate they are not reloaded on SIGHUP.
+func tlsConfig(cfg *config.AppConfig, serverName string) (*tls.Config, error) {
+	tlsCfg := &tls.Config{ServerName: serverName, MinVersion: tls.VersionTLS12}
+
+	pins, err := parsePins(cfg.UpstreamPins())
+	if err != nil || len(pins) == 0 {
+		return tlsCfg, err
+	}
+
+	tlsCfg.InsecureSkipVerify = true
+	// VerifyConnection rather than VerifyPeerCertificate, which resumed sessions skip
+	tlsCfg.VerifyConnection = func(cs tls.ConnectionState) error {
+		if len(cs.PeerCertificates) == 0 {
+			return errors.PinMismatch{Host: serverName}
+		}
+
+		got := spkiHash(cs.PeerCertificates[0])
+		for _, pin := range pins {
+			if pin == got {
+				return nil
+			}
+		}
+		return errors.PinMismatch{Host: serverName, Got: got}
+	}
+
+	return tlsCfg, nil
+}
+
+// spkiHash is the base64 SHA-256 of the certificate's public key, as in HPKP pin-sha256, e.g.
+// openssl x509 -pubkey -noout | openssl pkey -pubin -outform der | openssl dgst -sha256 -binary | base64
+func spkiHash(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+func parsePins(pins []string) ([]string, error) {
+	var parsed []string
+
+	for _, pin := range pins {
+		pin = strings.TrimPrefix(pin, "sha256/")
+		raw, err := base64.StdEncoding.DecodeString(pin)
+		if err != nil || len(raw) != sha256.Size {
+			return nil, fmt.Errorf("invalid -upstream-pin %s, expected a base64 SHA-256 hash", pin)
+		}
+		parsed = append(parsed, pin)
+	}
+
+	return parsed, nil
+}
@@ -0,0 +1,65 @@
+package upstream
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/fudanchii/ssh2dns/internal/config"
+	"github.com/fudanchii/ssh2dns/internal/recdns"
+)
+
+// NewClientPool connects lookups to a DNS-over-HTTPS or DNS-over-TLS resolver instead of the ssh tunnel,
+// as selected by -upstream. Every query goes to that resolver, whichever server the lookup asked for.
+func NewClientPool(cfg *config.AppConfig) (recdns.DNSClientPool, error) {
+	var (
+		client recdns.DNSClient
+		err    error
+	)
+
+	switch cfg.Upstream() {
+	case config.UpstreamDoH:
+		client, err = newDoHClient(cfg)
+	case config.UpstreamDoT:
+		client, err = newDoTClient(cfg)
+	default:
+		return nil, fmt.Errorf("unsupported upstream: %s", cfg.Upstream())
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return NewSharedPool(client), nil
+}
+
+// NewSharedPool hands out client to every lookup, for clients safe for concurrent use.
+func NewSharedPool(client recdns.DNSClient) recdns.DNSClientPool {
+	return &sharedPool{client: client}
+}
+
+// sharedPool hands out the same client to everyone,
+// the underlying transports manage their own connections and are safe for concurrent use.
+type sharedPool struct {
+	client recdns.DNSClient
+}
+
+func (sp *sharedPool) Acquire(ctx context.Context) (recdns.PoolItemWrapper[recdns.DNSClient], error) {
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	return sharedItem{sp.client}, nil
+}
+
+func (sp *sharedPool) Close() {
+	sp.client.Close()
+}
+
+type sharedItem struct {
+	client recdns.DNSClient
+}
+
+func (si sharedItem) Value() recdns.DNSClient {
+	return si.client
+}
+
+func (si sharedItem) Release() {}
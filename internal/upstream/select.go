@@ -0,0 +1,26 @@
+package upstream
+
+import (
+	"github.com/fudanchii/ssh2dns/internal/config"
+	"github.com/fudanchii/ssh2dns/internal/recdns"
+	"github.com/fudanchii/ssh2dns/internal/ssh"
+)
+
+// New picks the transport lookups go through, the ssh tunnel unless -upstream says otherwise,
+// possibly that of an OpenSSH ControlMaster, or none at all with -cache-only.
+func New(cfg *config.AppConfig) (recdns.DNSClientPool, error) {
+	if cfg.CacheOnly() {
+		return NewOfflinePool(), nil
+	}
+	if cfg.ControlPath() != "" {
+		client, err := ssh.NewMuxClient(cfg)
+		if err != nil {
+			return nil, err
+		}
+		return NewSharedPool(client), nil
+	}
+	if cfg.Upstream() == config.UpstreamSSH {
+		return ssh.NewClientPool(cfg)
+	}
+	return NewClientPool(cfg)
+}
@@ -0,0 +1,35 @@
+package version
+
+import (
+	"fmt"
+	"runtime/debug"
+	"strings"
+)
+
+// String reports the module version, vcs revision, and go version the binary was built with.
+func String() string {
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return "ssh2dns (unknown build)"
+	}
+
+	revision, modified := "unknown", false
+	for _, setting := range info.Settings {
+		switch setting.Key {
+		case "vcs.revision":
+			revision = setting.Value
+		case "vcs.modified":
+			modified = setting.Value == "true"
+		}
+	}
+
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "ssh2dns %s\n", info.Main.Version)
+	fmt.Fprintf(&sb, "commit: %s", revision)
+	if modified {
+		sb.WriteString(" (modified)")
+	}
+	fmt.Fprintf(&sb, "\ngo: %s", info.GoVersion)
+
+	return sb.String()
+}
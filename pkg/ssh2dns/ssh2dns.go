@@ -0,0 +1,58 @@
+// Package ssh2dns embeds the ssh2dns resolver in other programs, without flag parsing.
+// It resolves names the way the ssh2dns command does, over the upstream its options choose.
+package ssh2dns
+
+import (
+	"context"
+
+	"github.com/fudanchii/ssh2dns/internal/config"
+	"github.com/fudanchii/ssh2dns/internal/recdns"
+	"github.com/fudanchii/ssh2dns/internal/upstream"
+	"github.com/miekg/dns"
+)
+
+// Options configure a Resolver, keyed by the flag names of the ssh2dns command without their dash,
+// e.g. Options{"s": "example.com:22", "r": "true"}. Options left out get the flag defaults.
+type Options = config.Options
+
+// Resolver looks names up through the upstream, it is safe for concurrent use.
+type Resolver struct {
+	lc *recdns.LookupCoordinator
+}
+
+// New connects to the upstream opts choose, the ssh server unless -upstream says otherwise,
+// leaving the global flag set alone.
+func New(opts Options) (*Resolver, error) {
+	cfg, err := config.NewFromOptions(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	pool, err := upstream.New(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	lc, err := recdns.New(cfg, pool)
+	if err != nil {
+		pool.Close()
+		return nil, err
+	}
+
+	return &Resolver{lc: lc}, nil
+}
+
+// Lookup resolves name for qtype and qclass, giving up once ctx is done, or after -lookup-timeout.
+func (r *Resolver) Lookup(ctx context.Context, name string, qtype, qclass uint16) (*dns.Msg, error) {
+	return r.lc.Lookup(ctx, name, qtype, qclass)
+}
+
+// Exchange resolves the question of msg, giving up once ctx is done, or after -lookup-timeout.
+func (r *Resolver) Exchange(ctx context.Context, msg *dns.Msg) (*dns.Msg, error) {
+	return r.lc.Handle(ctx, msg)
+}
+
+// Close disconnects from the upstream.
+func (r *Resolver) Close() {
+	r.lc.Close()
+}
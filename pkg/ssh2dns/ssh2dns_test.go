@@ -0,0 +1,31 @@
+package ssh2dns_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/fudanchii/ssh2dns/pkg/ssh2dns"
+	"github.com/miekg/dns"
+)
+
+func TestNewRejectsBadOptions(t *testing.T) {
+	if _, err := ssh2dns.New(ssh2dns.Options{"no-such-flag": "1"}); err == nil {
+		t.Error("unknown option accepted")
+	}
+	if _, err := ssh2dns.New(ssh2dns.Options{"lookup-timeout": "-1s"}); err == nil {
+		t.Error("negative -lookup-timeout accepted")
+	}
+}
+
+func TestLookupCacheOnly(t *testing.T) {
+	r, err := ssh2dns.New(ssh2dns.Options{"cache-only": "true"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	// nothing is cached and nothing may be asked
+	if _, err := r.Lookup(context.Background(), "example.com", dns.TypeA, dns.ClassINET); err == nil {
+		t.Error("cache-only lookup of an uncached name succeeded")
+	}
+}